@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
 	"github.com/brysonmco/compressor/internal/auth"
 	"github.com/brysonmco/compressor/internal/db"
 	"github.com/brysonmco/compressor/internal/handlers"
+	"github.com/brysonmco/compressor/internal/jobs"
 	"github.com/brysonmco/compressor/internal/mail"
+	"github.com/brysonmco/compressor/internal/messaging"
 	internalmiddleware "github.com/brysonmco/compressor/internal/middleware"
+	"github.com/brysonmco/compressor/internal/outbox"
+	"github.com/brysonmco/compressor/internal/plans"
 	"github.com/brysonmco/compressor/internal/storage"
+	"github.com/brysonmco/compressor/internal/subscriptions"
+	"github.com/brysonmco/compressor/internal/tokens"
+	"github.com/brysonmco/compressor/internal/webhooks"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
@@ -20,6 +28,9 @@ import (
 func main() {
 	// Stripe
 	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	if apiBase := os.Getenv("STRIPE_API_BASE"); apiBase != "" {
+		subscriptions.UseAPIBase(apiBase)
+	}
 
 	// Database
 	database, err := db.NewDatabase(os.Getenv("DATABASE_URL"))
@@ -39,19 +50,94 @@ func main() {
 	mailService := mail.NewService()
 
 	// Storage
+	expiries := storage.DefaultExpiries
+	for env, expiry := range map[string]*time.Duration{
+		"S3_UPLOAD_URL_EXPIRY":   &expiries.ClientUpload,
+		"S3_DOWNLOAD_URL_EXPIRY": &expiries.ClientDownload,
+		"S3_WORKER_URL_EXPIRY":   &expiries.Worker,
+	} {
+		if value := os.Getenv(env); value != "" {
+			if *expiry, err = time.ParseDuration(value); err != nil {
+				log.Fatalf("invalid %s: %v", env, err)
+			}
+		}
+	}
 	strge, err := storage.NewStorage(
 		os.Getenv("S3_UPLOADS_BUCKET"),
+		os.Getenv("S3_DOWNLOADS_BUCKET"),
 		os.Getenv("S3_ENDPOINT"),
 		os.Getenv("S3_ACCESS_KEY"),
 		os.Getenv("S3_SECRET_KEY"),
 		os.Getenv("DEPLOYMENT_TARGET") != "development",
+		expiries,
 	)
 	if err != nil {
 		log.Fatalf("failed to connect to object storage: %v", err)
 	}
 
+	// Messaging
+	publisher, err := messaging.NewRabbitPublisher(
+		os.Getenv("RABBIT_USERNAME"),
+		os.Getenv("RABBIT_PASSWORD"),
+		os.Getenv("RABBIT_HOST"),
+	)
+	if err != nil {
+		log.Fatalf("failed to connect to message broker: %v", err)
+	}
+	defer publisher.Close()
+
+	// Background workers
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	// Outbox
+	go outbox.NewRelay(database, publisher, strge).Run(backgroundCtx)
+
+	// Job results
+	resultConsumer := messaging.NewResultConsumer(
+		os.Getenv("RABBIT_USERNAME"),
+		os.Getenv("RABBIT_PASSWORD"),
+		os.Getenv("RABBIT_HOST"),
+	)
+	go resultConsumer.Consume(backgroundCtx, jobs.NewResultApplier(database, strge).Apply)
+
+	// Jobs that were never uploaded
+	go jobs.NewExpirer(database, expiries.ClientUpload).Run(backgroundCtx)
+
+	// Job updates, for event streams
+	jobUpdates := jobs.NewUpdates(database)
+	go jobUpdates.Run(backgroundCtx)
+
+	// User webhooks
+	go webhooks.NewDispatcher(database).Run(backgroundCtx)
+
+	// Token periods
+	tokenScheduler := tokens.NewScheduler(database)
+	go tokenScheduler.Run(backgroundCtx)
+
+	// Stripe prices
+	priceCacheTTL := subscriptions.DefaultPriceCacheTTL
+	if value := os.Getenv("STRIPE_PRICE_CACHE_TTL"); value != "" {
+		if priceCacheTTL, err = time.ParseDuration(value); err != nil {
+			log.Fatalf("invalid STRIPE_PRICE_CACHE_TTL: %v", err)
+		}
+	}
+	priceCatalog := subscriptions.NewPriceCatalog(priceCacheTTL)
+
+	// Stripe webhook events
+	webhookProcessor := subscriptions.NewWebhookProcessor(database, tokenScheduler)
+	go subscriptions.NewEventWorker(database, webhookProcessor).Run(backgroundCtx)
+
+	// Stripe reconciliation, for anything the webhooks missed
+	reconciler := subscriptions.NewReconciler(database, webhookProcessor)
+	go reconciler.Run(backgroundCtx)
+
+	// Plans
+	planResolver := plans.NewResolver(database)
+
 	// Router
 	r := chi.NewRouter()
+	requestTimeout := 60 * time.Second
 
 	// CORS
 	var allowedOrigins []string
@@ -65,7 +151,7 @@ func main() {
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   allowedOrigins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Last-Event-ID"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
 		MaxAge:           300,
@@ -75,24 +161,42 @@ func main() {
 	r.Use(middleware.RequestID)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(60 * time.Second))
 
 	// Handlers
-	r.Mount("/v1/auth", handlers.NewAuthHandler(
-		database,
-		ath,
-		mailService))
-	r.Mount("/v1/subscriptions", handlers.NewSubscriptionHandler(
-		database,
-		authMiddleware,
-		os.Getenv("STRIPE_ENDPOINT_SECRET")))
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.Timeout(requestTimeout))
+		r.Mount("/v1/auth", handlers.NewAuthHandler(
+			database,
+			ath,
+			mailService))
+		r.Mount("/v1/subscriptions", handlers.NewSubscriptionHandler(
+			database,
+			authMiddleware,
+			os.Getenv("STRIPE_ENDPOINT_SECRET"),
+			webhookProcessor,
+			priceCatalog,
+			reconciler))
+		r.Mount("/v1/users", handlers.NewUserHandler(
+			database,
+			authMiddleware,
+			planResolver))
+		r.Mount("/v1/api-keys", handlers.NewApiKeyHandler(
+			database,
+			ath,
+			authMiddleware))
+		r.Mount("/v1/webhooks", handlers.NewWebhookHandler(
+			database,
+			authMiddleware,
+			os.Getenv("DEPLOYMENT_TARGET") == "development"))
+	})
+	// Times out everything but its event streams itself
 	r.Mount("/v1/compress", handlers.NewCompressionHandler(
 		database,
 		authMiddleware,
-		strge))
-	r.Mount("/v1/users", handlers.NewUserHandler(
-		database,
-		authMiddleware))
+		strge,
+		planResolver,
+		jobUpdates,
+		requestTimeout))
 
 	log.Fatal(http.ListenAndServe(os.Getenv("LISTEN_ADDR"), r))
 }
@@ -8,6 +8,7 @@ require (
 	github.com/go-chi/cors v1.2.1
 	github.com/jackc/pgx/v5 v5.7.4
 	github.com/minio/minio-go/v7 v7.0.92
+	github.com/rabbitmq/amqp091-go v1.10.0
 	github.com/stripe/stripe-go/v82 v82.1.0
 	golang.org/x/crypto v0.38.0
 )
@@ -100,6 +100,18 @@ func (a *Auth) GenerateRefreshToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
+// ApiKeyPrefix starts every API key, which is how they are told apart from access tokens.
+const ApiKeyPrefix = "cmp_"
+
+// GenerateApiKey creates a key to be shown to the user once and stored hashed with HashRefreshToken.
+func (a *Auth) GenerateApiKey() (string, error) {
+	token, err := a.GenerateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	return ApiKeyPrefix + token, nil
+}
+
 func (a *Auth) HashRefreshToken(token string) string {
 	sum := sha256.Sum256([]byte(token))
 	return hex.EncodeToString(sum[:])
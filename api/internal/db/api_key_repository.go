@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/jackc/pgx/v5"
+)
+
+const apiKeyColumns = `id, user_id, name, prefix, key_hash, scopes, expires_at, last_used_at, revoked_at, created_at`
+
+func scanApiKey(row pgx.Row) (*models.ApiKey, error) {
+	var key models.ApiKey
+	if err := row.Scan(
+		&key.Id,
+		&key.UserId,
+		&key.Name,
+		&key.Prefix,
+		&key.KeyHash,
+		&key.Scopes,
+		&key.ExpiresAt,
+		&key.LastUsedAt,
+		&key.RevokedAt,
+		&key.CreatedAt,
+	); err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (d *Database) CreateApiKey(
+	ctx context.Context,
+	keyReq models.CreateApiKey,
+) (*models.ApiKey, error) {
+	query := `INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING ` + apiKeyColumns
+
+	return scanApiKey(d.Pool.QueryRow(ctx, query,
+		keyReq.UserId,
+		keyReq.Name,
+		keyReq.Prefix,
+		keyReq.KeyHash,
+		keyReq.Scopes,
+		keyReq.ExpiresAt,
+	))
+}
+
+func (d *Database) FindApiKeyById(
+	ctx context.Context,
+	id int64,
+) (*models.ApiKey, error) {
+	query := `SELECT ` + apiKeyColumns + `
+		FROM api_keys
+		WHERE id = $1`
+
+	return scanApiKey(d.Pool.QueryRow(ctx, query, id))
+}
+
+func (d *Database) FindApiKeyByHash(
+	ctx context.Context,
+	keyHash string,
+) (*models.ApiKey, error) {
+	query := `SELECT ` + apiKeyColumns + `
+		FROM api_keys
+		WHERE key_hash = $1`
+
+	return scanApiKey(d.Pool.QueryRow(ctx, query, keyHash))
+}
+
+// FindApiKeysByUserId returns all of a user's keys, revoked and expired ones included, newest first.
+func (d *Database) FindApiKeysByUserId(
+	ctx context.Context,
+	userId int64,
+) ([]*models.ApiKey, error) {
+	query := `SELECT ` + apiKeyColumns + `
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id DESC`
+
+	rows, err := d.Pool.Query(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*models.ApiKey{}
+	for rows.Next() {
+		key, err := scanApiKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (d *Database) RevokeApiKey(
+	ctx context.Context,
+	id int64,
+) error {
+	query := `UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`
+
+	cmdTag, err := d.Pool.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("could not revoke api key")
+	}
+	return nil
+}
+
+// TouchApiKey records that a key was used. It is only written once a minute, a key used in a tight loop would
+// otherwise update the row on every request.
+func (d *Database) TouchApiKey(
+	ctx context.Context,
+	id int64,
+) error {
+	query := `UPDATE api_keys
+		SET last_used_at = now()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute')`
+
+	_, err := d.Pool.Exec(ctx, query, id)
+	return err
+}
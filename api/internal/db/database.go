@@ -3,6 +3,8 @@ package db
 import (
 	"context"
 	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"time"
 )
@@ -35,3 +37,56 @@ func NewDatabase(configString string) (*Database, error) {
 func (d *Database) Close() {
 	d.Pool.Close()
 }
+
+// querier is satisfied by both the pool and transactions, so queries that need to run inside a transaction can share
+// their implementation with the plain version.
+type querier interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// WithTx runs fn inside a transaction, committing if it returns nil and rolling back otherwise.
+func (d *Database) WithTx(
+	ctx context.Context,
+	fn func(tx pgx.Tx) error,
+) error {
+	tx, err := d.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// TryAdvisoryLock takes a session-level advisory lock if nobody else holds it, for work that runs across many
+// transactions. The lock is held by a connection set aside for it until unlock is called. unlock is nil if the lock
+// wasn't acquired.
+func (d *Database) TryAdvisoryLock(
+	ctx context.Context,
+	key int64,
+) (func(), error) {
+	conn, err := d.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var acquired bool
+	if err = conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&acquired); err != nil || !acquired {
+		conn.Release()
+		return nil, err
+	}
+
+	return func() {
+		if _, err := conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, key); err != nil {
+			// The lock goes with the session, so a connection that can't unlock mustn't go back to the pool
+			conn.Conn().Close(context.Background())
+		}
+		conn.Release()
+	}, nil
+}
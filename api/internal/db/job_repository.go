@@ -2,22 +2,26 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/brysonmco/compressor/internal/models"
+	"github.com/jackc/pgx/v5"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func (d *Database) FindJobById(
-	ctx context.Context,
-	id int64,
-) (*models.Job, error) {
-	query := `SELECT id, user_id, created_at, updated_at, file_uploaded, file_name, status, input_codec, input_container, 
-       input_resolution_horizontal, input_resolution_vertical, input_size, output_codec, output_container, 
-       output_resolution_horizontal, output_resolution_vertical, output_size
-		FROM jobs
-		WHERE id = $1`
-
-	row := d.Pool.QueryRow(ctx, query, id)
+// jobColumns are read by every query returning a full job, most metadata is only filled in as the job progresses.
+const jobColumns = `id, user_id, created_at, updated_at, file_uploaded, COALESCE(file_name, ''), status, 
+       COALESCE(input_codec, ''), COALESCE(input_container, ''), COALESCE(input_resolution_horizontal, 0), 
+       COALESCE(input_resolution_vertical, 0), COALESCE(input_size, 0), COALESCE(input_duration, 0), 
+       COALESCE(output_codec, ''), COALESCE(output_container, ''), COALESCE(output_crf, 0), 
+       COALESCE(output_preset, ''), COALESCE(output_max_width, 0), COALESCE(output_max_height, 0), 
+       COALESCE(output_audio_bitrate, 0), COALESCE(output_resolution_horizontal, 0), 
+       COALESCE(output_resolution_vertical, 0), COALESCE(output_size, 0), progress_percent, progress_eta_seconds, 
+       progress_fps, progress_bitrate, progress_updated_at, COALESCE(failure_reason, ''), last_result_sequence`
 
+func scanJob(row pgx.Row) (*models.Job, error) {
 	var job models.Job
 	if err := row.Scan(
 		&job.Id,
@@ -32,11 +36,24 @@ func (d *Database) FindJobById(
 		&job.InputResolutionHorizontal,
 		&job.InputResolutionVertical,
 		&job.InputSize,
-		&job.OutputCodec,
-		&job.OutputContainer,
+		&job.InputDuration,
+		&job.Output.Codec,
+		&job.Output.Container,
+		&job.Output.Crf,
+		&job.Output.Preset,
+		&job.Output.MaxWidth,
+		&job.Output.MaxHeight,
+		&job.Output.AudioBitrate,
 		&job.OutputResolutionHorizontal,
 		&job.OutputResolutionVertical,
 		&job.OutputSize,
+		&job.Progress.Percent,
+		&job.Progress.EtaSeconds,
+		&job.Progress.Fps,
+		&job.Progress.BitrateKbps,
+		&job.Progress.UpdatedAt,
+		&job.FailureReason,
+		&job.LastResultSequence,
 	); err != nil {
 		return nil, err
 	}
@@ -44,72 +61,285 @@ func (d *Database) FindJobById(
 	return &job, nil
 }
 
+func (d *Database) FindJobById(
+	ctx context.Context,
+	id int64,
+) (*models.Job, error) {
+	query := `SELECT ` + jobColumns + `
+		FROM jobs
+		WHERE id = $1`
+
+	return scanJob(d.Pool.QueryRow(ctx, query, id))
+}
+
+// FindJobByIdForUpdateTx locks the job's row until the transaction ends.
+func (d *Database) FindJobByIdForUpdateTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	id int64,
+) (*models.Job, error) {
+	query := `SELECT ` + jobColumns + `
+		FROM jobs
+		WHERE id = $1
+		FOR UPDATE`
+
+	return scanJob(tx.QueryRow(ctx, query, id))
+}
+
+// FindJobsAwaitingUploadBefore returns jobs after afterId still waiting for their upload that were created before the
+// given time.
+func (d *Database) FindJobsAwaitingUploadBefore(
+	ctx context.Context,
+	before time.Time,
+	afterId int64,
+	limit int,
+) ([]*models.Job, error) {
+	query := `SELECT ` + jobColumns + `
+		FROM jobs
+		WHERE status = 'awaiting_upload' AND created_at < $1 AND id > $2
+		ORDER BY id
+		LIMIT $3`
+
+	rows, err := d.Pool.Query(ctx, query, before, afterId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*models.Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// jobSortColumns are the column, and its type for comparing against a cursor, behind each sort.
+var jobSortColumns = map[models.JobSort][2]string{
+	models.JobSortCreatedAt: {"created_at", "timestamp"},
+	models.JobSortUpdatedAt: {"updated_at", "timestamp"},
+	models.JobSortInputSize: {"COALESCE(input_size, 0)", "bigint"},
+}
+
+// FindJobsByUserId lists a user's jobs. Listings are paged with a cursor rather than an offset, so jobs being created
+// while paging don't shift what comes next.
 func (d *Database) FindJobsByUserId(
 	ctx context.Context,
 	userId int64,
+	opts *models.JobListOptions,
 ) ([]*models.Job, error) {
-	return nil, nil
+	sortColumn, ok := jobSortColumns[opts.Sort]
+	if !ok {
+		sortColumn = jobSortColumns[models.JobSortCreatedAt]
+	}
+
+	args := []any{userId}
+	arg := func(value any) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	conditions := []string{"user_id = $1"}
+	if len(opts.Statuses) > 0 {
+		statuses := make([]string, len(opts.Statuses))
+		for i, status := range opts.Statuses {
+			statuses[i] = string(status)
+		}
+		conditions = append(conditions, "status = ANY("+arg(statuses)+")")
+	}
+	if opts.CreatedAfter != nil {
+		conditions = append(conditions, "created_at >= "+arg(*opts.CreatedAfter))
+	}
+	if opts.CreatedBefore != nil {
+		conditions = append(conditions, "created_at < "+arg(*opts.CreatedBefore))
+	}
+	if opts.InputContainer != "" {
+		conditions = append(conditions, "input_container = "+arg(opts.InputContainer))
+	}
+	if opts.OutputContainer != "" {
+		conditions = append(conditions, "output_container = "+arg(opts.OutputContainer))
+	}
+
+	direction, comparison := "ASC", ">"
+	if opts.Descending {
+		direction, comparison = "DESC", "<"
+	}
+	if opts.After != nil {
+		conditions = append(conditions, fmt.Sprintf("(%s, id) %s (%s::%s, %s)", sortColumn[0], comparison,
+			arg(opts.After.Value), sortColumn[1], arg(opts.After.Id)))
+	}
+
+	query := `SELECT ` + jobColumns + `
+		FROM jobs
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY ` + sortColumn[0] + ` ` + direction + `, id ` + direction + `
+		LIMIT ` + arg(opts.Limit)
+
+	rows, err := d.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*models.Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+func (d *Database) FindJobEventsByJobId(
+	ctx context.Context,
+	jobId int64,
+) ([]*models.JobEvent, error) {
+	return d.FindJobEventsByJobIdAfter(ctx, jobId, 0)
+}
+
+// FindJobEventsByJobIdAfter returns the job's transitions recorded after the event with id afterId.
+func (d *Database) FindJobEventsByJobIdAfter(
+	ctx context.Context,
+	jobId int64,
+	afterId int64,
+) ([]*models.JobEvent, error) {
+	query := `SELECT id, job_id, from_status, to_status, reason, created_at
+		FROM job_events
+		WHERE job_id = $1 AND id > $2
+		ORDER BY id`
+
+	rows, err := d.Pool.Query(ctx, query, jobId, afterId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*models.JobEvent{}
+	for rows.Next() {
+		var event models.JobEvent
+		if err = rows.Scan(
+			&event.Id,
+			&event.JobId,
+			&event.FromStatus,
+			&event.ToStatus,
+			&event.Reason,
+			&event.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
 }
 
 func (d *Database) CreateJob(
 	ctx context.Context,
 	jobReq *models.CreateJob,
 ) (*models.Job, error) {
-	query := `INSERT INTO jobs (user_id, file_name, input_container, input_size)
-    		VALUES ($1, $2, $3, $4)
-    		RETURNING id, user_id, created_at, updated_at, file_uploaded, file_name, status, input_container, input_size`
+	return createJob(ctx, d.Pool, jobReq)
+}
 
-	var job models.Job
-	if err := d.Pool.QueryRow(ctx, query,
+func (d *Database) CreateJobTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	jobReq *models.CreateJob,
+) (*models.Job, error) {
+	return createJob(ctx, tx, jobReq)
+}
+
+func createJob(
+	ctx context.Context,
+	q querier,
+	jobReq *models.CreateJob,
+) (*models.Job, error) {
+	query := `INSERT INTO jobs (user_id, file_name, input_container, input_size, output_codec, output_container, 
+                  output_crf, output_preset, output_max_width, output_max_height, output_audio_bitrate)
+    		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+    		RETURNING ` + jobColumns
+
+	return scanJob(q.QueryRow(ctx, query,
 		jobReq.UserId,
 		jobReq.FileName,
 		jobReq.InputContainer,
 		jobReq.InputSize,
-	).Scan(
-		&job.Id,
-		&job.UserId,
-		&job.CreatedAt,
-		&job.UpdatedAt,
-		&job.FileUploaded,
-		&job.FileName,
-		&job.Status,
-		&job.InputContainer,
-		&job.InputSize,
-	); err != nil {
-		return nil, err
-	}
-
-	return &job, nil
+		jobReq.Output.Codec,
+		jobReq.Output.Container,
+		jobReq.Output.Crf,
+		jobReq.Output.Preset,
+		jobReq.Output.MaxWidth,
+		jobReq.Output.MaxHeight,
+		jobReq.Output.AudioBitrate,
+	))
 }
 
 func (d *Database) UpdateJob(
 	ctx context.Context,
 	job *models.Job,
+) error {
+	return updateJob(ctx, d.Pool, job)
+}
+
+func (d *Database) UpdateJobTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	job *models.Job,
+) error {
+	return updateJob(ctx, tx, job)
+}
+
+// updateJob writes everything but the job's status, which only changes through TransitionJob.
+func updateJob(
+	ctx context.Context,
+	q querier,
+	job *models.Job,
 ) error {
 	query := `UPDATE jobs 
-		SET user_id = $1, created_at = $2, updated_at = $3, file_uploaded = $4, file_name = $5, status = $6, 
-		    input_codec = $7, input_container = $8, input_resolution_horizontal = $9, input_resolution_vertical = $10,
-		    input_size = $11, output_codec = $12, output_container = $13, output_resolution_horizontal = $14, 
-		    output_resolution_vertical = $15, output_size = $16
-		WHERE id = $17`
+		SET user_id = $1, created_at = $2, updated_at = $3, file_uploaded = $4, file_name = $5, input_codec = $6, 
+		    input_container = $7, input_resolution_horizontal = $8, input_resolution_vertical = $9, input_size = $10, 
+		    input_duration = $11, output_codec = $12, output_container = $13, output_crf = $14, output_preset = $15, 
+		    output_max_width = $16, output_max_height = $17, output_audio_bitrate = $18, 
+		    output_resolution_horizontal = $19, output_resolution_vertical = $20, output_size = $21, 
+		    progress_percent = $22, progress_eta_seconds = $23, progress_fps = $24, progress_bitrate = $25, 
+		    progress_updated_at = $26, failure_reason = NULLIF($27, ''), last_result_sequence = $28
+		WHERE id = $29`
 
-	cmdTag, err := d.Pool.Exec(ctx, query,
+	cmdTag, err := q.Exec(ctx, query,
 		job.UserId,
 		job.CreatedAt,
 		job.UpdatedAt,
 		job.FileUploaded,
 		job.FileName,
-		job.Status,
 		job.InputCodec,
 		job.InputContainer,
 		job.InputResolutionHorizontal,
 		job.InputResolutionVertical,
 		job.InputSize,
-		job.OutputCodec,
-		job.OutputContainer,
+		job.InputDuration,
+		job.Output.Codec,
+		job.Output.Container,
+		job.Output.Crf,
+		job.Output.Preset,
+		job.Output.MaxWidth,
+		job.Output.MaxHeight,
+		job.Output.AudioBitrate,
 		job.OutputResolutionHorizontal,
 		job.OutputResolutionVertical,
 		job.OutputSize,
+		job.Progress.Percent,
+		job.Progress.EtaSeconds,
+		job.Progress.Fps,
+		job.Progress.BitrateKbps,
+		job.Progress.UpdatedAt,
+		job.FailureReason,
+		job.LastResultSequence,
 		job.Id,
 	)
 	if err != nil {
@@ -119,5 +349,104 @@ func (d *Database) UpdateJob(
 	if cmdTag.RowsAffected() == 0 {
 		return fmt.Errorf("could not update job")
 	}
-	return nil
+	return notifyJobUpdated(ctx, q, job.Id)
+}
+
+// ErrJobStatusChanged is returned by TransitionJob when the job is no longer in the status the caller expected.
+var ErrJobStatusChanged = errors.New("job status changed")
+
+// TransitionJob moves a job from one status to another and records the transition. It only succeeds if the job is
+// still in the from status.
+func (d *Database) TransitionJob(
+	ctx context.Context,
+	id int64,
+	from models.JobStatus,
+	to models.JobStatus,
+	reason string,
+) error {
+	return d.WithTx(ctx, func(tx pgx.Tx) error {
+		return d.TransitionJobTx(ctx, tx, id, from, to, reason)
+	})
+}
+
+func (d *Database) TransitionJobTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	id int64,
+	from models.JobStatus,
+	to models.JobStatus,
+	reason string,
+) error {
+	if !from.CanTransitionTo(to) {
+		return fmt.Errorf("job cannot move from %s to %s", from, to)
+	}
+
+	query := `UPDATE jobs
+		SET status = $1, updated_at = now()
+		WHERE id = $2 AND status = $3`
+
+	cmdTag, err := tx.Exec(ctx, query, to, id, from)
+	if err != nil {
+		return err
+	}
+
+	if cmdTag.RowsAffected() == 0 {
+		return ErrJobStatusChanged
+	}
+
+	query = `INSERT INTO job_events (job_id, from_status, to_status, reason)
+		VALUES ($1, $2, $3, $4)`
+
+	if _, err = tx.Exec(ctx, query, id, from, to, reason); err != nil {
+		return err
+	}
+	return notifyJobUpdated(ctx, tx, id)
+}
+
+// JobUpdatesChannel is notified with a job's id whenever the job is updated. Notifications sent inside a transaction
+// are only delivered once it commits, and duplicates within one transaction are only delivered once.
+const JobUpdatesChannel = "job_updates"
+
+func notifyJobUpdated(
+	ctx context.Context,
+	q querier,
+	id int64,
+) error {
+	_, err := q.Exec(ctx, `SELECT pg_notify($1, $2)`, JobUpdatesChannel, strconv.FormatInt(id, 10))
+	return err
+}
+
+// ListenJobUpdates opens a connection of its own listening on JobUpdatesChannel, the caller must close it.
+func (d *Database) ListenJobUpdates(ctx context.Context) (*pgx.Conn, error) {
+	conn, err := d.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Taken out of the pool for good, a connection that is listening can't be handed to anyone else
+	listener := conn.Hijack()
+	if _, err = listener.Exec(ctx, `LISTEN `+JobUpdatesChannel); err != nil {
+		listener.Close(context.Background())
+		return nil, err
+	}
+	return listener, nil
+}
+
+// runningJobStatuses are the statuses that count towards a plan's concurrent job limit.
+const runningJobStatuses = `('queued', 'downloading', 'probing', 'compressing', 'uploading')`
+
+// CountRunningJobsByUserIdTx should be called with the user locked, so that concurrent callers can't both see room
+// for one more job.
+func (d *Database) CountRunningJobsByUserIdTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+) (int, error) {
+	query := `SELECT count(*)
+		FROM jobs
+		WHERE user_id = $1 AND status IN ` + runningJobStatuses
+
+	var count int
+	err := tx.QueryRow(ctx, query, userId).Scan(&count)
+	return count, err
 }
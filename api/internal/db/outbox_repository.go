@@ -0,0 +1,135 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/jackc/pgx/v5"
+	"slices"
+	"time"
+)
+
+const outboxColumns = `id, exchange, routing_key, event, job_id, payload, attempts, last_error, next_attempt_at, sent_at,
+       failed_at, created_at`
+
+func scanOutboxMessage(row pgx.Row) (*models.OutboxMessage, error) {
+	var message models.OutboxMessage
+	if err := row.Scan(
+		&message.Id,
+		&message.Exchange,
+		&message.RoutingKey,
+		&message.Event,
+		&message.JobId,
+		&message.Payload,
+		&message.Attempts,
+		&message.LastError,
+		&message.NextAttemptAt,
+		&message.SentAt,
+		&message.FailedAt,
+		&message.CreatedAt,
+	); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// CreateOutboxMessageTx queues a message to be published once tx commits.
+func (d *Database) CreateOutboxMessageTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	messageReq *models.CreateOutboxMessage,
+) (*models.OutboxMessage, error) {
+	query := `INSERT INTO outbox (exchange, routing_key, event, job_id, payload)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING ` + outboxColumns
+
+	return scanOutboxMessage(tx.QueryRow(ctx, query,
+		messageReq.Exchange,
+		messageReq.RoutingKey,
+		messageReq.Event,
+		messageReq.JobId,
+		messageReq.Payload,
+	))
+}
+
+// ClaimOutboxMessages takes up to limit messages that are due to be sent, oldest first. Claimed messages aren't due
+// again until lease has passed, so other relays leave them alone while they are published, and a relay that dies
+// part way through doesn't lose them.
+func (d *Database) ClaimOutboxMessages(
+	ctx context.Context,
+	limit int,
+	lease time.Duration,
+) ([]*models.OutboxMessage, error) {
+	query := `UPDATE outbox
+		SET next_attempt_at = now() + $2::interval
+		WHERE id IN (SELECT id
+		             FROM outbox
+		             WHERE sent_at IS NULL AND failed_at IS NULL AND next_attempt_at <= now()
+		             ORDER BY id
+		             LIMIT $1
+		             FOR UPDATE SKIP LOCKED)
+		RETURNING ` + outboxColumns
+
+	rows, err := d.Pool.Query(ctx, query, limit, lease)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []*models.OutboxMessage
+	for rows.Next() {
+		message, err := scanOutboxMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// RETURNING doesn't keep the order of the subquery
+	slices.SortFunc(messages, func(a, b *models.OutboxMessage) int {
+		return int(a.Id - b.Id)
+	})
+	return messages, nil
+}
+
+func (d *Database) MarkOutboxMessageSent(
+	ctx context.Context,
+	id int64,
+) error {
+	query := `UPDATE outbox SET sent_at = now(), attempts = attempts + 1 WHERE id = $1`
+
+	cmdTag, err := d.Pool.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("could not mark outbox message sent")
+	}
+	return nil
+}
+
+// MarkOutboxMessageFailed records a failed attempt at publishing a message, which is tried again at nextAttemptAt. The
+// message is given up on when nextAttemptAt is nil.
+func (d *Database) MarkOutboxMessageFailed(
+	ctx context.Context,
+	id int64,
+	lastError string,
+	nextAttemptAt *time.Time,
+) error {
+	query := `UPDATE outbox
+		SET attempts = attempts + 1, last_error = $1, next_attempt_at = COALESCE($2, next_attempt_at),
+		    failed_at = CASE WHEN $2::timestamp IS NULL THEN now() END
+		WHERE id = $3`
+
+	cmdTag, err := d.Pool.Exec(ctx, query, lastError, nextAttemptAt, id)
+	if err != nil {
+		return err
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("could not mark outbox message failed")
+	}
+	return nil
+}
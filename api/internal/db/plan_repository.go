@@ -2,33 +2,91 @@ package db
 
 import (
 	"context"
-	"fmt"
 	"github.com/brysonmco/compressor/internal/models"
+	"github.com/jackc/pgx/v5"
+	"time"
 )
 
+const planColumns = `id, name, tokens, priority, COALESCE(stripe_product_id, ''), concurrent_jobs, max_resolution, 
+       max_file_size, file_retention_hours, watermark`
+
+func scanPlan(row pgx.Row) (*models.Plan, error) {
+	var plan models.Plan
+	var fileRetentionHours int
+	if err := row.Scan(
+		&plan.Id,
+		&plan.Name,
+		&plan.Tokens,
+		&plan.Priority,
+		&plan.StripeProductId,
+		&plan.ConcurrentJobs,
+		&plan.MaxResolution,
+		&plan.MaxFileSize,
+		&fileRetentionHours,
+		&plan.Watermark,
+	); err != nil {
+		return nil, err
+	}
+	plan.FileRetention = time.Duration(fileRetentionHours) * time.Hour
+
+	return &plan, nil
+}
+
+// FindAllPlans returns every plan in the order they were added.
 func (d *Database) FindAllPlans(
 	ctx context.Context,
 ) ([]*models.Plan, error) {
-	return []*models.Plan{}, fmt.Errorf("not implemented")
-}
+	query := `SELECT ` + planColumns + `
+		FROM plans
+		ORDER BY id`
 
-func (d *Database) FindPlanByStripeProductId(
-	ctx context.Context,
-	stripeProductId string,
-) (*models.Plan, error) {
-	return &models.Plan{}, fmt.Errorf("not implemented")
+	rows, err := d.Pool.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plans []*models.Plan
+	for rows.Next() {
+		plan, err := scanPlan(rows)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, plan)
+	}
+
+	return plans, rows.Err()
 }
 
 func (d *Database) FindPlanById(
 	ctx context.Context,
 	id int64,
 ) (*models.Plan, error) {
-	return &models.Plan{}, fmt.Errorf("not implemented")
+	query := `SELECT ` + planColumns + `
+		FROM plans
+		WHERE id = $1`
+
+	return scanPlan(d.Pool.QueryRow(ctx, query, id))
 }
 
 func (d *Database) FindPlanByName(
 	ctx context.Context,
 	name string,
 ) (*models.Plan, error) {
-	return &models.Plan{}, fmt.Errorf("not implemented")
+	query := `SELECT ` + planColumns + `
+		FROM plans
+		WHERE name = $1`
+
+	return scanPlan(d.Pool.QueryRow(ctx, query, name))
+}
+
+func (d *Database) FindPlanByStripeProductId(
+	ctx context.Context,
+	stripeProductId string,
+) (*models.Plan, error) {
+	query := `SELECT ` + planColumns + `
+		FROM plans
+		WHERE stripe_product_id = $1`
+
+	return scanPlan(d.Pool.QueryRow(ctx, query, stripeProductId))
 }
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+// CreateStripeEvent stores a webhook event for the worker to process. It returns false if the event has already
+// been received, Stripe delivers events at least once.
+func (d *Database) CreateStripeEvent(
+	ctx context.Context,
+	eventReq *models.CreateStripeEvent,
+) (bool, error) {
+	query := `INSERT INTO stripe_events (id, type, created, payload)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO NOTHING`
+
+	cmdTag, err := d.Pool.Exec(ctx, query,
+		eventReq.Id,
+		eventReq.Type,
+		eventReq.Created,
+		eventReq.Payload,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return cmdTag.RowsAffected() == 1, nil
+}
+
+// FindPendingStripeEvents returns up to limit events that are due to be processed, oldest first. They aren't locked,
+// each one is claimed with ClaimStripeEventTx as it is processed.
+func (d *Database) FindPendingStripeEvents(
+	ctx context.Context,
+	limit int,
+) ([]*models.StripeEvent, error) {
+	query := `SELECT id, type, created, payload, attempts, last_error, next_attempt_at, processed_at, received_at
+		FROM stripe_events
+		WHERE processed_at IS NULL AND next_attempt_at <= now()
+		ORDER BY created, received_at
+		LIMIT $1`
+
+	rows, err := d.Pool.Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*models.StripeEvent
+	for rows.Next() {
+		var event models.StripeEvent
+		if err := rows.Scan(
+			&event.Id,
+			&event.Type,
+			&event.Created,
+			&event.Payload,
+			&event.Attempts,
+			&event.LastError,
+			&event.NextAttemptAt,
+			&event.ProcessedAt,
+			&event.ReceivedAt,
+		); err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
+
+// ClaimStripeEventTx locks an event until the transaction ends, reporting false if it has been processed or another
+// transaction has it locked.
+func (d *Database) ClaimStripeEventTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	id string,
+) (bool, error) {
+	query := `SELECT id
+		FROM stripe_events
+		WHERE id = $1 AND processed_at IS NULL AND next_attempt_at <= now()
+		FOR UPDATE SKIP LOCKED`
+
+	cmdTag, err := tx.Exec(ctx, query, id)
+	if err != nil {
+		return false, err
+	}
+	return cmdTag.RowsAffected() == 1, nil
+}
+
+func (d *Database) MarkStripeEventProcessedTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	id string,
+) error {
+	query := `UPDATE stripe_events SET processed_at = now(), attempts = attempts + 1 WHERE id = $1`
+
+	cmdTag, err := tx.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("could not mark stripe event processed")
+	}
+	return nil
+}
+
+// MarkStripeEventFailedTx records a failed attempt at an event. Without a nextAttemptAt it isn't tried again.
+func (d *Database) MarkStripeEventFailedTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	id string,
+	lastError string,
+	nextAttemptAt *time.Time,
+) error {
+	query := `UPDATE stripe_events SET attempts = attempts + 1, last_error = $1, next_attempt_at = $2 WHERE id = $3`
+
+	cmdTag, err := tx.Exec(ctx, query, lastError, nextAttemptAt, id)
+	if err != nil {
+		return err
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("could not mark stripe event failed")
+	}
+	return nil
+}
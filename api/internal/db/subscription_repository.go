@@ -2,20 +2,15 @@ package db
 
 import (
 	"context"
+	"fmt"
 	"github.com/brysonmco/compressor/internal/models"
+	"github.com/jackc/pgx/v5"
 )
 
-func (d *Database) FindSubscriptionById(
-	ctx context.Context,
-	id int64,
-) (*models.Subscription, error) {
-	query := `SELECT id, user_id, stripe_subscription_id, stripe_price_id, plan_id, status, current_period_start, 
-       current_period_end, created_at, updated_at 
-		FROM subscriptions
-		WHERE id = $1`
-
-	row := d.Pool.QueryRow(ctx, query, id)
+const subscriptionColumns = `id, user_id, stripe_subscription_id, stripe_price_id, plan_id, status, current_period_start,
+       current_period_end, cancel_at_period_end, created_at, updated_at, last_event_at`
 
+func scanSubscription(row pgx.Row) (*models.Subscription, error) {
 	var subscription models.Subscription
 	if err := row.Scan(
 		&subscription.Id,
@@ -26,8 +21,10 @@ func (d *Database) FindSubscriptionById(
 		&subscription.Status,
 		&subscription.CurrentPeriodStart,
 		&subscription.CurrentPeriodEnd,
+		&subscription.CancelAtPeriodEnd,
 		&subscription.CreatedAt,
 		&subscription.UpdatedAt,
+		&subscription.LastEventAt,
 	); err != nil {
 		return nil, err
 	}
@@ -35,48 +32,107 @@ func (d *Database) FindSubscriptionById(
 	return &subscription, nil
 }
 
+func (d *Database) FindSubscriptionById(
+	ctx context.Context,
+	id int64,
+) (*models.Subscription, error) {
+	query := `SELECT ` + subscriptionColumns + `
+		FROM subscriptions
+		WHERE id = $1`
+
+	return scanSubscription(d.Pool.QueryRow(ctx, query, id))
+}
+
+func (d *Database) FindSubscriptionByStripeSubscriptionId(
+	ctx context.Context,
+	stripeSubscriptionId string,
+) (*models.Subscription, error) {
+	query := `SELECT ` + subscriptionColumns + `
+		FROM subscriptions
+		WHERE stripe_subscription_id = $1`
+
+	return scanSubscription(d.Pool.QueryRow(ctx, query, stripeSubscriptionId))
+}
+
+// FindSubscriptionByStripeSubscriptionIdForUpdateTx locks the subscription's row until the transaction ends.
+func (d *Database) FindSubscriptionByStripeSubscriptionIdForUpdateTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	stripeSubscriptionId string,
+) (*models.Subscription, error) {
+	query := `SELECT ` + subscriptionColumns + `
+		FROM subscriptions
+		WHERE stripe_subscription_id = $1
+		FOR UPDATE`
+
+	return scanSubscription(tx.QueryRow(ctx, query, stripeSubscriptionId))
+}
+
 func (d *Database) FindActiveSubscriptionByUserId(
 	ctx context.Context,
 	userId int64,
 ) (*models.Subscription, error) {
-	query := `SELECT id, user_id, stripe_subscription_id, stripe_price_id, plan_id, status, current_period_start, 
-	   current_period_end, created_at, updated_at 
+	return findActiveSubscription(ctx, d.Pool, userId)
+}
+
+func (d *Database) FindActiveSubscriptionByUserIdTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+) (*models.Subscription, error) {
+	return findActiveSubscription(ctx, tx, userId)
+}
+
+func findActiveSubscription(
+	ctx context.Context,
+	q querier,
+	userId int64,
+) (*models.Subscription, error) {
+	query := `SELECT ` + subscriptionColumns + `
 		FROM subscriptions
 		WHERE user_id = $1 AND status = 'active'`
 
-	row := d.Pool.QueryRow(ctx, query, userId)
+	return scanSubscription(q.QueryRow(ctx, query, userId))
+}
+
+func (d *Database) FindSubscriptionsByUserId(
+	ctx context.Context,
+	userId int64,
+) ([]*models.Subscription, error) {
+	query := `SELECT ` + subscriptionColumns + `
+		FROM subscriptions
+		WHERE user_id = $1
+		ORDER BY id`
 
-	var subscription models.Subscription
-	if err := row.Scan(
-		&subscription.Id,
-		&subscription.UserId,
-		&subscription.StripeSubscriptionId,
-		&subscription.StripePriceId,
-		&subscription.PlanId,
-		&subscription.Status,
-		&subscription.CurrentPeriodStart,
-		&subscription.CurrentPeriodEnd,
-		&subscription.CreatedAt,
-		&subscription.UpdatedAt,
-	); err != nil {
+	rows, err := d.Pool.Query(ctx, query, userId)
+	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return &subscription, nil
+	var subscriptions []*models.Subscription
+	for rows.Next() {
+		subscription, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	return subscriptions, rows.Err()
 }
 
-func (d *Database) CreateSubscription(
+func (d *Database) CreateSubscriptionTx(
 	ctx context.Context,
+	tx pgx.Tx,
 	subscriptionReq models.CreateSubscription,
 ) (*models.Subscription, error) {
-	query := `INSERT INTO subscriptions (user_id, stripe_subscription_id, stripe_price_id, plan_id, status, 
-                           current_period_start, current_period_end) 
-			VALUES ($1, $2, $3, $4, $5, $6)
-    		RETURNING id, user_id, stripe_subscription_id, stripe_price_id, plan_id, status, current_period_start, 
-    		    current_period_end, created_at, updated_at`
+	query := `INSERT INTO subscriptions (user_id, stripe_subscription_id, stripe_price_id, plan_id, status,
+                           current_period_start, current_period_end, cancel_at_period_end, last_event_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+    		RETURNING ` + subscriptionColumns
 
-	var subscription models.Subscription
-	if err := d.Pool.QueryRow(ctx, query,
+	return scanSubscription(tx.QueryRow(ctx, query,
 		subscriptionReq.UserId,
 		subscriptionReq.StripeSubscriptionId,
 		subscriptionReq.StripePriceId,
@@ -84,20 +140,39 @@ func (d *Database) CreateSubscription(
 		subscriptionReq.Status,
 		subscriptionReq.CurrentPeriodStart,
 		subscriptionReq.CurrentPeriodEnd,
-	).Scan(
-		&subscription.Id,
-		&subscription.UserId,
-		&subscription.StripeSubscriptionId,
-		&subscription.StripePriceId,
-		&subscription.PlanId,
-		&subscription.Status,
-		&subscription.CurrentPeriodStart,
-		&subscription.CurrentPeriodEnd,
-		&subscription.CreatedAt,
-		&subscription.UpdatedAt,
-	); err != nil {
-		return nil, err
+		subscriptionReq.CancelAtPeriodEnd,
+		subscriptionReq.LastEventAt,
+	))
+}
+
+// UpdateSubscriptionTx writes a subscription's price, plan, status, period, pending cancellation and the time of the
+// state it came from.
+func (d *Database) UpdateSubscriptionTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	subscription *models.Subscription,
+) error {
+	query := `UPDATE subscriptions
+		SET stripe_price_id = $1, plan_id = $2, status = $3, current_period_start = $4, current_period_end = $5,
+		    cancel_at_period_end = $6, last_event_at = $7, updated_at = now()
+		WHERE id = $8`
+
+	cmdTag, err := tx.Exec(ctx, query,
+		subscription.StripePriceId,
+		subscription.PlanId,
+		subscription.Status,
+		subscription.CurrentPeriodStart,
+		subscription.CurrentPeriodEnd,
+		subscription.CancelAtPeriodEnd,
+		subscription.LastEventAt,
+		subscription.Id,
+	)
+	if err != nil {
+		return err
 	}
 
-	return &subscription, nil
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("could not update subscription")
+	}
+	return nil
 }
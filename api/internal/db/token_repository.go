@@ -0,0 +1,479 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+// ErrInsufficientTokens is returned when a user doesn't have enough available tokens to reserve for a job.
+var ErrInsufficientTokens = errors.New("insufficient tokens")
+
+func (d *Database) FindTokenBalanceByUserId(
+	ctx context.Context,
+	userId int64,
+) (*models.TokenLedgerBalance, error) {
+	return findTokenBalance(ctx, d.Pool, userId)
+}
+
+func (d *Database) FindTokenBalanceByUserIdTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+) (*models.TokenLedgerBalance, error) {
+	return findTokenBalance(ctx, tx, userId)
+}
+
+func findTokenBalance(
+	ctx context.Context,
+	q querier,
+	userId int64,
+) (*models.TokenLedgerBalance, error) {
+	query := `SELECT COALESCE(sum(amount) FILTER (WHERE account = 'available'), 0),
+       COALESCE(sum(amount) FILTER (WHERE account = 'reserved'), 0)
+		FROM token_entries
+		WHERE user_id = $1`
+
+	var balance models.TokenLedgerBalance
+	if err := q.QueryRow(ctx, query, userId).Scan(
+		&balance.Available,
+		&balance.Reserved,
+	); err != nil {
+		return nil, err
+	}
+
+	return &balance, nil
+}
+
+// GrantTokensTx credits tokens to a user's available balance.
+func (d *Database) GrantTokensTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+	amount int,
+	description string,
+) error {
+	return postTokenTransaction(ctx, tx, userId, nil, "", models.TokenGrant, description, []models.TokenEntry{
+		{Account: models.TokenAccountGranted, Amount: -amount},
+		{Account: models.TokenAccountAvailable, Amount: amount},
+	})
+}
+
+// PurchaseTokensTx credits tokens a user has paid for to their available balance. They never expire. Each checkout
+// session is only ever credited once, later calls for the same one do nothing.
+func (d *Database) PurchaseTokensTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+	amount int,
+	checkoutSessionId string,
+	description string,
+) error {
+	query := `SELECT EXISTS (SELECT 1 FROM token_transactions WHERE reference = $1)`
+
+	var credited bool
+	if err := tx.QueryRow(ctx, query, checkoutSessionId).Scan(&credited); err != nil || credited {
+		return err
+	}
+
+	return postTokenTransaction(ctx, tx, userId, nil, checkoutSessionId, models.TokenPurchase, description,
+		[]models.TokenEntry{
+			{Account: models.TokenAccountPurchased, Amount: -amount},
+			{Account: models.TokenAccountAvailable, Amount: amount},
+		})
+}
+
+// FindTokensSpentSinceTx returns how many tokens a user has been charged for jobs since the given time.
+func (d *Database) FindTokensSpentSinceTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+	since time.Time,
+) (int, error) {
+	query := `SELECT COALESCE(sum(amount), 0)
+		FROM token_entries
+		WHERE user_id = $1 AND account = 'spent' AND created_at >= $2`
+
+	var spent int
+	err := tx.QueryRow(ctx, query, userId, since).Scan(&spent)
+	return spent, err
+}
+
+// ExpireTokensTx removes tokens from a user's available balance.
+func (d *Database) ExpireTokensTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+	amount int,
+	description string,
+) error {
+	return postTokenTransaction(ctx, tx, userId, nil, "", models.TokenExpiration, description, []models.TokenEntry{
+		{Account: models.TokenAccountAvailable, Amount: -amount},
+		{Account: models.TokenAccountExpired, Amount: amount},
+	})
+}
+
+// ReserveTokensTx holds tokens for a job until it is settled or refunded. The user must be locked with LockUserTx so
+// the balance can't be spent twice.
+func (d *Database) ReserveTokensTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+	jobId int64,
+	amount int,
+) error {
+	balance, err := findTokenBalance(ctx, tx, userId)
+	if err != nil {
+		return err
+	}
+	if balance.Available < amount {
+		return ErrInsufficientTokens
+	}
+
+	return postTokenTransaction(ctx, tx, userId, &jobId, "", models.TokenReservation, "", reservationEntries(amount))
+}
+
+// ExtendJobReservationTx makes sure at least amount tokens are reserved for a job, reserving the difference from the
+// available balance. Jobs with nothing reserved aren't metered and are left alone. The user must be locked with
+// LockUserTx.
+func (d *Database) ExtendJobReservationTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+	jobId int64,
+	amount int,
+) error {
+	reserved, err := findJobReservation(ctx, tx, jobId)
+	if err != nil || reserved == 0 || reserved >= amount {
+		return err
+	}
+
+	return d.ReserveTokensTx(ctx, tx, userId, jobId, amount-reserved)
+}
+
+// SettleJobTokensTx charges a finished job's actual cost against its reservation. Anything reserved but not used is
+// refunded, anything used beyond the reservation is taken from the available balance as far as it goes, the balance
+// is never overdrawn. Jobs with nothing reserved aren't metered and settle to nothing, which also makes settling
+// idempotent. The user must be locked with LockUserTx.
+func (d *Database) SettleJobTokensTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+	jobId int64,
+	cost int,
+) error {
+	reserved, err := findJobReservation(ctx, tx, jobId)
+	if err != nil || reserved == 0 {
+		return err
+	}
+
+	var available int
+	if cost > reserved {
+		balance, err := findTokenBalance(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+		available = balance.Available
+	}
+
+	debit, refund := settlementEntries(cost, reserved, available)
+	if err = postTokenTransaction(ctx, tx, userId, &jobId, "", models.TokenDebit, "", debit); err != nil {
+		return err
+	}
+	if len(refund) > 0 {
+		return postTokenTransaction(ctx, tx, userId, &jobId, "", models.TokenRefund, "unused reservation", refund)
+	}
+	return nil
+}
+
+// RefundJobTokensTx returns everything still reserved for a job to the user's available balance.
+func (d *Database) RefundJobTokensTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+	jobId int64,
+	reason string,
+) error {
+	reserved, err := findJobReservation(ctx, tx, jobId)
+	if err != nil || reserved == 0 {
+		return err
+	}
+
+	return postTokenTransaction(ctx, tx, userId, &jobId, "", models.TokenRefund, reason, refundEntries(reserved))
+}
+
+// reservationEntries move amount from the available balance to the reserved account.
+func reservationEntries(amount int) []models.TokenEntry {
+	return []models.TokenEntry{
+		{Account: models.TokenAccountAvailable, Amount: -amount},
+		{Account: models.TokenAccountReserved, Amount: amount},
+	}
+}
+
+// settlementEntries charge cost against what is reserved for a job, anything over the reservation is taken from
+// available as far as it goes. The refund returns whatever was reserved but not used, and is empty if nothing was.
+func settlementEntries(
+	cost int,
+	reserved int,
+	available int,
+) ([]models.TokenEntry, []models.TokenEntry) {
+	charged := min(cost, reserved)
+	if cost > reserved {
+		charged += min(cost-reserved, max(available, 0))
+	}
+
+	debit := []models.TokenEntry{
+		{Account: models.TokenAccountReserved, Amount: -min(cost, reserved)},
+		{Account: models.TokenAccountSpent, Amount: charged},
+	}
+	if charged > reserved {
+		debit = append(debit, models.TokenEntry{Account: models.TokenAccountAvailable, Amount: reserved - charged})
+	}
+
+	if cost >= reserved {
+		return debit, nil
+	}
+	return debit, refundEntries(reserved - cost)
+}
+
+// refundEntries return amount from the reserved account to the available balance.
+func refundEntries(amount int) []models.TokenEntry {
+	return []models.TokenEntry{
+		{Account: models.TokenAccountReserved, Amount: -amount},
+		{Account: models.TokenAccountAvailable, Amount: amount},
+	}
+}
+
+// findJobReservation returns how many tokens are still reserved for a job.
+func findJobReservation(
+	ctx context.Context,
+	q querier,
+	jobId int64,
+) (int, error) {
+	query := `SELECT COALESCE(sum(e.amount), 0)
+		FROM token_entries e
+		JOIN token_transactions t ON t.id = e.transaction_id
+		WHERE t.job_id = $1 AND e.account = 'reserved'`
+
+	var reserved int
+	err := q.QueryRow(ctx, query, jobId).Scan(&reserved)
+	return reserved, err
+}
+
+// postTokenTransaction writes a transaction and its entries, which must balance. reference is an optional external
+// id, such as a Stripe checkout session, that can only be posted once.
+func postTokenTransaction(
+	ctx context.Context,
+	q querier,
+	userId int64,
+	jobId *int64,
+	reference string,
+	kind models.TokenTransactionKind,
+	description string,
+	entries []models.TokenEntry,
+) error {
+	var sum int
+	for _, entry := range entries {
+		sum += entry.Amount
+	}
+	if sum != 0 {
+		return fmt.Errorf("%s transaction for user %d does not balance: %d", kind, userId, sum)
+	}
+
+	query := `INSERT INTO token_transactions (user_id, job_id, reference, kind, description)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5)
+		RETURNING id`
+
+	var transactionId int64
+	if err := q.QueryRow(ctx, query, userId, jobId, reference, kind, description).Scan(&transactionId); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		query = `INSERT INTO token_entries (transaction_id, user_id, account, amount)
+			VALUES ($1, $2, $3, $4)`
+
+		if _, err := q.Exec(ctx, query, transactionId, userId, entry.Account, entry.Amount); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FindUsersDueTokenPeriod returns users after afterId without an open token period, or whose open period has ended
+// and has a period to move on to. Subscribers only move on once their subscription has renewed.
+func (d *Database) FindUsersDueTokenPeriod(
+	ctx context.Context,
+	afterId int64,
+	limit int,
+) ([]int64, error) {
+	query := `SELECT u.id
+		FROM users u
+		LEFT JOIN token_periods p ON p.user_id = u.id AND p.closed_at IS NULL
+		LEFT JOIN subscriptions s ON s.user_id = u.id AND s.status = 'active'
+		WHERE u.id > $1
+		  AND (p.id IS NULL OR (p.period_end <= now() AND (s.id IS NULL OR s.current_period_end > p.period_end)))
+		ORDER BY u.id
+		LIMIT $2`
+
+	rows, err := d.Pool.Query(ctx, query, afterId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIds []int64
+	for rows.Next() {
+		var userId int64
+		if err = rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		userIds = append(userIds, userId)
+	}
+
+	return userIds, rows.Err()
+}
+
+func (d *Database) FindOpenTokenPeriodByUserIdTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+) (*models.TokenPeriod, error) {
+	query := `SELECT id, user_id, plan_id, granted, allocation, period_start, period_end, closed_at
+		FROM token_periods
+		WHERE user_id = $1 AND closed_at IS NULL`
+
+	var period models.TokenPeriod
+	if err := tx.QueryRow(ctx, query, userId).Scan(
+		&period.Id,
+		&period.UserId,
+		&period.PlanId,
+		&period.Granted,
+		&period.Allocation,
+		&period.PeriodStart,
+		&period.PeriodEnd,
+		&period.ClosedAt,
+	); err != nil {
+		return nil, err
+	}
+
+	return &period, nil
+}
+
+func (d *Database) CreateTokenPeriodTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	period *models.TokenPeriod,
+) error {
+	query := `INSERT INTO token_periods (user_id, plan_id, granted, allocation, period_start, period_end)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+
+	_, err := tx.Exec(ctx, query,
+		period.UserId,
+		period.PlanId,
+		period.Granted,
+		period.Allocation,
+		period.PeriodStart,
+		period.PeriodEnd,
+	)
+	return err
+}
+
+// UpdateTokenPeriodPlanTx records an open period moving onto another plan.
+func (d *Database) UpdateTokenPeriodPlanTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	period *models.TokenPeriod,
+) error {
+	query := `UPDATE token_periods
+		SET plan_id = $1, granted = $2, allocation = $3
+		WHERE id = $4 AND closed_at IS NULL`
+
+	cmdTag, err := tx.Exec(ctx, query, period.PlanId, period.Granted, period.Allocation, period.Id)
+	if err != nil {
+		return err
+	}
+
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("could not update token period")
+	}
+	return nil
+}
+
+func (d *Database) CloseTokenPeriodTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	id int64,
+) error {
+	query := `UPDATE token_periods
+		SET closed_at = now()
+		WHERE id = $1 AND closed_at IS NULL`
+
+	cmdTag, err := tx.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("could not close token period")
+	}
+	return nil
+}
+
+func (d *Database) FindActiveTokenPacks(
+	ctx context.Context,
+) ([]*models.TokenPack, error) {
+	query := `SELECT id, name, tokens, stripe_price_id, active
+		FROM token_packs
+		WHERE active AND stripe_price_id IS NOT NULL
+		ORDER BY tokens`
+
+	rows, err := d.Pool.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var packs []*models.TokenPack
+	for rows.Next() {
+		var pack models.TokenPack
+		if err = rows.Scan(
+			&pack.Id,
+			&pack.Name,
+			&pack.Tokens,
+			&pack.StripePriceId,
+			&pack.Active,
+		); err != nil {
+			return nil, err
+		}
+		packs = append(packs, &pack)
+	}
+
+	return packs, rows.Err()
+}
+
+func (d *Database) FindTokenPackById(
+	ctx context.Context,
+	id int64,
+) (*models.TokenPack, error) {
+	query := `SELECT id, name, tokens, COALESCE(stripe_price_id, ''), active
+		FROM token_packs
+		WHERE id = $1`
+
+	var pack models.TokenPack
+	if err := d.Pool.QueryRow(ctx, query, id).Scan(
+		&pack.Id,
+		&pack.Name,
+		&pack.Tokens,
+		&pack.StripePriceId,
+		&pack.Active,
+	); err != nil {
+		return nil, err
+	}
+
+	return &pack, nil
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"github.com/brysonmco/compressor/internal/models"
+	"testing"
+)
+
+// ledger sums entries into account balances, the way findTokenBalance does in SQL.
+type ledger map[models.TokenAccount]int
+
+func (l ledger) post(t *testing.T, entries []models.TokenEntry) {
+	t.Helper()
+
+	var sum int
+	for _, entry := range entries {
+		sum += entry.Amount
+		l[entry.Account] += entry.Amount
+	}
+	if sum != 0 {
+		t.Fatalf("transaction does not balance: %v", entries)
+	}
+}
+
+// reserve starts a ledger with granted tokens available and reserved of them held for a job.
+func reserve(t *testing.T, granted int, reserved int) ledger {
+	l := ledger{}
+	l.post(t, []models.TokenEntry{
+		{Account: models.TokenAccountGranted, Amount: -granted},
+		{Account: models.TokenAccountAvailable, Amount: granted},
+	})
+	l.post(t, reservationEntries(reserved))
+	return l
+}
+
+func TestReservation(t *testing.T) {
+	l := reserve(t, 100, 30)
+
+	if l[models.TokenAccountAvailable] != 70 || l[models.TokenAccountReserved] != 30 {
+		t.Errorf("expected 70 available and 30 reserved, got %v", l)
+	}
+}
+
+func TestSettlement(t *testing.T) {
+	tests := []struct {
+		name      string
+		granted   int
+		reserved  int
+		cost      int
+		available int
+		spent     int
+		refunded  bool
+	}{
+		{"exactly reserved", 100, 30, 30, 70, 30, false},
+		{"under reservation refunds the rest", 100, 30, 10, 90, 10, true},
+		{"over reservation takes from available", 100, 30, 50, 50, 50, false},
+		{"over reservation never overdraws", 40, 30, 50, 0, 40, false},
+		{"nothing left to take", 30, 30, 50, 0, 30, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := reserve(t, test.granted, test.reserved)
+
+			debit, refund := settlementEntries(test.cost, test.reserved, l[models.TokenAccountAvailable])
+			l.post(t, debit)
+			if (len(refund) > 0) != test.refunded {
+				t.Errorf("expected refund %v, got %v", test.refunded, refund)
+			}
+			l.post(t, refund)
+
+			if l[models.TokenAccountReserved] != 0 {
+				t.Errorf("expected nothing left reserved, got %d", l[models.TokenAccountReserved])
+			}
+			if l[models.TokenAccountAvailable] != test.available {
+				t.Errorf("expected %d available, got %d", test.available, l[models.TokenAccountAvailable])
+			}
+			if l[models.TokenAccountSpent] != test.spent {
+				t.Errorf("expected %d spent, got %d", test.spent, l[models.TokenAccountSpent])
+			}
+		})
+	}
+}
+
+func TestRefund(t *testing.T) {
+	l := reserve(t, 100, 30)
+	l.post(t, refundEntries(l[models.TokenAccountReserved]))
+
+	if l[models.TokenAccountAvailable] != 100 || l[models.TokenAccountReserved] != 0 {
+		t.Errorf("expected 100 available and nothing reserved, got %v", l)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/brysonmco/compressor/internal/models"
+	"github.com/jackc/pgx/v5"
 )
 
 func (d *Database) FindUserByEmail(
@@ -68,6 +69,28 @@ func (d *Database) FindUserByID(
 	return &user, nil
 }
 
+// LockUserTx serialises work on a user's jobs and tokens until the transaction ends.
+func (d *Database) LockUserTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	id int64,
+) error {
+	query := `SELECT id
+		FROM users
+		WHERE id = $1
+		FOR UPDATE`
+
+	cmdTag, err := tx.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	if cmdTag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
 func (d *Database) FindUserByStripeCustomerID(
 	ctx context.Context,
 	stripeCustomerId string,
@@ -99,6 +122,49 @@ func (d *Database) FindUserByStripeCustomerID(
 	return &user, nil
 }
 
+// FindUsersWithStripeCustomer pages through users that have a Stripe customer, in id order after afterId.
+func (d *Database) FindUsersWithStripeCustomer(
+	ctx context.Context,
+	afterId int64,
+	limit int,
+) ([]*models.User, error) {
+	query := `SELECT id, email, first_name, last_name, password_hash, stripe_customer_id, email_verified, role, created_at, 
+       updated_at, last_login
+		FROM users
+		WHERE stripe_customer_id IS NOT NULL AND id > $1
+		ORDER BY id
+		LIMIT $2`
+
+	rows, err := d.Pool.Query(ctx, query, afterId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*models.User
+	for rows.Next() {
+		var user models.User
+		if err = rows.Scan(
+			&user.Id,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.PasswordHash,
+			&user.StripeCustomerId,
+			&user.EmailVerified,
+			&user.Role,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.LastLogin,
+		); err != nil {
+			return nil, err
+		}
+		users = append(users, &user)
+	}
+
+	return users, rows.Err()
+}
+
 func (d *Database) CreateUser(
 	ctx context.Context,
 	userReq *models.CreateUser,
@@ -0,0 +1,340 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+const webhookEndpointColumns = `id, user_id, url, secret, events, created_at, updated_at`
+
+func scanWebhookEndpoint(row pgx.Row) (*models.WebhookEndpoint, error) {
+	var endpoint models.WebhookEndpoint
+	if err := row.Scan(
+		&endpoint.Id,
+		&endpoint.UserId,
+		&endpoint.Url,
+		&endpoint.Secret,
+		&endpoint.Events,
+		&endpoint.CreatedAt,
+		&endpoint.UpdatedAt,
+	); err != nil {
+		return nil, err
+	}
+
+	return &endpoint, nil
+}
+
+func (d *Database) CreateWebhookEndpoint(
+	ctx context.Context,
+	endpointReq models.CreateWebhookEndpoint,
+) (*models.WebhookEndpoint, error) {
+	query := `INSERT INTO webhook_endpoints (user_id, url, secret, events)
+		VALUES ($1, $2, $3, $4)
+		RETURNING ` + webhookEndpointColumns
+
+	return scanWebhookEndpoint(d.Pool.QueryRow(ctx, query,
+		endpointReq.UserId,
+		endpointReq.Url,
+		endpointReq.Secret,
+		endpointReq.Events,
+	))
+}
+
+func (d *Database) FindWebhookEndpointById(
+	ctx context.Context,
+	id int64,
+) (*models.WebhookEndpoint, error) {
+	query := `SELECT ` + webhookEndpointColumns + `
+		FROM webhook_endpoints
+		WHERE id = $1`
+
+	return scanWebhookEndpoint(d.Pool.QueryRow(ctx, query, id))
+}
+
+func (d *Database) FindWebhookEndpointsByUserId(
+	ctx context.Context,
+	userId int64,
+) ([]*models.WebhookEndpoint, error) {
+	query := `SELECT ` + webhookEndpointColumns + `
+		FROM webhook_endpoints
+		WHERE user_id = $1
+		ORDER BY id`
+
+	rows, err := d.Pool.Query(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	endpoints := []*models.WebhookEndpoint{}
+	for rows.Next() {
+		endpoint, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	return endpoints, rows.Err()
+}
+
+// DeleteWebhookEndpoint removes an endpoint along with its delivery logs.
+func (d *Database) DeleteWebhookEndpoint(
+	ctx context.Context,
+	id int64,
+) error {
+	cmdTag, err := d.Pool.Exec(ctx, `DELETE FROM webhook_endpoints WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("could not delete webhook endpoint")
+	}
+	return nil
+}
+
+const webhookDeliveryColumns = `d.id, d.endpoint_id, d.event_id, d.event, d.job_id, d.payload, d.status, d.attempts,
+       d.next_attempt_at, d.delivered_at, d.created_at`
+
+func scanWebhookDelivery(row pgx.Row, extra ...any) (*models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	if err := row.Scan(append([]any{
+		&delivery.Id,
+		&delivery.EndpointId,
+		&delivery.EventId,
+		&delivery.Event,
+		&delivery.JobId,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.DeliveredAt,
+		&delivery.CreatedAt,
+	}, extra...)...); err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// CreateWebhookDeliveriesTx queues an event for every one of the user's endpoints subscribed to it, they are sent
+// once tx commits.
+func (d *Database) CreateWebhookDeliveriesTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+	eventId string,
+	event string,
+	jobId int64,
+	payload json.RawMessage,
+) error {
+	query := `INSERT INTO webhook_deliveries (endpoint_id, event_id, event, job_id, payload)
+		SELECT id, $1, $2, $3, $4
+		FROM webhook_endpoints
+		WHERE user_id = $5 AND $2 = ANY (events)`
+
+	_, err := tx.Exec(ctx, query, eventId, event, jobId, payload, userId)
+	return err
+}
+
+// ClaimDueWebhookDeliveries takes up to limit pending deliveries that are due to be sent. Claimed deliveries aren't due
+// again until lease has passed, so other dispatchers leave them alone while they are sent without holding any locks,
+// and a dispatcher that dies part way through doesn't lose them.
+func (d *Database) ClaimDueWebhookDeliveries(
+	ctx context.Context,
+	limit int,
+	lease time.Duration,
+) ([]*models.DueWebhookDelivery, error) {
+	query := `UPDATE webhook_deliveries d
+		SET next_attempt_at = now() + $2::interval
+		FROM webhook_endpoints e
+		WHERE e.id = d.endpoint_id
+		  AND d.id IN (SELECT id
+		               FROM webhook_deliveries
+		               WHERE status = 'pending' AND next_attempt_at <= now()
+		               ORDER BY next_attempt_at, id
+		               LIMIT $1
+		               FOR UPDATE SKIP LOCKED)
+		RETURNING ` + webhookDeliveryColumns + `, e.url, e.secret`
+
+	rows, err := d.Pool.Query(ctx, query, limit, lease)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*models.DueWebhookDelivery
+	for rows.Next() {
+		var due models.DueWebhookDelivery
+		delivery, err := scanWebhookDelivery(rows, &due.Url, &due.Secret)
+		if err != nil {
+			return nil, err
+		}
+		due.WebhookDelivery = *delivery
+		deliveries = append(deliveries, &due)
+	}
+
+	return deliveries, rows.Err()
+}
+
+func (d *Database) FindWebhookDeliveryById(
+	ctx context.Context,
+	id int64,
+) (*models.WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + `
+		FROM webhook_deliveries d
+		WHERE d.id = $1`
+
+	return scanWebhookDelivery(d.Pool.QueryRow(ctx, query, id))
+}
+
+// FindWebhookDeliveriesByEndpointId returns up to limit of an endpoint's deliveries, newest first, starting before
+// beforeId when it is set.
+func (d *Database) FindWebhookDeliveriesByEndpointId(
+	ctx context.Context,
+	endpointId int64,
+	beforeId int64,
+	limit int,
+) ([]*models.WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + `
+		FROM webhook_deliveries d
+		WHERE d.endpoint_id = $1 AND ($2 = 0 OR d.id < $2)
+		ORDER BY d.id DESC
+		LIMIT $3`
+
+	rows, err := d.Pool.Query(ctx, query, endpointId, beforeId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*models.WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+func (d *Database) MarkWebhookDeliveryDeliveredTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	id int64,
+) error {
+	query := `UPDATE webhook_deliveries
+		SET status = 'delivered', attempts = attempts + 1, delivered_at = now()
+		WHERE id = $1`
+
+	cmdTag, err := tx.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("could not mark webhook delivery delivered")
+	}
+	return nil
+}
+
+// MarkWebhookDeliveryAttemptFailedTx schedules the next attempt of a delivery, or gives up on it when nextAttemptAt is
+// nil.
+func (d *Database) MarkWebhookDeliveryAttemptFailedTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	id int64,
+	nextAttemptAt *time.Time,
+) error {
+	query := `UPDATE webhook_deliveries
+		SET status = CASE WHEN $1::timestamp IS NULL THEN 'failed' ELSE 'pending' END, attempts = attempts + 1,
+		    next_attempt_at = COALESCE($1, next_attempt_at)
+		WHERE id = $2`
+
+	cmdTag, err := tx.Exec(ctx, query, nextAttemptAt, id)
+	if err != nil {
+		return err
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("could not mark webhook delivery attempt failed")
+	}
+	return nil
+}
+
+// RedeliverWebhookDelivery queues a delivery to be sent again straight away, with a fresh set of attempts.
+func (d *Database) RedeliverWebhookDelivery(
+	ctx context.Context,
+	id int64,
+) error {
+	query := `UPDATE webhook_deliveries
+		SET status = 'pending', attempts = 0, next_attempt_at = now(), delivered_at = NULL
+		WHERE id = $1`
+
+	cmdTag, err := d.Pool.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return fmt.Errorf("could not redeliver webhook delivery")
+	}
+	return nil
+}
+
+func (d *Database) CreateWebhookDeliveryAttemptTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	attemptReq models.CreateWebhookDeliveryAttempt,
+) error {
+	query := `INSERT INTO webhook_delivery_attempts (delivery_id, response_status, response_body, error, duration_ms)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5)`
+
+	_, err := tx.Exec(ctx, query,
+		attemptReq.DeliveryId,
+		attemptReq.ResponseStatus,
+		attemptReq.ResponseBody,
+		attemptReq.Error,
+		attemptReq.DurationMs,
+	)
+	return err
+}
+
+func (d *Database) FindWebhookDeliveryAttemptsByDeliveryId(
+	ctx context.Context,
+	deliveryId int64,
+) ([]*models.WebhookDeliveryAttempt, error) {
+	query := `SELECT id, delivery_id, response_status, response_body, error, duration_ms, created_at
+		FROM webhook_delivery_attempts
+		WHERE delivery_id = $1
+		ORDER BY id`
+
+	rows, err := d.Pool.Query(ctx, query, deliveryId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []*models.WebhookDeliveryAttempt{}
+	for rows.Next() {
+		var attempt models.WebhookDeliveryAttempt
+		if err = rows.Scan(
+			&attempt.Id,
+			&attempt.DeliveryId,
+			&attempt.ResponseStatus,
+			&attempt.ResponseBody,
+			&attempt.Error,
+			&attempt.DurationMs,
+			&attempt.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, &attempt)
+	}
+
+	return attempts, rows.Err()
+}
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/brysonmco/compressor/internal/auth"
+	"github.com/brysonmco/compressor/internal/db"
+	"github.com/brysonmco/compressor/internal/middleware"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/brysonmco/compressor/internal/utils"
+	"github.com/go-chi/chi/v5"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxActiveApiKeys = 25
+	maxApiKeyName    = 100
+	// apiKeyPrefixLength is how much of a key is kept in the clear to identify it, the random part starts after the
+	// "cmp_"
+	apiKeyPrefixLength = 12
+)
+
+type ApiKeyHandler struct {
+	Database       *db.Database
+	Auth           *auth.Auth
+	AuthMiddleware *middleware.AuthMiddleware
+}
+
+func NewApiKeyHandler(
+	database *db.Database,
+	ath *auth.Auth,
+	authMiddleware *middleware.AuthMiddleware,
+) http.Handler {
+	h := &ApiKeyHandler{
+		Database:       database,
+		Auth:           ath,
+		AuthMiddleware: authMiddleware,
+	}
+
+	// Keys can't be used to manage keys
+	r := chi.NewRouter()
+	r.With(authMiddleware.Protected).Get("/", h.handleListApiKeys)
+	r.With(authMiddleware.Protected).Post("/", h.handleCreateApiKey)
+	r.With(authMiddleware.Protected).Delete("/{id}", h.handleRevokeApiKey)
+
+	return r
+}
+
+// GET /v1/api-keys
+func (h *ApiKeyHandler) handleListApiKeys(w http.ResponseWriter, r *http.Request) {
+	id := r.Context().Value("userId").(int64)
+
+	keys, err := h.Database.FindApiKeysByUserId(r.Context(), id)
+	if err != nil {
+		log.Printf("error finding api keys: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error fetching api keys", "internal_error", nil)
+		return
+	}
+
+	utils.WriteSuccess(w, r, http.StatusOK, "api keys fetched", map[string]interface{}{
+		"keys":   keys,
+		"scopes": middleware.Scopes,
+	})
+}
+
+type createApiKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"` // Optional, keys without one last until they are revoked
+}
+
+// POST /v1/api-keys
+func (h *ApiKeyHandler) handleCreateApiKey(w http.ResponseWriter, r *http.Request) {
+	id := r.Context().Value("userId").(int64)
+
+	// Parse request body
+	var req createApiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, r, http.StatusBadRequest, "error parsing JSON", "invalid_json", nil)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxApiKeyName {
+		utils.WriteError(w, r, http.StatusBadRequest, "name must be between 1 and 100 characters", "invalid_name", nil)
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		utils.WriteError(w, r, http.StatusBadRequest, "at least one scope is required", "invalid_scopes",
+			middleware.Scopes)
+		return
+	}
+	var scopes []string
+	for _, scope := range req.Scopes {
+		if !slices.Contains(middleware.Scopes, scope) {
+			utils.WriteError(w, r, http.StatusBadRequest, "unknown scope "+scope, "invalid_scopes", middleware.Scopes)
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(time.Now()) {
+			utils.WriteError(w, r, http.StatusBadRequest, "expiresAt must be in the future", "invalid_expiry", nil)
+			return
+		}
+		expiresAt := req.ExpiresAt.UTC()
+		req.ExpiresAt = &expiresAt
+	}
+
+	existing, err := h.Database.FindApiKeysByUserId(r.Context(), id)
+	if err != nil {
+		log.Printf("error finding api keys: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "internal service error", "internal_error", nil)
+		return
+	}
+	active := 0
+	for _, key := range existing {
+		if key.IsActive() {
+			active++
+		}
+	}
+	if active >= maxActiveApiKeys {
+		utils.WriteError(w, r, http.StatusForbidden, "too many api keys", "api_key_limit", nil)
+		return
+	}
+
+	token, err := h.Auth.GenerateApiKey()
+	if err != nil {
+		log.Printf("error generating api key: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "internal service error", "internal_error", nil)
+		return
+	}
+
+	key, err := h.Database.CreateApiKey(r.Context(), models.CreateApiKey{
+		UserId:    id,
+		Name:      req.Name,
+		Prefix:    token[:apiKeyPrefixLength],
+		KeyHash:   h.Auth.HashRefreshToken(token),
+		Scopes:    scopes,
+		ExpiresAt: req.ExpiresAt,
+	})
+	if err != nil {
+		log.Printf("error creating api key: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "internal service error", "internal_error", nil)
+		return
+	}
+
+	// The only time the key is shown, we only keep its hash
+	utils.WriteSuccess(w, r, http.StatusCreated, "api key created", map[string]interface{}{
+		"key":    key,
+		"secret": token,
+	})
+}
+
+// DELETE /v1/api-keys/{id}
+func (h *ApiKeyHandler) handleRevokeApiKey(w http.ResponseWriter, r *http.Request) {
+	id := r.Context().Value("userId").(int64)
+
+	keyId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, r, http.StatusNotFound, "api key not found", "api_key_not_found", nil)
+		return
+	}
+
+	key, err := h.Database.FindApiKeyById(r.Context(), keyId)
+	if err != nil || key.UserId != id {
+		// We don't want to leak information about another user's keys
+		utils.WriteError(w, r, http.StatusNotFound, "api key not found", "api_key_not_found", nil)
+		return
+	}
+	if key.RevokedAt != nil {
+		utils.WriteError(w, r, http.StatusConflict, "api key already revoked", "api_key_revoked", nil)
+		return
+	}
+
+	if err = h.Database.RevokeApiKey(r.Context(), key.Id); err != nil {
+		log.Printf("error revoking api key: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error revoking api key", "internal_error", nil)
+		return
+	}
+
+	utils.WriteSuccess(w, r, http.StatusOK, "api key revoked", nil)
+}
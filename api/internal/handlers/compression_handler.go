@@ -1,15 +1,27 @@
 package handlers
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/brysonmco/compressor/internal/db"
+	"github.com/brysonmco/compressor/internal/jobs"
+	"github.com/brysonmco/compressor/internal/messaging"
 	"github.com/brysonmco/compressor/internal/middleware"
 	"github.com/brysonmco/compressor/internal/models"
+	"github.com/brysonmco/compressor/internal/plans"
+	"github.com/brysonmco/compressor/internal/pricing"
 	"github.com/brysonmco/compressor/internal/storage"
 	"github.com/brysonmco/compressor/internal/utils"
+	"github.com/brysonmco/compressor/internal/webhooks"
 	"github.com/go-chi/chi/v5"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/jackc/pgx/v5"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,22 +29,44 @@ type CompressionHandler struct {
 	Database       *db.Database
 	AuthMiddleware *middleware.AuthMiddleware
 	Storage        *storage.Storage
+	Plans          *plans.Resolver
+	Updates        *jobs.Updates
 }
 
 func NewCompressionHandler(
 	database *db.Database,
 	authMiddleware *middleware.AuthMiddleware,
 	strge *storage.Storage,
+	planResolver *plans.Resolver,
+	jobUpdates *jobs.Updates,
+	requestTimeout time.Duration,
 ) http.Handler {
 	h := &CompressionHandler{
 		Database:       database,
 		AuthMiddleware: authMiddleware,
 		Storage:        strge,
+		Plans:          planResolver,
+		Updates:        jobUpdates,
 	}
 
 	r := chi.NewRouter()
-	r.With(authMiddleware.Protected).Post("/new", h.handleCreateCompressionJob)
-	r.With(authMiddleware.Protected).Post("/upload-complete", h.handleUploadComplete)
+
+	// API keys are let through with the matching scope
+	jobsRead := authMiddleware.ProtectedWithScope(middleware.ScopeJobsRead)
+	jobsWrite := authMiddleware.ProtectedWithScope(middleware.ScopeJobsWrite)
+	r.Group(func(r chi.Router) {
+		r.Use(chimiddleware.Timeout(requestTimeout))
+		r.With(jobsWrite).Post("/new", h.handleCreateCompressionJob)
+		r.With(jobsWrite).Post("/upload-complete", h.handleUploadComplete)
+		r.With(jobsRead).Post("/download", h.handleDownload)
+		r.With(jobsRead).Post("/estimate", h.handleEstimate)
+		r.With(jobsRead).Get("/jobs", h.handleListJobs)
+		r.With(jobsRead).Get("/jobs/{id}", h.handleGetJob)
+		r.With(jobsWrite).Post("/jobs/{id}/cancel", h.handleCancelJob)
+	})
+
+	// Event streams stay open for as long as the client wants them, so aren't timed out
+	r.With(jobsRead).Get("/jobs/{id}/events", h.handleJobEvents)
 
 	return r
 }
@@ -40,6 +74,12 @@ func NewCompressionHandler(
 type createCompressionJobRequest struct {
 	FileName      string `json:"fileName"`
 	FileContainer string `json:"fileContainer"`
+	FileSize      int64  `json:"fileSize"` // Bytes, the upload is held to this
+	// Optional, when the client knows them the reservation is closer to what the job will actually cost
+	FileDuration float64               `json:"fileDuration"` // Seconds
+	FileWidth    int                   `json:"fileWidth"`
+	FileHeight   int                   `json:"fileHeight"`
+	Output       models.OutputSettings `json:"output"` // Optional, anything left out uses the defaults
 }
 
 func (h *CompressionHandler) handleCreateCompressionJob(w http.ResponseWriter, r *http.Request) {
@@ -53,34 +93,27 @@ func (h *CompressionHandler) handleCreateCompressionJob(w http.ResponseWriter, r
 	}
 
 	// Validate request
-	if req.FileName == "" || req.FileContainer == "" {
+	if req.FileName == "" || req.FileContainer == "" || req.FileSize <= 0 {
 		utils.WriteError(w, r, http.StatusBadRequest, "missing required fields", "missing_fields", nil)
 		return
 	}
+	if req.FileDuration < 0 || req.FileWidth < 0 || req.FileHeight < 0 {
+		utils.WriteError(w, r, http.StatusBadRequest, "invalid file details", "invalid_input", nil)
+		return
+	}
 
-	// Get their subscription
-	// TODO: Implement subscription handling
-	/*var plan *models.Plan
-	subscription, err := h.Database.FindActiveSubscriptionByUserId(r.Context(), id)
-	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
-		log.Printf("error fetching subscription: %v", err)
+	// Get their plan
+	plan, err := h.Plans.ForUser(r.Context(), id)
+	if err != nil {
+		log.Printf("error fetching plan: %v", err)
 		utils.WriteError(w, r, http.StatusInternalServerError, "error creating job", "internal_error", nil)
 		return
-	} else if errors.Is(err, pgx.ErrNoRows) {
-		plan, err = h.Database.FindPlanByName(r.Context(), "Free")
-		if err != nil {
-			log.Printf("error fetching plan: %v", err)
-			utils.WriteError(w, r, http.StatusInternalServerError, "error creating job", "internal_error", nil)
-			return
-		}
-	} else {
-		plan, err = h.Database.FindPlanById(r.Context(), subscription.PlanId)
-		if err != nil {
-			log.Printf("error fetching plan: %v", err)
-			utils.WriteError(w, r, http.StatusInternalServerError, "error creating job", "internal_error", nil)
-			return
-		}
-	}*/
+	}
+
+	if req.FileSize > plan.MaxFileSize {
+		utils.WriteError(w, r, http.StatusForbidden, "file too large for your plan", "file_size_limit", nil)
+		return
+	}
 
 	// Ensure valid container
 	allowedContainers := []string{"mp4", "mkv", "mov", "avi", "webm", "flv", "ts", "mpg", "ogg", "wav"}
@@ -94,28 +127,72 @@ func (h *CompressionHandler) handleCreateCompressionJob(w http.ResponseWriter, r
 		}
 	}
 
-	// Create job
-	job, err := h.Database.CreateJob(r.Context(), &models.CreateJob{
-		UserId:   id,
-		FileName: req.FileName,
+	// Validate output settings
+	output := req.Output.WithDefaults()
+	if err := output.Validate(); err != nil {
+		utils.WriteError(w, r, http.StatusBadRequest, "invalid output settings", "invalid_output_settings", err.Error())
+		return
+	}
+	if !plan.AllowsResolution(output.MaxWidth, output.MaxHeight) {
+		utils.WriteError(w, r, http.StatusForbidden, "resolution not allowed on your plan", "resolution_limit", nil)
+		return
+	}
+
+	// Create job, reserving what it will cost
+	var job *models.Job
+	err = h.Database.WithTx(r.Context(), func(tx pgx.Tx) error {
+		if err := h.Database.LockUserTx(r.Context(), tx, id); err != nil {
+			return err
+		}
+
+		running, err := h.Database.CountRunningJobsByUserIdTx(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		if !plan.AllowsConcurrentJobs(running) {
+			return errConcurrentJobLimit
+		}
+
+		job, err = h.Database.CreateJobTx(r.Context(), tx, &models.CreateJob{
+			UserId:         id,
+			FileName:       req.FileName,
+			InputContainer: req.FileContainer,
+			InputSize:      req.FileSize,
+			Output:         output,
+		})
+		if err != nil {
+			return err
+		}
+
+		if plan.Tokens == models.Unlimited {
+			return nil
+		}
+		tokens := pricing.Reservation(pricing.Input{
+			Size:     req.FileSize,
+			Duration: req.FileDuration,
+			Width:    req.FileWidth,
+			Height:   req.FileHeight,
+		}, output)
+		return h.Database.ReserveTokensTx(r.Context(), tx, id, job.Id, tokens)
 	})
-	if err != nil {
+	if errors.Is(err, errConcurrentJobLimit) {
+		utils.WriteError(w, r, http.StatusForbidden, "too many jobs running", "concurrent_job_limit", nil)
+		return
+	} else if errors.Is(err, db.ErrInsufficientTokens) {
+		utils.WriteError(w, r, http.StatusPaymentRequired, "not enough tokens", "insufficient_tokens", nil)
+		return
+	} else if err != nil {
 		log.Printf("error creating job: %v", err)
 		utils.WriteError(w, r, http.StatusInternalServerError, "error creating job", "internal_error", nil)
 		return
 	}
 
 	// Generate upload URL
-	uploadURL, formData, err := h.Storage.GenerateUploadURLForUploads(
-		r.Context(),
-		job.Id,
-		req.FileContainer,
-		time.Now().Add(time.Hour),
-		10240,
-	)
+	uploadURL, formData, err := h.Storage.GenerateUploadURLForUploads(r.Context(), job, req.FileSize)
 	if err != nil {
 		log.Printf("error generating upload URL: %v", err)
 		utils.WriteError(w, r, http.StatusInternalServerError, "error creating job", "internal_error", nil)
+		return
 	}
 
 	utils.WriteSuccess(w, r, http.StatusOK, "job created", map[string]interface{}{
@@ -125,6 +202,8 @@ func (h *CompressionHandler) handleCreateCompressionJob(w http.ResponseWriter, r
 	})
 }
 
+var errConcurrentJobLimit = errors.New("concurrent job limit reached")
+
 type uploadCompleteRequest struct {
 	JobId int64 `json:"jobId"`
 }
@@ -157,9 +236,13 @@ func (h *CompressionHandler) handleUploadComplete(w http.ResponseWriter, r *http
 		utils.WriteError(w, r, http.StatusBadRequest, "file already uploaded", "file_already_uploaded", nil)
 		return
 	}
+	if job.Status != models.JobStatusAwaitingUpload {
+		utils.WriteError(w, r, http.StatusBadRequest, "job is not awaiting an upload", "job_not_awaiting_upload", nil)
+		return
+	}
 
 	// Check that the file was actually uploaded
-	inUploads, err := h.Storage.FileInUploads(r.Context(), job.Id, job.InputContainer)
+	inUploads, err := h.Storage.FileInUploads(r.Context(), job)
 	if err != nil {
 		log.Printf("error checking if file exists: %v", err)
 		utils.WriteError(w, r, http.StatusInternalServerError, "error checking if file exists", "internal_error", nil)
@@ -170,17 +253,597 @@ func (h *CompressionHandler) handleUploadComplete(w http.ResponseWriter, r *http
 		return
 	}
 
-	// Update job
-	job.FileUploaded = true
-	err = h.Database.UpdateJob(r.Context(), job)
+	// Limits are re-checked as the job is queued, their plan may have changed since it was created
+	plan, err := h.Plans.ForUser(r.Context(), id)
 	if err != nil {
-		log.Printf("error updating job: %v", err)
+		log.Printf("error fetching plan: %v", err)
 		utils.WriteError(w, r, http.StatusInternalServerError, "internal service error", "internal_error", nil)
 		return
 	}
 
 	// Tell compression-service to provision a VM
-	// TODO: Implement
+	message, err := messaging.NewJobMessage(job.Id, messaging.NewJobPayload{
+		InputContainer: job.InputContainer,
+		MaxResolution:  plan.MaxResolution,
+		Output: messaging.OutputSettings{
+			Codec:        job.Output.Codec,
+			Container:    job.Output.Container,
+			Crf:          job.Output.Crf,
+			Preset:       job.Output.Preset,
+			MaxWidth:     job.Output.MaxWidth,
+			MaxHeight:    job.Output.MaxHeight,
+			AudioBitrate: job.Output.AudioBitrate,
+		},
+	})
+	if err != nil {
+		log.Printf("error creating job message: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "internal service error", "internal_error", nil)
+		return
+	}
+
+	// Update job, the message is only published by the outbox relay once this commits
+	job.FileUploaded = true
+	err = h.Database.WithTx(r.Context(), func(tx pgx.Tx) error {
+		if err := h.Database.LockUserTx(r.Context(), tx, id); err != nil {
+			return err
+		}
+
+		running, err := h.Database.CountRunningJobsByUserIdTx(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		if !plan.AllowsConcurrentJobs(running) {
+			return errConcurrentJobLimit
+		}
+
+		if err := h.Database.UpdateJobTx(r.Context(), tx, job); err != nil {
+			return err
+		}
+
+		err = h.Database.TransitionJobTx(r.Context(), tx, job.Id, job.Status, models.JobStatusQueued, "upload completed")
+		if err != nil {
+			return err
+		}
+
+		_, err = h.Database.CreateOutboxMessageTx(r.Context(), tx, &models.CreateOutboxMessage{
+			RoutingKey: messaging.JobsQueue,
+			Event:      message.Event,
+			JobId:      message.JobId,
+			Payload:    message.Payload,
+		})
+		return err
+	})
+	if errors.Is(err, db.ErrJobStatusChanged) {
+		// Another request got there first
+		utils.WriteError(w, r, http.StatusConflict, "file already uploaded", "file_already_uploaded", nil)
+		return
+	} else if errors.Is(err, errConcurrentJobLimit) {
+		utils.WriteError(w, r, http.StatusForbidden, "too many jobs running", "concurrent_job_limit", nil)
+		return
+	} else if err != nil {
+		log.Printf("error updating job: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "internal service error", "internal_error", nil)
+		return
+	}
 
 	utils.WriteSuccess(w, r, http.StatusOK, "file uploaded", nil)
 }
+
+type downloadRequest struct {
+	JobId int64 `json:"jobId"`
+}
+
+func (h *CompressionHandler) handleDownload(w http.ResponseWriter, r *http.Request) {
+	id := r.Context().Value("userId").(int64)
+
+	// Parse request body
+	var req downloadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, r, http.StatusBadRequest, "error parsing JSON", "invalid_json", nil)
+		return
+	}
+
+	// Find job
+	job, err := h.Database.FindJobById(r.Context(), req.JobId)
+	if err != nil {
+		utils.WriteError(w, r, http.StatusBadRequest, "job not found", "job_not_found", nil)
+		return
+	}
+
+	if job.UserId != id {
+		// We don't want to leak information about another user's jobs
+		utils.WriteError(w, r, http.StatusBadRequest, "job not found", "job_not_found", nil)
+		return
+	}
+
+	if job.Status != models.JobStatusCompleted {
+		utils.WriteError(w, r, http.StatusBadRequest, "job has not completed", "job_not_completed", nil)
+		return
+	}
+
+	// Check the file is still there
+	inDownloads, err := h.Storage.FileInDownloads(r.Context(), job)
+	if err != nil {
+		log.Printf("error checking if file exists: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error checking if file exists", "internal_error", nil)
+		return
+	}
+	if !inDownloads {
+		utils.WriteError(w, r, http.StatusBadRequest, "file not found", "file_not_found", nil)
+		return
+	}
+
+	downloadURL, expiresAt, err := h.Storage.GenerateDownloadURLForDownloads(r.Context(), job)
+	if err != nil {
+		log.Printf("error generating download URL: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "internal service error", "internal_error", nil)
+		return
+	}
+
+	utils.WriteSuccess(w, r, http.StatusOK, "download ready", map[string]interface{}{
+		"downloadUrl": downloadURL,
+		"expiresAt":   expiresAt,
+	})
+}
+
+type estimateRequest struct {
+	JobId  int64                 `json:"jobId"` // Optional, estimates from a probed job's input instead of Input
+	Input  pricing.Input         `json:"input"`
+	Output models.OutputSettings `json:"output"` // Optional, anything left out uses the defaults
+}
+
+func (h *CompressionHandler) handleEstimate(w http.ResponseWriter, r *http.Request) {
+	id := r.Context().Value("userId").(int64)
+
+	// Parse request body
+	var req estimateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, r, http.StatusBadRequest, "error parsing JSON", "invalid_json", nil)
+		return
+	}
+
+	input := req.Input
+	if req.JobId != 0 {
+		job, err := h.Database.FindJobById(r.Context(), req.JobId)
+		if err != nil || job.UserId != id {
+			// We don't want to leak information about another user's jobs
+			utils.WriteError(w, r, http.StatusBadRequest, "job not found", "job_not_found", nil)
+			return
+		}
+
+		input = pricing.JobInput(job)
+		if input.Duration <= 0 || input.Width <= 0 || input.Height <= 0 {
+			utils.WriteError(w, r, http.StatusBadRequest, "job has not been probed", "job_not_probed", nil)
+			return
+		}
+	} else if input.Size <= 0 {
+		utils.WriteError(w, r, http.StatusBadRequest, "missing required fields", "missing_fields", nil)
+		return
+	} else if input.Duration < 0 || input.Width < 0 || input.Height < 0 {
+		utils.WriteError(w, r, http.StatusBadRequest, "invalid input details", "invalid_input", nil)
+		return
+	}
+
+	// Validate output settings
+	output := req.Output.WithDefaults()
+	if err := output.Validate(); err != nil {
+		utils.WriteError(w, r, http.StatusBadRequest, "invalid output settings", "invalid_output_settings", err.Error())
+		return
+	}
+
+	plan, err := h.Plans.ForUser(r.Context(), id)
+	if err != nil {
+		log.Printf("error fetching plan: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "internal service error", "internal_error", nil)
+		return
+	}
+
+	estimate := pricing.EstimateJob(input, output)
+
+	utils.WriteSuccess(w, r, http.StatusOK, "estimate calculated", map[string]interface{}{
+		"tokens":     estimate.Tokens,
+		"outputSize": estimate.OutputSize,
+		// Jobs on unlimited plans aren't charged, the estimate is still what the job would cost
+		"unlimited":     plan.Tokens == models.Unlimited,
+		"allowedByPlan": input.Size <= plan.MaxFileSize && plan.AllowsResolution(output.MaxWidth, output.MaxHeight),
+	})
+}
+
+const (
+	defaultJobListLimit = 20
+	maxJobListLimit     = 100
+)
+
+// GET /v1/compress/jobs
+func (h *CompressionHandler) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	id := r.Context().Value("userId").(int64)
+	query := r.URL.Query()
+
+	opts := models.JobListOptions{
+		InputContainer:  query.Get("inputContainer"),
+		OutputContainer: query.Get("outputContainer"),
+		Sort:            models.JobSortCreatedAt,
+		Descending:      query.Get("order") != "asc",
+		Limit:           defaultJobListLimit,
+	}
+
+	// Parse filters
+	if statuses := query.Get("status"); statuses != "" {
+		for _, status := range strings.Split(statuses, ",") {
+			if !models.JobStatus(status).IsValid() {
+				utils.WriteError(w, r, http.StatusBadRequest, "invalid status", "invalid_query", status)
+				return
+			}
+			opts.Statuses = append(opts.Statuses, models.JobStatus(status))
+		}
+	}
+	for param, value := range map[string]**time.Time{
+		"createdAfter":  &opts.CreatedAfter,
+		"createdBefore": &opts.CreatedBefore,
+	} {
+		if query.Get(param) == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, query.Get(param))
+		if err != nil {
+			utils.WriteError(w, r, http.StatusBadRequest, "invalid "+param, "invalid_query", nil)
+			return
+		}
+		t = t.UTC()
+		*value = &t
+	}
+	if sort := query.Get("sort"); sort != "" {
+		if !models.JobSort(sort).IsValid() {
+			utils.WriteError(w, r, http.StatusBadRequest, "invalid sort", "invalid_query", nil)
+			return
+		}
+		opts.Sort = models.JobSort(sort)
+	}
+	if order := query.Get("order"); order != "" && order != "asc" && order != "desc" {
+		utils.WriteError(w, r, http.StatusBadRequest, "invalid order", "invalid_query", nil)
+		return
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxJobListLimit {
+			utils.WriteError(w, r, http.StatusBadRequest, "invalid limit", "invalid_query", nil)
+			return
+		}
+		opts.Limit = n
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := decodeJobCursor(cursor)
+		if err != nil || after.Sort != opts.Sort || after.Descending != opts.Descending {
+			utils.WriteError(w, r, http.StatusBadRequest, "invalid cursor", "invalid_cursor", nil)
+			return
+		}
+		opts.After = after
+	}
+
+	// Ask for one more than the page to know whether there's another
+	pageSize := opts.Limit
+	opts.Limit++
+	jobs, err := h.Database.FindJobsByUserId(r.Context(), id, &opts)
+	if err != nil {
+		log.Printf("error finding jobs: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error fetching jobs", "internal_error", nil)
+		return
+	}
+
+	var nextCursor *string
+	if len(jobs) > pageSize {
+		jobs = jobs[:pageSize]
+		cursor := encodeJobCursor(jobs[pageSize-1].CursorAfter(opts.Sort, opts.Descending))
+		nextCursor = &cursor
+	}
+	if jobs == nil {
+		jobs = []*models.Job{}
+	}
+
+	utils.WriteSuccess(w, r, http.StatusOK, "jobs fetched", map[string]interface{}{
+		"jobs":       jobs,
+		"nextCursor": nextCursor,
+	})
+}
+
+// Cursors are opaque to clients.
+func encodeJobCursor(cursor models.JobCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeJobCursor(encoded string) (*models.JobCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor models.JobCursor
+	if err = json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	if !cursor.IsValid() {
+		return nil, errors.New("invalid cursor value")
+	}
+	return &cursor, nil
+}
+
+// GET /v1/compress/jobs/{id}
+func (h *CompressionHandler) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	id := r.Context().Value("userId").(int64)
+
+	jobId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, r, http.StatusBadRequest, "job not found", "job_not_found", nil)
+		return
+	}
+
+	// Find job
+	job, err := h.Database.FindJobById(r.Context(), jobId)
+	if err != nil || job.UserId != id {
+		// We don't want to leak information about another user's jobs
+		utils.WriteError(w, r, http.StatusBadRequest, "job not found", "job_not_found", nil)
+		return
+	}
+
+	events, err := h.Database.FindJobEventsByJobId(r.Context(), job.Id)
+	if err != nil {
+		log.Printf("error finding job events: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error fetching job", "internal_error", nil)
+		return
+	}
+
+	response := map[string]interface{}{
+		"job":     job,
+		"history": events,
+	}
+
+	// Completed jobs come with a download link, as long as the file hasn't been cleaned up
+	if job.Status == models.JobStatusCompleted {
+		inDownloads, err := h.Storage.FileInDownloads(r.Context(), job)
+		if err != nil {
+			log.Printf("error checking if file exists: %v", err)
+			utils.WriteError(w, r, http.StatusInternalServerError, "error fetching job", "internal_error", nil)
+			return
+		}
+
+		if inDownloads {
+			downloadURL, expiresAt, err := h.Storage.GenerateDownloadURLForDownloads(r.Context(), job)
+			if err != nil {
+				log.Printf("error generating download URL: %v", err)
+				utils.WriteError(w, r, http.StatusInternalServerError, "error fetching job", "internal_error", nil)
+				return
+			}
+			response["downloadUrl"] = downloadURL
+			response["downloadExpiresAt"] = expiresAt
+		}
+	}
+
+	utils.WriteSuccess(w, r, http.StatusOK, "job fetched", response)
+}
+
+// errJobFinished is returned from the cancel transaction when the job ended before it could be cancelled.
+var errJobFinished = errors.New("job finished")
+
+// POST /v1/compress/jobs/{id}/cancel
+func (h *CompressionHandler) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	id := r.Context().Value("userId").(int64)
+
+	jobId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, r, http.StatusBadRequest, "job not found", "job_not_found", nil)
+		return
+	}
+
+	// Find job
+	job, err := h.Database.FindJobById(r.Context(), jobId)
+	if err != nil || job.UserId != id {
+		// We don't want to leak information about another user's jobs
+		utils.WriteError(w, r, http.StatusBadRequest, "job not found", "job_not_found", nil)
+		return
+	}
+
+	message, err := messaging.CancelJobMessage(job.Id, messaging.CancelJobPayload{Reason: "cancelled by user"})
+	if err != nil {
+		log.Printf("error creating cancel message: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "internal service error", "internal_error", nil)
+		return
+	}
+
+	// The job is locked so a result can't finish it while we are cancelling it
+	err = h.Database.WithTx(r.Context(), func(tx pgx.Tx) error {
+		job, err = h.Database.FindJobByIdForUpdateTx(r.Context(), tx, jobId)
+		if err != nil {
+			return err
+		}
+		if job.Status.IsTerminal() {
+			return errJobFinished
+		}
+
+		from := job.Status
+		err = h.Database.TransitionJobTx(r.Context(), tx, job.Id, from, models.JobStatusCancelled, "cancelled by user")
+		if err != nil {
+			return err
+		}
+		job.Status = models.JobStatusCancelled
+
+		if err = h.Database.RefundJobTokensTx(r.Context(), tx, job.UserId, job.Id, "job cancelled"); err != nil {
+			return err
+		}
+		if err = webhooks.QueueJobEventTx(r.Context(), h.Database, tx, job, job.Status); err != nil {
+			return err
+		}
+
+		// Nothing has been sent to compression-service until the upload completes
+		if from == models.JobStatusAwaitingUpload {
+			return nil
+		}
+
+		_, err = h.Database.CreateOutboxMessageTx(r.Context(), tx, &models.CreateOutboxMessage{
+			Exchange: messaging.CancellationsExchange,
+			Event:    message.Event,
+			JobId:    message.JobId,
+			Payload:  message.Payload,
+		})
+		return err
+	})
+	if errors.Is(err, errJobFinished) || errors.Is(err, db.ErrJobStatusChanged) {
+		utils.WriteError(w, r, http.StatusConflict, "job has already finished", "job_finished", nil)
+		return
+	} else if err != nil {
+		log.Printf("error cancelling job: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "internal service error", "internal_error", nil)
+		return
+	}
+
+	utils.WriteSuccess(w, r, http.StatusOK, "job cancelled", job)
+}
+
+// jobStreamHeartbeat is how often an idle job event stream is written to, so proxies don't close it and we notice when
+// the client has gone.
+const jobStreamHeartbeat = 15 * time.Second
+
+// GET /v1/compress/jobs/{id}/events
+//
+// Streams the job as Server-Sent Events. A "state" event with the whole job comes first, followed by a "status" event
+// for every transition and a "progress" event whenever the progress changes. Transitions carry their id, so a client
+// reconnecting with Last-Event-ID is sent the transitions it missed before the current state. The stream ends once the
+// job has finished. The stream is exempt from the request timeout.
+func (h *CompressionHandler) handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	id := r.Context().Value("userId").(int64)
+
+	jobId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, r, http.StatusBadRequest, "job not found", "job_not_found", nil)
+		return
+	}
+
+	// Subscribed before the job is read, so nothing that changes in between is missed
+	updates, unsubscribe := h.Updates.Subscribe(jobId)
+	defer unsubscribe()
+
+	// Find job
+	job, err := h.Database.FindJobById(r.Context(), jobId)
+	if err != nil || job.UserId != id {
+		// We don't want to leak information about another user's jobs
+		utils.WriteError(w, r, http.StatusBadRequest, "job not found", "job_not_found", nil)
+		return
+	}
+
+	// An id we didn't hand out is treated as a fresh connection
+	lastEventId, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	resumed := err == nil && lastEventId > 0
+	if !resumed {
+		lastEventId = 0
+	}
+
+	events, err := h.Database.FindJobEventsByJobIdAfter(r.Context(), job.Id, lastEventId)
+	if err != nil {
+		log.Printf("error finding job events: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error fetching job", "internal_error", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // Stop nginx holding events back
+	w.WriteHeader(http.StatusOK)
+
+	stream := &eventStream{
+		writer:     w,
+		controller: http.NewResponseController(w),
+	}
+
+	// The state covers every transition a new client hasn't seen, a resumed one only needs what it missed
+	for _, event := range events {
+		if resumed {
+			if err = stream.send("status", event.Id, event); err != nil {
+				return
+			}
+		}
+		lastEventId = event.Id
+	}
+	if err = stream.send("state", lastEventId, job); err != nil {
+		return
+	}
+
+	progressUpdatedAt := job.Progress.UpdatedAt
+	heartbeat := time.NewTicker(jobStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for !job.Status.IsTerminal() {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-heartbeat.C:
+			if err = stream.comment("heartbeat"); err != nil {
+				return
+			}
+
+		case <-updates:
+			job, err = h.Database.FindJobById(r.Context(), jobId)
+			if err != nil {
+				log.Printf("error finding job %d for event stream: %v", jobId, err)
+				return
+			}
+			events, err = h.Database.FindJobEventsByJobIdAfter(r.Context(), job.Id, lastEventId)
+			if err != nil {
+				log.Printf("error finding events of job %d for event stream: %v", jobId, err)
+				return
+			}
+
+			for _, event := range events {
+				if err = stream.send("status", event.Id, event); err != nil {
+					return
+				}
+				lastEventId = event.Id
+			}
+
+			if job.Progress.UpdatedAt != nil &&
+				(progressUpdatedAt == nil || job.Progress.UpdatedAt.After(*progressUpdatedAt)) {
+				progressUpdatedAt = job.Progress.UpdatedAt
+				if err = stream.send("progress", 0, job.Progress); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// eventStream writes Server-Sent Events, flushing after each one.
+type eventStream struct {
+	writer     http.ResponseWriter
+	controller *http.ResponseController
+}
+
+// send writes an event with data encoded as JSON. An id of 0 leaves the client's last event id as it was.
+func (s *eventStream) send(
+	event string,
+	id int64,
+	data interface{},
+) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if id > 0 {
+		if _, err = fmt.Fprintf(s.writer, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err = fmt.Fprintf(s.writer, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	return s.controller.Flush()
+}
+
+// comment writes a line clients ignore, used to keep the connection alive.
+func (s *eventStream) comment(text string) error {
+	if _, err := fmt.Fprintf(s.writer, ": %s\n\n", text); err != nil {
+		return err
+	}
+	return s.controller.Flush()
+}
@@ -1,12 +1,16 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/brysonmco/compressor/internal/db"
 	"github.com/brysonmco/compressor/internal/middleware"
 	"github.com/brysonmco/compressor/internal/models"
+	"github.com/brysonmco/compressor/internal/subscriptions"
 	"github.com/brysonmco/compressor/internal/utils"
 	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
 	"github.com/stripe/stripe-go/v82"
 	billing_session "github.com/stripe/stripe-go/v82/billingportal/session"
 	"github.com/stripe/stripe-go/v82/checkout/session"
@@ -14,6 +18,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -21,46 +26,139 @@ type SubscriptionHandler struct {
 	Database       *db.Database
 	AuthMiddleware *middleware.AuthMiddleware
 	EndpointSecret string
+	Subscriptions  *subscriptions.WebhookProcessor
+	Prices         *subscriptions.PriceCatalog
+	Reconciler     *subscriptions.Reconciler
 }
 
 func NewSubscriptionHandler(
 	database *db.Database,
 	authMiddleware *middleware.AuthMiddleware,
 	endpointSecret string,
+	subscriptionSync *subscriptions.WebhookProcessor,
+	prices *subscriptions.PriceCatalog,
+	reconciler *subscriptions.Reconciler,
 ) http.Handler {
 	h := &SubscriptionHandler{
 		Database:       database,
 		AuthMiddleware: authMiddleware,
 		EndpointSecret: endpointSecret,
+		Subscriptions:  subscriptionSync,
+		Prices:         prices,
+		Reconciler:     reconciler,
 	}
 
 	r := chi.NewRouter()
 	r.Get("/plans", h.handleGetPlans)
+	r.Get("/token-packs", h.handleGetTokenPacks)
 	r.With(authMiddleware.Protected).Post("/checkout", h.handleCreateCheckoutSession)
 	r.With(authMiddleware.Protected).Post("/portal", h.handleCreatePortalSession)
 	r.With(authMiddleware.Protected).Post("/cancel", h.handleCancelSubscription)
+	r.With(authMiddleware.Protected).Post("/resume", h.handleResumeSubscription)
+	r.With(authMiddleware.Protected).Post("/change", h.handleChangeSubscription)
 	r.Post("/webhook", h.handleStripeWebhook)
+	r.With(authMiddleware.ProtectedAdminOnly).Post("/reconcile/{userId}", h.handleReconcileUser)
 
 	return r
 }
 
 // GET /v1/subscriptions/plans
 type planResponse struct {
-	Id int64 `json:"id"`
+	Id                 int64                     `json:"id"`
+	Name               string                    `json:"name"`
+	Tokens             int                       `json:"tokens"` // Per period, -1 for unlimited
+	Priority           string                    `json:"priority"`
+	ConcurrentJobs     int                       `json:"concurrentJobs"` // -1 for unlimited
+	MaxResolution      int64                     `json:"maxResolution"`  // Width * height
+	MaxFileSize        int64                     `json:"maxFileSize"`    // Bytes
+	FileRetentionHours int                       `json:"fileRetentionHours"`
+	Watermark          bool                      `json:"watermark"`
+	Prices             *subscriptions.PlanPrices `json:"prices"` // Null for the free plan
 }
 
 func (h *SubscriptionHandler) handleGetPlans(w http.ResponseWriter, r *http.Request) {
-	_, err := h.Database.FindAllPlans(r.Context())
+	plans, err := h.Database.FindAllPlans(r.Context())
 	if err != nil {
 		log.Printf("error finding plans: %v", err)
 		utils.WriteError(w, r, http.StatusInternalServerError, "error fetching plans", "internal_error", nil)
 		return
 	}
+
+	response := make([]planResponse, 0, len(plans))
+	for _, plan := range plans {
+		var prices *subscriptions.PlanPrices
+		if plan.StripeProductId != "" {
+			prices, err = h.Prices.ForProduct(plan.StripeProductId)
+			if err != nil {
+				log.Printf("error fetching prices for product %s: %v", plan.StripeProductId, err)
+				utils.WriteError(w, r, http.StatusInternalServerError, "error fetching plans", "internal_error", nil)
+				return
+			}
+		}
+
+		response = append(response, planResponse{
+			Id:                 plan.Id,
+			Name:               plan.Name,
+			Tokens:             plan.Tokens,
+			Priority:           plan.Priority,
+			ConcurrentJobs:     plan.ConcurrentJobs,
+			MaxResolution:      plan.MaxResolution,
+			MaxFileSize:        plan.MaxFileSize,
+			FileRetentionHours: int(plan.FileRetention.Hours()),
+			Watermark:          plan.Watermark,
+			Prices:             prices,
+		})
+	}
+
+	utils.WriteSuccess(w, r, http.StatusOK, "plans fetched", response)
+}
+
+var errInvalidPrice = errors.New("invalid price")
+
+// planForPrice finds the plan a price belongs to, as long as it's one of the prices the plans endpoint offers.
+func (h *SubscriptionHandler) planForPrice(
+	ctx context.Context,
+	priceId string,
+) (*models.Plan, error) {
+	productId, err := subscriptions.GetProductIdFromPrice(priceId)
+	if err != nil {
+		return nil, errInvalidPrice
+	}
+
+	plan, err := h.Database.FindPlanByStripeProductId(ctx, productId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errInvalidPrice
+	} else if err != nil {
+		return nil, err
+	}
+
+	offered, err := h.Prices.Includes(productId, priceId)
+	if err != nil {
+		return nil, err
+	}
+	if !offered {
+		return nil, errInvalidPrice
+	}
+
+	return plan, nil
+}
+
+// GET /v1/subscriptions/token-packs
+func (h *SubscriptionHandler) handleGetTokenPacks(w http.ResponseWriter, r *http.Request) {
+	packs, err := h.Database.FindActiveTokenPacks(r.Context())
+	if err != nil {
+		log.Printf("error finding token packs: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error fetching token packs", "internal_error", nil)
+		return
+	}
+
+	utils.WriteSuccess(w, r, http.StatusOK, "token packs fetched", packs)
 }
 
 // POST /v1/subscriptions/checkout
 type createCheckoutSessionRequest struct {
-	PriceId string `json:"priceId"`
+	PriceId     string `json:"priceId"`     // Subscribe to a plan's price
+	TokenPackId int64  `json:"tokenPackId"` // Or buy a token pack
 }
 
 func (h *SubscriptionHandler) handleCreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
@@ -75,6 +173,10 @@ func (h *SubscriptionHandler) handleCreateCheckoutSession(w http.ResponseWriter,
 		utils.WriteError(w, r, http.StatusBadRequest, "error parsing JSON", "invalid_json", nil)
 		return
 	}
+	if (data.PriceId == "") == (data.TokenPackId == 0) {
+		utils.WriteError(w, r, http.StatusBadRequest, "either a price or a token pack is required", "missing_fields", nil)
+		return
+	}
 
 	// Get the user object
 	user, err := h.Database.FindUserByID(r.Context(), id)
@@ -97,10 +199,41 @@ func (h *SubscriptionHandler) handleCreateCheckoutSession(w http.ResponseWriter,
 		SuccessURL: stripe.String("http://localhost:8080/dashboard"),
 		CancelURL:  stripe.String("http://localhost:8080/pricing"),
 	}
+
+	if data.PriceId != "" {
+		if _, err := h.planForPrice(r.Context(), data.PriceId); errors.Is(err, errInvalidPrice) {
+			utils.WriteError(w, r, http.StatusBadRequest, "invalid price", "invalid_price", nil)
+			return
+		} else if err != nil {
+			log.Printf("error finding plan for price %s: %v", data.PriceId, err)
+			utils.WriteError(w, r, http.StatusInternalServerError, "error creating checkout session", "internal_error", nil)
+			return
+		}
+	} else {
+		pack, err := h.Database.FindTokenPackById(r.Context(), data.TokenPackId)
+		if errors.Is(err, pgx.ErrNoRows) || (err == nil && (!pack.Active || pack.StripePriceId == "")) {
+			utils.WriteError(w, r, http.StatusBadRequest, "token pack not found", "token_pack_not_found", nil)
+			return
+		} else if err != nil {
+			log.Printf("error finding token pack: %v", err)
+			utils.WriteError(w, r, http.StatusInternalServerError, "error creating checkout session", "internal_error", nil)
+			return
+		}
+
+		// The webhook credits whatever the metadata says, so the user gets the pack as it was when they paid
+		params.Mode = stripe.String(stripe.CheckoutSessionModePayment)
+		params.LineItems[0].Price = stripe.String(pack.StripePriceId)
+		params.Metadata = map[string]string{
+			subscriptions.TokenPackIdMetadataKey:     strconv.FormatInt(pack.Id, 10),
+			subscriptions.TokenPackTokensMetadataKey: strconv.Itoa(pack.Tokens),
+		}
+	}
+
 	sess, err := session.New(params)
 	if err != nil {
 		log.Printf("error creating checkout session: %v", err)
 		utils.WriteError(w, r, http.StatusInternalServerError, "error creating checkout session", "internal_error", nil)
+		return
 	}
 
 	// Return checkout url
@@ -153,67 +286,196 @@ func (h *SubscriptionHandler) handleStripeWebhook(w http.ResponseWriter, r *http
 		return
 	}
 
-	switch evnt.Type {
-	case "customer.subscription.created":
-		h.handleSubscriptionCreated(w, r, evnt)
-		break
-	case "customer.subscription.updated":
-	case "customer.subscription.deleted":
-	case "invoice.paid":
-	default:
-		log.Printf("unhandled webhook event type: %s", evnt.Type)
-		utils.WriteError(w, r, http.StatusBadRequest, "unhandled webhook event type", "bad_payload", nil)
+	// Events are processed by the worker, Stripe only needs to know we have it
+	created, err := h.Database.CreateStripeEvent(r.Context(), &models.CreateStripeEvent{
+		Id:      evnt.ID,
+		Type:    string(evnt.Type),
+		Created: time.Unix(evnt.Created, 0).UTC(),
+		Payload: payload,
+	})
+	if err != nil {
+		// Stripe retries anything that isn't a 2xx
+		log.Printf("error storing webhook event %s: %v", evnt.ID, err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "could not store webhook event", "internal_error", nil)
+		return
+	}
+	if !created {
+		utils.WriteSuccess(w, r, http.StatusOK, "webhook event already received", nil)
+		return
 	}
 
+	utils.WriteSuccess(w, r, http.StatusOK, "webhook event received", nil)
+}
+
+// POST /v1/subscriptions/cancel
+type cancelSubscriptionRequest struct {
+	Immediately bool `json:"immediately"` // Otherwise the subscription runs until the end of the paid period
 }
 
 func (h *SubscriptionHandler) handleCancelSubscription(w http.ResponseWriter, r *http.Request) {
+	id := r.Context().Value("userId").(int64)
 
+	var req cancelSubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, r, http.StatusBadRequest, "error parsing JSON", "invalid_json", nil)
+		return
+	}
+
+	current, ok := h.activeSubscription(w, r, id)
+	if !ok {
+		return
+	}
+
+	if current.CancelAtPeriodEnd && !req.Immediately {
+		utils.WriteError(w, r, http.StatusBadRequest, "subscription is already cancelling", "subscription_cancelling", nil)
+		return
+	}
+
+	sub, err := subscriptions.CancelSubscription(current.StripeSubscriptionId, !req.Immediately)
+	if err != nil {
+		log.Printf("error cancelling subscription: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error cancelling subscription", "internal_error", nil)
+		return
+	}
+
+	h.writeSynced(w, r, sub, "subscription cancelled")
 }
 
-func (h *SubscriptionHandler) handleSubscriptionCreated(w http.ResponseWriter, r *http.Request, evnt stripe.Event) {
-	var subscription stripe.Subscription
-	err := json.Unmarshal(evnt.Data.Raw, &subscription)
+// POST /v1/subscriptions/resume
+func (h *SubscriptionHandler) handleResumeSubscription(w http.ResponseWriter, r *http.Request) {
+	id := r.Context().Value("userId").(int64)
+
+	current, ok := h.activeSubscription(w, r, id)
+	if !ok {
+		return
+	}
+
+	if !current.CancelAtPeriodEnd {
+		utils.WriteError(w, r, http.StatusBadRequest, "subscription is not cancelling", "subscription_not_cancelling", nil)
+		return
+	}
+
+	sub, err := subscriptions.ResumeSubscription(current.StripeSubscriptionId)
 	if err != nil {
-		log.Printf("error unmarshalling webhook event: %v", err)
-		utils.WriteError(w, r, http.StatusBadRequest, "could not unmarshall webhook event", "bad_payload", nil)
+		log.Printf("error resuming subscription: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error resuming subscription", "internal_error", nil)
 		return
 	}
 
-	customerId := subscription.Customer.ID
-	subscriptionId := subscription.ID
-	priceId := subscription.Items.Data[0].Price.ID
+	h.writeSynced(w, r, sub, "subscription resumed")
+}
+
+// POST /v1/subscriptions/change
+type changeSubscriptionRequest struct {
+	PriceId string `json:"priceId"`
+}
+
+func (h *SubscriptionHandler) handleChangeSubscription(w http.ResponseWriter, r *http.Request) {
+	id := r.Context().Value("userId").(int64)
+
+	var req changeSubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, r, http.StatusBadRequest, "error parsing JSON", "invalid_json", nil)
+		return
+	}
+	if req.PriceId == "" {
+		utils.WriteError(w, r, http.StatusBadRequest, "missing required fields", "missing_fields", nil)
+		return
+	}
+
+	current, ok := h.activeSubscription(w, r, id)
+	if !ok {
+		return
+	}
 
-	user, err := h.Database.FindUserByStripeCustomerID(r.Context(), customerId)
+	if req.PriceId == current.StripePriceId {
+		utils.WriteError(w, r, http.StatusBadRequest, "already subscribed to this price", "same_price", nil)
+		return
+	}
+
+	if _, err := h.planForPrice(r.Context(), req.PriceId); errors.Is(err, errInvalidPrice) {
+		utils.WriteError(w, r, http.StatusBadRequest, "invalid price", "invalid_price", nil)
+		return
+	} else if err != nil {
+		log.Printf("error finding plan for price %s: %v", req.PriceId, err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error changing subscription", "internal_error", nil)
+		return
+	}
+
+	sub, err := subscriptions.ChangeSubscriptionPrice(current.StripeSubscriptionId, req.PriceId)
+	if err != nil {
+		log.Printf("error changing subscription price: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error changing subscription", "internal_error", nil)
+		return
+	}
+
+	h.writeSynced(w, r, sub, "subscription changed")
+}
+
+// activeSubscription finds the user's active subscription, writing an error if they don't have one.
+func (h *SubscriptionHandler) activeSubscription(
+	w http.ResponseWriter,
+	r *http.Request,
+	userId int64,
+) (*models.Subscription, bool) {
+	subscription, err := h.Database.FindActiveSubscriptionByUserId(r.Context(), userId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		utils.WriteError(w, r, http.StatusBadRequest, "no active subscription", "no_active_subscription", nil)
+		return nil, false
+	} else if err != nil {
+		log.Printf("error finding subscription: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "internal service error", "internal_error", nil)
+		return nil, false
+	}
+	return subscription, true
+}
+
+// writeSynced records what Stripe returned straight away rather than waiting for the webhook, then writes it.
+func (h *SubscriptionHandler) writeSynced(
+	w http.ResponseWriter,
+	r *http.Request,
+	sub *stripe.Subscription,
+	message string,
+) {
+	subscription, err := h.Subscriptions.Sync(r.Context(), sub)
 	if err != nil {
-		log.Printf("error finding user by stripe customer id: %v", err)
-		utils.WriteError(w, r, http.StatusInternalServerError, "could not handle subscription creation", "internal_error", nil)
+		// Stripe has the change, the webhook will catch us up
+		log.Printf("error syncing subscription %s: %v", sub.ID, err)
+		utils.WriteSuccess(w, r, http.StatusOK, message, nil)
 		return
 	}
 
-	// Get the plan
-	productId := subscription.Items.Data[0].Price.Product.ID
-	plan, err := h.Database.FindPlanByStripeProductId(r.Context(), productId)
+	utils.WriteSuccess(w, r, http.StatusOK, message, subscription)
+}
+
+// POST /v1/subscriptions/reconcile/{userId}
+func (h *SubscriptionHandler) handleReconcileUser(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.ParseInt(chi.URLParam(r, "userId"), 10, 64)
 	if err != nil {
-		log.Printf("error finding plan by product id %v: %v", productId, err)
-		utils.WriteError(w, r, http.StatusInternalServerError, "could not handle subscription creation", "internal_error", nil)
+		utils.WriteError(w, r, http.StatusBadRequest, "invalid user id", "invalid_user_id", nil)
 		return
 	}
 
-	subReq := models.CreateSubscription{
-		UserId:               user.Id,
-		StripeSubscriptionId: subscriptionId,
-		StripePriceId:        priceId,
-		PlanId:               plan.Id,
-		Status:               string(subscription.Status),
-		CurrentPeriodStart:   time.Unix(subscription.Items.Data[0].CurrentPeriodStart, 0),
-		CurrentPeriodEnd:     time.Unix(subscription.Items.Data[0].CurrentPeriodEnd, 0),
+	user, err := h.Database.FindUserByID(r.Context(), userId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		utils.WriteError(w, r, http.StatusNotFound, "user not found", "user_not_found", nil)
+		return
+	} else if err != nil {
+		log.Printf("error finding user: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error reconciling subscriptions", "internal_error", nil)
+		return
+	}
+	if user.StripeCustomerId == "" {
+		utils.WriteError(w, r, http.StatusBadRequest, "user has no stripe customer", "no_stripe_customer", nil)
+		return
 	}
 
-	_, err = h.Database.CreateSubscription(r.Context(), subReq)
+	report, err := h.Reconciler.ReconcileUser(r.Context(), user)
 	if err != nil {
-		log.Printf("error creating subscription in database: %v", err)
-		utils.WriteError(w, r, http.StatusInternalServerError, "could not handle subscription creation", "internal_error", nil)
+		log.Printf("error reconciling subscriptions of user %d: %v", userId, err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error reconciling subscriptions", "internal_error", nil)
 		return
 	}
+
+	utils.WriteSuccess(w, r, http.StatusOK, "subscriptions reconciled", report)
 }
@@ -4,8 +4,11 @@ import (
 	"fmt"
 	"github.com/brysonmco/compressor/internal/db"
 	"github.com/brysonmco/compressor/internal/middleware"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/brysonmco/compressor/internal/plans"
 	"github.com/brysonmco/compressor/internal/utils"
 	"github.com/go-chi/chi/v5"
+	"log"
 	"net/http"
 	"time"
 )
@@ -13,19 +16,22 @@ import (
 type UserHandler struct {
 	Database       *db.Database
 	AuthMiddleware *middleware.AuthMiddleware
+	Plans          *plans.Resolver
 }
 
 func NewUserHandler(
 	database *db.Database,
 	authMiddleware *middleware.AuthMiddleware,
+	planResolver *plans.Resolver,
 ) http.Handler {
 	h := &UserHandler{
 		Database:       database,
 		AuthMiddleware: authMiddleware,
+		Plans:          planResolver,
 	}
 
 	r := chi.NewRouter()
-	r.With(authMiddleware.Protected).Get("/profile", h.handleGetProfile)
+	r.With(authMiddleware.ProtectedWithScope(middleware.ScopeBillingRead)).Get("/profile", h.handleGetProfile)
 	r.With(authMiddleware.ProtectedAdminOnly).Get("/:id", h.handleGetProfile)
 
 	return r
@@ -47,7 +53,24 @@ func (h *UserHandler) handleGetProfile(w http.ResponseWriter, r *http.Request) {
 	// TODO: Implement
 
 	// Get tokens
-	// TODO: Implement
+	plan, err := h.Plans.ForUser(r.Context(), id)
+	if err != nil {
+		log.Printf("error fetching plan: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error fetching plan", "internal_error", nil)
+		return
+	}
+	balance, err := h.Database.FindTokenBalanceByUserId(r.Context(), id)
+	if err != nil {
+		log.Printf("error fetching token balance: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error fetching tokens", "internal_error", nil)
+		return
+	}
+
+	// Unlimited plans don't draw on the ledger
+	tokens := balance.Available
+	if plan.Tokens == models.Unlimited {
+		tokens = models.Unlimited
+	}
 
 	// Return user data
 	utils.WriteSuccess(w, r, http.StatusOK, "user profile", map[string]interface{}{
@@ -59,7 +82,8 @@ func (h *UserHandler) handleGetProfile(w http.ResponseWriter, r *http.Request) {
 			"plan":      0,
 			"periodEnd": time.Now().Add(time.Hour * 24),
 		},
-		"tokens": 1000, // TODO: Implement token fetching
+		"tokens":         tokens,
+		"reservedTokens": balance.Reserved,
 	})
 }
 
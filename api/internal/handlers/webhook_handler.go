@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/brysonmco/compressor/internal/db"
+	"github.com/brysonmco/compressor/internal/middleware"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/brysonmco/compressor/internal/utils"
+	"github.com/brysonmco/compressor/internal/webhooks"
+	"github.com/go-chi/chi/v5"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+const (
+	maxWebhookEndpoints = 10
+	minWebhookSecret    = 16
+	// Delivery log pages
+	defaultDeliveryLimit = 20
+	maxDeliveryLimit     = 100
+)
+
+type WebhookHandler struct {
+	Database       *db.Database
+	AuthMiddleware *middleware.AuthMiddleware
+	AllowHTTP      bool // Endpoints must use HTTPS unless this is set, for development
+}
+
+func NewWebhookHandler(
+	database *db.Database,
+	authMiddleware *middleware.AuthMiddleware,
+	allowHTTP bool,
+) http.Handler {
+	h := &WebhookHandler{
+		Database:       database,
+		AuthMiddleware: authMiddleware,
+		AllowHTTP:      allowHTTP,
+	}
+
+	r := chi.NewRouter()
+	r.With(authMiddleware.Protected).Get("/", h.handleListEndpoints)
+	r.With(authMiddleware.Protected).Post("/", h.handleCreateEndpoint)
+	r.With(authMiddleware.Protected).Get("/{id}", h.handleGetEndpoint)
+	r.With(authMiddleware.Protected).Delete("/{id}", h.handleDeleteEndpoint)
+	r.With(authMiddleware.Protected).Get("/{id}/deliveries", h.handleListDeliveries)
+	r.With(authMiddleware.Protected).Get("/{id}/deliveries/{deliveryId}", h.handleGetDelivery)
+	r.With(authMiddleware.Protected).Post("/{id}/deliveries/{deliveryId}/redeliver", h.handleRedeliver)
+
+	return r
+}
+
+// GET /v1/webhooks
+func (h *WebhookHandler) handleListEndpoints(w http.ResponseWriter, r *http.Request) {
+	id := r.Context().Value("userId").(int64)
+
+	endpoints, err := h.Database.FindWebhookEndpointsByUserId(r.Context(), id)
+	if err != nil {
+		log.Printf("error finding webhook endpoints: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error fetching webhook endpoints", "internal_error", nil)
+		return
+	}
+
+	utils.WriteSuccess(w, r, http.StatusOK, "webhook endpoints fetched", map[string]interface{}{
+		"endpoints": endpoints,
+		"events":    webhooks.Events,
+	})
+}
+
+type createEndpointRequest struct {
+	Url    string   `json:"url"`
+	Secret string   `json:"secret"` // Optional, one is generated if left out
+	Events []string `json:"events"`
+}
+
+// POST /v1/webhooks
+func (h *WebhookHandler) handleCreateEndpoint(w http.ResponseWriter, r *http.Request) {
+	id := r.Context().Value("userId").(int64)
+
+	// Parse request body
+	var req createEndpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, r, http.StatusBadRequest, "error parsing JSON", "invalid_json", nil)
+		return
+	}
+
+	endpointUrl, err := webhooks.ValidateURL(req.Url, h.AllowHTTP)
+	if err != nil {
+		utils.WriteError(w, r, http.StatusBadRequest, err.Error(), "invalid_url", nil)
+		return
+	}
+
+	if len(req.Events) == 0 {
+		utils.WriteError(w, r, http.StatusBadRequest, "at least one event is required", "invalid_events",
+			webhooks.Events)
+		return
+	}
+	var events []string
+	for _, event := range req.Events {
+		if !slices.Contains(webhooks.Events, event) {
+			utils.WriteError(w, r, http.StatusBadRequest, "unknown event "+event, "invalid_events", webhooks.Events)
+			return
+		}
+		if !slices.Contains(events, event) {
+			events = append(events, event)
+		}
+	}
+
+	if req.Secret == "" {
+		req.Secret, err = webhooks.GenerateSecret()
+		if err != nil {
+			log.Printf("error generating webhook secret: %v", err)
+			utils.WriteError(w, r, http.StatusInternalServerError, "internal service error", "internal_error", nil)
+			return
+		}
+	} else if len(req.Secret) < minWebhookSecret {
+		utils.WriteError(w, r, http.StatusBadRequest, "secret must be at least 16 characters", "invalid_secret", nil)
+		return
+	}
+
+	existing, err := h.Database.FindWebhookEndpointsByUserId(r.Context(), id)
+	if err != nil {
+		log.Printf("error finding webhook endpoints: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "internal service error", "internal_error", nil)
+		return
+	}
+	if len(existing) >= maxWebhookEndpoints {
+		utils.WriteError(w, r, http.StatusForbidden, "too many webhook endpoints", "webhook_endpoint_limit", nil)
+		return
+	}
+
+	endpoint, err := h.Database.CreateWebhookEndpoint(r.Context(), models.CreateWebhookEndpoint{
+		UserId: id,
+		Url:    endpointUrl.String(),
+		Secret: req.Secret,
+		Events: events,
+	})
+	if err != nil {
+		log.Printf("error creating webhook endpoint: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "internal service error", "internal_error", nil)
+		return
+	}
+
+	// The only time the secret is shown
+	utils.WriteSuccess(w, r, http.StatusCreated, "webhook endpoint created", map[string]interface{}{
+		"endpoint": endpoint,
+		"secret":   endpoint.Secret,
+	})
+}
+
+// GET /v1/webhooks/{id}
+func (h *WebhookHandler) handleGetEndpoint(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := h.findEndpoint(w, r)
+	if !ok {
+		return
+	}
+
+	utils.WriteSuccess(w, r, http.StatusOK, "webhook endpoint fetched", endpoint)
+}
+
+// DELETE /v1/webhooks/{id}
+func (h *WebhookHandler) handleDeleteEndpoint(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := h.findEndpoint(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.Database.DeleteWebhookEndpoint(r.Context(), endpoint.Id); err != nil {
+		log.Printf("error deleting webhook endpoint: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error deleting webhook endpoint", "internal_error", nil)
+		return
+	}
+
+	utils.WriteSuccess(w, r, http.StatusOK, "webhook endpoint deleted", nil)
+}
+
+// GET /v1/webhooks/{id}/deliveries
+//
+// Newest first, pass the last id of a page as before to get the next one.
+func (h *WebhookHandler) handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := h.findEndpoint(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultDeliveryLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxDeliveryLimit {
+			utils.WriteError(w, r, http.StatusBadRequest, "limit must be between 1 and 100", "invalid_limit", nil)
+			return
+		}
+		limit = parsed
+	}
+
+	var before int64
+	if value := query.Get("before"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			utils.WriteError(w, r, http.StatusBadRequest, "invalid before", "invalid_before", nil)
+			return
+		}
+		before = parsed
+	}
+
+	deliveries, err := h.Database.FindWebhookDeliveriesByEndpointId(r.Context(), endpoint.Id, before, limit)
+	if err != nil {
+		log.Printf("error finding webhook deliveries: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error fetching deliveries", "internal_error", nil)
+		return
+	}
+
+	utils.WriteSuccess(w, r, http.StatusOK, "deliveries fetched", deliveries)
+}
+
+// GET /v1/webhooks/{id}/deliveries/{deliveryId}
+func (h *WebhookHandler) handleGetDelivery(w http.ResponseWriter, r *http.Request) {
+	delivery, ok := h.findDelivery(w, r)
+	if !ok {
+		return
+	}
+
+	attempts, err := h.Database.FindWebhookDeliveryAttemptsByDeliveryId(r.Context(), delivery.Id)
+	if err != nil {
+		log.Printf("error finding webhook delivery attempts: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error fetching delivery", "internal_error", nil)
+		return
+	}
+
+	utils.WriteSuccess(w, r, http.StatusOK, "delivery fetched", map[string]interface{}{
+		"delivery": delivery,
+		"attempts": attempts,
+	})
+}
+
+// POST /v1/webhooks/{id}/deliveries/{deliveryId}/redeliver
+//
+// Sends the delivery again as soon as possible, whatever happened to it before. Receivers see the same event id.
+func (h *WebhookHandler) handleRedeliver(w http.ResponseWriter, r *http.Request) {
+	delivery, ok := h.findDelivery(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.Database.RedeliverWebhookDelivery(r.Context(), delivery.Id); err != nil {
+		log.Printf("error redelivering webhook delivery: %v", err)
+		utils.WriteError(w, r, http.StatusInternalServerError, "error redelivering", "internal_error", nil)
+		return
+	}
+
+	utils.WriteSuccess(w, r, http.StatusAccepted, "delivery queued", nil)
+}
+
+// findEndpoint loads the endpoint in the URL, writing an error unless it belongs to the user.
+func (h *WebhookHandler) findEndpoint(
+	w http.ResponseWriter,
+	r *http.Request,
+) (*models.WebhookEndpoint, bool) {
+	id := r.Context().Value("userId").(int64)
+
+	endpointId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, r, http.StatusNotFound, "webhook endpoint not found", "webhook_not_found", nil)
+		return nil, false
+	}
+
+	endpoint, err := h.Database.FindWebhookEndpointById(r.Context(), endpointId)
+	if err != nil || endpoint.UserId != id {
+		// We don't want to leak information about another user's endpoints
+		utils.WriteError(w, r, http.StatusNotFound, "webhook endpoint not found", "webhook_not_found", nil)
+		return nil, false
+	}
+
+	return endpoint, true
+}
+
+// findDelivery loads the delivery in the URL, writing an error unless it was made for the endpoint, which belongs to
+// the user.
+func (h *WebhookHandler) findDelivery(
+	w http.ResponseWriter,
+	r *http.Request,
+) (*models.WebhookDelivery, bool) {
+	endpoint, ok := h.findEndpoint(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	deliveryId, err := strconv.ParseInt(chi.URLParam(r, "deliveryId"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, r, http.StatusNotFound, "delivery not found", "delivery_not_found", nil)
+		return nil, false
+	}
+
+	delivery, err := h.Database.FindWebhookDeliveryById(r.Context(), deliveryId)
+	if err != nil || delivery.EndpointId != endpoint.Id {
+		utils.WriteError(w, r, http.StatusNotFound, "delivery not found", "delivery_not_found", nil)
+		return nil, false
+	}
+
+	return delivery, true
+}
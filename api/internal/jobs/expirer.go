@@ -0,0 +1,98 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/brysonmco/compressor/internal/db"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/jackc/pgx/v5"
+	"log"
+	"time"
+)
+
+const (
+	expiryPollInterval = time.Minute
+	expiryBatchSize    = 100
+	// uploadGracePeriod gives a client that finished uploading just before its URL expired time to tell us
+	uploadGracePeriod = 10 * time.Minute
+)
+
+// Expirer expires jobs whose file was never uploaded once their upload URL has expired, refunding what was reserved
+// for them.
+type Expirer struct {
+	Database     *db.Database
+	UploadExpiry time.Duration // How long upload URLs are valid for
+}
+
+func NewExpirer(
+	database *db.Database,
+	uploadExpiry time.Duration,
+) *Expirer {
+	return &Expirer{
+		Database:     database,
+		UploadExpiry: uploadExpiry,
+	}
+}
+
+// Run expires jobs until ctx is cancelled.
+func (e *Expirer) Run(ctx context.Context) {
+	ticker := time.NewTicker(expiryPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.expireAll(ctx); err != nil {
+				log.Printf("error expiring jobs: %v", err)
+			}
+		}
+	}
+}
+
+// expireAll expires every job that is due, each in its own transaction so one that fails doesn't hold up the rest.
+func (e *Expirer) expireAll(ctx context.Context) error {
+	before := time.Now().Add(-e.UploadExpiry - uploadGracePeriod)
+
+	var afterId int64
+	for {
+		jobs, err := e.Database.FindJobsAwaitingUploadBefore(ctx, before, afterId, expiryBatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, job := range jobs {
+			afterId = job.Id
+			if err = e.expire(ctx, job); err != nil {
+				log.Printf("error expiring job %d: %v", job.Id, err)
+			}
+		}
+
+		if len(jobs) < expiryBatchSize {
+			return nil
+		}
+	}
+}
+
+// expire moves a job to expired and refunds it, unless its upload was completed or it was cancelled in the meantime.
+func (e *Expirer) expire(
+	ctx context.Context,
+	job *models.Job,
+) error {
+	return e.Database.WithTx(ctx, func(tx pgx.Tx) error {
+		err := e.Database.TransitionJobTx(ctx, tx, job.Id, job.Status, models.JobStatusExpired, "upload URL expired")
+		if errors.Is(err, db.ErrJobStatusChanged) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = e.Database.RefundJobTokensTx(ctx, tx, job.UserId, job.Id, "upload expired"); err != nil {
+			return fmt.Errorf("error refunding: %v", err)
+		}
+		return nil
+	})
+}
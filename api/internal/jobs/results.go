@@ -0,0 +1,229 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/brysonmco/compressor/internal/db"
+	"github.com/brysonmco/compressor/internal/messaging"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/brysonmco/compressor/internal/pricing"
+	"github.com/brysonmco/compressor/internal/storage"
+	"github.com/brysonmco/compressor/internal/webhooks"
+	"github.com/jackc/pgx/v5"
+	"log"
+	"time"
+)
+
+// ResultApplier records results published by compression-service against their jobs.
+type ResultApplier struct {
+	Database *db.Database
+	Storage  *storage.Storage
+}
+
+func NewResultApplier(
+	database *db.Database,
+	strge *storage.Storage,
+) *ResultApplier {
+	return &ResultApplier{
+		Database: database,
+		Storage:  strge,
+	}
+}
+
+// resultStatuses is the status each result moves a job to.
+var resultStatuses = map[string]models.JobStatus{
+	messaging.ResultDownloading: models.JobStatusDownloading,
+	messaging.ResultProbing:     models.JobStatusProbing,
+	messaging.ResultProbed:      models.JobStatusProbing,
+	messaging.ResultStarted:     models.JobStatusCompressing,
+	messaging.ResultProgress:    models.JobStatusCompressing,
+	messaging.ResultUploading:   models.JobStatusUploading,
+	messaging.ResultCompleted:   models.JobStatusCompleted,
+	messaging.ResultFailed:      models.JobStatusFailed,
+}
+
+// Apply updates the job a result belongs to. Results are delivered at least once and may arrive out of order, so
+// anything not newer than the last result applied to the job is dropped, as is anything the job's current status
+// doesn't allow (e.g. progress for a cancelled job). Results with a payload that can't be decoded fail with
+// messaging.ErrPermanent, retrying them won't help.
+func (a *ResultApplier) Apply(
+	ctx context.Context,
+	result *messaging.JobResult,
+) error {
+	// A job only completes once its file is really in storage, which is checked before the transaction is opened
+	var uploadedSize int64
+	if result.Event == messaging.ResultCompleted {
+		var err error
+		if uploadedSize, err = a.uploadedSize(ctx, result.JobId); err != nil {
+			return err
+		}
+	}
+
+	return a.Database.WithTx(ctx, func(tx pgx.Tx) error {
+		job, err := a.Database.FindJobByIdForUpdateTx(ctx, tx, result.JobId)
+		if errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("dropping %s result for unknown job %d", result.Event, result.JobId)
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if result.Sequence <= job.LastResultSequence {
+			return nil
+		}
+
+		status, known := resultStatuses[result.Event]
+		if !known {
+			// Still record the sequence, a newer build may publish events we don't know about yet
+			log.Printf("ignoring unknown %s result for job %d", result.Event, result.JobId)
+			status = job.Status
+		}
+		if status != job.Status && !job.Status.CanTransitionTo(status) {
+			log.Printf("dropping %s result for job %d in status %s", result.Event, result.JobId, job.Status)
+			return nil
+		}
+		reason := "compression-service reported " + result.Event
+		// Set when we fail the job ourselves, compression-service is still working on it
+		var stop bool
+
+		now := time.Now()
+		switch result.Event {
+		case messaging.ResultProbed:
+			var payload messaging.ProbedPayload
+			if err = result.DecodePayload(&payload); err != nil {
+				return fmt.Errorf("%w: error parsing probed payload: %v", messaging.ErrPermanent, err)
+			}
+
+			job.InputCodec = payload.Codec
+			job.InputResolutionHorizontal = payload.Width
+			job.InputResolutionVertical = payload.Height
+			job.InputDuration = payload.Duration
+			if payload.Size > 0 {
+				job.InputSize = payload.Size
+			}
+
+			// The reservation was made on what the client told us about the input, make sure it covers the real one
+			if err = a.Database.LockUserTx(ctx, tx, job.UserId); err != nil {
+				return err
+			}
+			cost := pricing.EstimateJob(pricing.JobInput(job), job.Output).Tokens
+			err = a.Database.ExtendJobReservationTx(ctx, tx, job.UserId, job.Id, cost)
+			if errors.Is(err, db.ErrInsufficientTokens) {
+				job.FailureReason = "not enough tokens to compress the file"
+				reason = job.FailureReason
+				status = models.JobStatusFailed
+				stop = true
+			} else if err != nil {
+				return err
+			}
+
+		case messaging.ResultProgress:
+			var payload messaging.ProgressPayload
+			if err = result.DecodePayload(&payload); err != nil {
+				return fmt.Errorf("%w: error parsing progress payload: %v", messaging.ErrPermanent, err)
+			}
+
+			job.Progress.Percent = payload.Percent
+			job.Progress.EtaSeconds = payload.EtaSeconds
+			job.Progress.Fps = payload.Fps
+			job.Progress.BitrateKbps = payload.BitrateKbps
+			job.Progress.UpdatedAt = &now
+
+		case messaging.ResultCompleted:
+			var payload messaging.CompletedPayload
+			if err = result.DecodePayload(&payload); err != nil {
+				return fmt.Errorf("%w: error parsing completed payload: %v", messaging.ErrPermanent, err)
+			}
+
+			if uploadedSize != payload.Size {
+				job.FailureReason = fmt.Sprintf("compressed file in storage is %d bytes, expected %d", uploadedSize,
+					payload.Size)
+				if uploadedSize < 0 {
+					job.FailureReason = "compressed file is missing from storage"
+				}
+				reason = job.FailureReason
+				status = models.JobStatusFailed
+				break
+			}
+
+			// The codec asked for is kept, ffprobe names codecs differently (e.g. h265 is hevc)
+			job.OutputResolutionHorizontal = payload.Width
+			job.OutputResolutionVertical = payload.Height
+			job.OutputSize = payload.Size
+			job.Progress.Percent = 100
+			job.Progress.EtaSeconds = 0
+			job.Progress.UpdatedAt = &now
+
+		case messaging.ResultFailed:
+			var payload messaging.FailedPayload
+			if err = result.DecodePayload(&payload); err != nil {
+				return fmt.Errorf("%w: error parsing failed payload: %v", messaging.ErrPermanent, err)
+			}
+
+			job.FailureReason = payload.Error
+			reason = payload.Error
+		}
+
+		job.LastResultSequence = result.Sequence
+		job.UpdatedAt = now
+		if err = a.Database.UpdateJobTx(ctx, tx, job); err != nil {
+			return err
+		}
+
+		if status == job.Status {
+			return nil
+		}
+
+		// Settle up once the job has finished
+		switch status {
+		case models.JobStatusCompleted:
+			// Charged on the probed input, the same way it was estimated and reserved
+			if err = a.Database.LockUserTx(ctx, tx, job.UserId); err != nil {
+				return err
+			}
+			cost := pricing.EstimateJob(pricing.JobInput(job), job.Output).Tokens
+			err = a.Database.SettleJobTokensTx(ctx, tx, job.UserId, job.Id, cost)
+		case models.JobStatusFailed:
+			err = a.Database.RefundJobTokensTx(ctx, tx, job.UserId, job.Id, "job failed")
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = webhooks.QueueJobEventTx(ctx, a.Database, tx, job, status); err != nil {
+			return err
+		}
+
+		if err = a.Database.TransitionJobTx(ctx, tx, job.Id, job.Status, status, reason); err != nil || !stop {
+			return err
+		}
+
+		message, err := messaging.CancelJobMessage(job.Id, messaging.CancelJobPayload{Reason: reason})
+		if err != nil {
+			return err
+		}
+		_, err = a.Database.CreateOutboxMessageTx(ctx, tx, &models.CreateOutboxMessage{
+			Exchange: messaging.CancellationsExchange,
+			Event:    message.Event,
+			JobId:    message.JobId,
+			Payload:  message.Payload,
+		})
+		return err
+	})
+}
+
+// uploadedSize returns the size of a job's compressed file in storage, or -1 if it isn't there or the job doesn't
+// exist.
+func (a *ResultApplier) uploadedSize(
+	ctx context.Context,
+	jobId int64,
+) (int64, error) {
+	job, err := a.Database.FindJobById(ctx, jobId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return -1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return a.Storage.FileSizeInDownloads(ctx, job)
+}
@@ -0,0 +1,126 @@
+package jobs
+
+import (
+	"context"
+	"github.com/brysonmco/compressor/internal/db"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Updates tells the streams watching a job when it has changed. Changes are announced through Postgres, so an update
+// applied by any API instance reaches the streams on every instance.
+type Updates struct {
+	Database    *db.Database
+	mu          sync.Mutex
+	subscribers map[int64]map[chan struct{}]struct{}
+}
+
+func NewUpdates(database *db.Database) *Updates {
+	return &Updates{
+		Database:    database,
+		subscribers: map[int64]map[chan struct{}]struct{}{},
+	}
+}
+
+// Subscribe returns a channel that receives whenever the job changes, and a function to stop receiving. Updates are
+// coalesced, a subscriber that falls behind only sees one, so it should re-read the job rather than count them.
+func (u *Updates) Subscribe(jobId int64) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	u.mu.Lock()
+	if u.subscribers[jobId] == nil {
+		u.subscribers[jobId] = map[chan struct{}]struct{}{}
+	}
+	u.subscribers[jobId][ch] = struct{}{}
+	u.mu.Unlock()
+
+	return ch, func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		delete(u.subscribers[jobId], ch)
+		if len(u.subscribers[jobId]) == 0 {
+			delete(u.subscribers, jobId)
+		}
+	}
+}
+
+// Run listens for job updates until ctx is cancelled, reconnecting with backoff if the connection drops.
+func (u *Updates) Run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		listened, err := u.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("job update listener disconnected, reconnecting in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		// Reset the backoff once we have managed to listen again
+		if listened {
+			backoff = time.Second
+		} else {
+			backoff = min(backoff*2, time.Minute)
+		}
+	}
+}
+
+// listen dispatches notifications until the connection fails, reporting whether it got as far as listening.
+func (u *Updates) listen(ctx context.Context) (bool, error) {
+	conn, err := u.Database.ListenJobUpdates(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close(context.Background())
+
+	// Anything could have changed while we weren't listening
+	u.notifyAll()
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return true, err
+		}
+
+		jobId, err := strconv.ParseInt(notification.Payload, 10, 64)
+		if err != nil {
+			log.Printf("ignoring job update with invalid payload %q", notification.Payload)
+			continue
+		}
+		u.notify(jobId)
+	}
+}
+
+func (u *Updates) notify(jobId int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for ch := range u.subscribers[jobId] {
+		signal(ch)
+	}
+}
+
+func (u *Updates) notifyAll() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, subscribers := range u.subscribers {
+		for ch := range subscribers {
+			signal(ch)
+		}
+	}
+}
+
+// signal wakes a subscriber without blocking, one pending update is as good as several.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
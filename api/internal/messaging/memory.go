@@ -0,0 +1,58 @@
+package messaging
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryPublisher keeps published messages in memory, it is meant for tests and running without a broker.
+type MemoryPublisher struct {
+	Err error // Returned from Publish when set, to simulate broker failures
+
+	mu        sync.Mutex
+	published []PublishedMessage
+}
+
+// PublishedMessage is a message and where it was published to.
+type PublishedMessage struct {
+	Exchange   string
+	RoutingKey string
+	Message    *Message
+}
+
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{}
+}
+
+func (p *MemoryPublisher) Publish(
+	ctx context.Context,
+	exchange string,
+	routingKey string,
+	message *Message,
+) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.Err != nil {
+		return p.Err
+	}
+
+	p.published = append(p.published, PublishedMessage{
+		Exchange:   exchange,
+		RoutingKey: routingKey,
+		Message:    message,
+	})
+	return nil
+}
+
+// Published returns a copy of the messages published so far, in the order they were published.
+func (p *MemoryPublisher) Published() []PublishedMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]PublishedMessage(nil), p.published...)
+}
+
+func (p *MemoryPublisher) Close() error {
+	return nil
+}
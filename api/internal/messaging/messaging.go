@@ -0,0 +1,89 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// JobsQueue is the durable queue compression-service consumes new jobs from.
+const JobsQueue = "jobs"
+
+// CancellationsExchange is the durable fanout exchange cancel messages are published to, every compression-service
+// instance gets a copy as any of them could be running the job.
+const CancellationsExchange = "job_cancellations"
+
+type Message struct {
+	Event   string          `json:"event"`
+	JobId   int64           `json:"job_id"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Publisher delivers messages to compression-service through an exchange, the default exchange ("") routes straight
+// to the queue named by the routing key. Publish only returns nil once the broker has taken responsibility for the
+// message.
+type Publisher interface {
+	Publish(ctx context.Context, exchange string, routingKey string, message *Message) error
+	Close() error
+}
+
+// Message events
+const (
+	NewJobEvent    = "new_job"
+	CancelJobEvent = "cancel_job"
+)
+
+// NewJobPayload tells compression-service where to fetch a job's file from and put the result. The pre-signed URLs
+// are left out of what is stored in the outbox, the relay fills them in as the message is published.
+type NewJobPayload struct {
+	DownloadUrl    string         `json:"download_url"`
+	UploadUrl      string         `json:"upload_url"`
+	InputContainer string         `json:"input_container"`
+	MaxResolution  int64          `json:"max_resolution"` // width * height, -1 for unlimited
+	Output         OutputSettings `json:"output"`
+}
+
+type OutputSettings struct {
+	Codec        string `json:"codec"`
+	Container    string `json:"container"`
+	Crf          int    `json:"crf"`
+	Preset       string `json:"preset"`
+	MaxWidth     int    `json:"max_width"`
+	MaxHeight    int    `json:"max_height"`
+	AudioBitrate int    `json:"audio_bitrate"`
+}
+
+func NewJobMessage(
+	jobId int64,
+	payload NewJobPayload,
+) (*Message, error) {
+	payloadJson, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Event:   NewJobEvent,
+		JobId:   jobId,
+		Payload: payloadJson,
+	}, nil
+}
+
+type CancelJobPayload struct {
+	Reason string `json:"reason"`
+}
+
+func CancelJobMessage(
+	jobId int64,
+	payload CancelJobPayload,
+) (*Message, error) {
+	payloadJson, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Event:   CancelJobEvent,
+		JobId:   jobId,
+		Payload: payloadJson,
+	}, nil
+}
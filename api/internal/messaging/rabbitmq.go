@@ -0,0 +1,140 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"sync"
+)
+
+type RabbitPublisher struct {
+	Connection *amqp.Connection
+	channel    *amqp.Channel
+	url        string
+	mu         sync.Mutex
+}
+
+func NewRabbitPublisher(
+	username string,
+	password string,
+	host string,
+) (*RabbitPublisher, error) {
+	p := &RabbitPublisher{
+		url: fmt.Sprintf("amqp://%s:%s@%s/", username, password, host),
+	}
+
+	if err := p.connect(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// connect (re)opens the connection and a confirming channel, callers must hold the lock.
+func (p *RabbitPublisher) connect() error {
+	if p.Connection == nil || p.Connection.IsClosed() {
+		conn, err := amqp.Dial(p.url)
+		if err != nil {
+			return fmt.Errorf("error connecting to broker: %v", err)
+		}
+		p.Connection = conn
+	}
+
+	ch, err := p.Connection.Channel()
+	if err != nil {
+		return fmt.Errorf("error opening channel: %v", err)
+	}
+
+	// Have the broker acknowledge every message we publish
+	if err = ch.Confirm(false); err != nil {
+		ch.Close()
+		return fmt.Errorf("error enabling publisher confirms: %v", err)
+	}
+
+	// Must match the declaration in compression-service
+	_, err = ch.QueueDeclare(
+		JobsQueue,
+		true,  // Durable
+		false, // Auto-delete
+		false, // Exclusive
+		false, // No-wait
+		nil,
+	)
+	if err != nil {
+		ch.Close()
+		return fmt.Errorf("error declaring jobs queue: %v", err)
+	}
+
+	err = ch.ExchangeDeclare(
+		CancellationsExchange,
+		"fanout",
+		true,  // Durable
+		false, // Auto-delete
+		false, // Internal
+		false, // No-wait
+		nil,
+	)
+	if err != nil {
+		ch.Close()
+		return fmt.Errorf("error declaring cancellations exchange: %v", err)
+	}
+
+	p.channel = ch
+	return nil
+}
+
+func (p *RabbitPublisher) Publish(
+	ctx context.Context,
+	exchange string,
+	routingKey string,
+	message *Message,
+) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.channel == nil || p.channel.IsClosed() {
+		if err = p.connect(); err != nil {
+			return err
+		}
+	}
+
+	confirmation, err := p.channel.PublishWithDeferredConfirmWithContext(ctx,
+		exchange,
+		routingKey,
+		false, // Mandatory
+		false, // Immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("error publishing message: %v", err)
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error waiting for publisher confirm: %v", err)
+	}
+	if !acked {
+		return fmt.Errorf("broker rejected message for job %d", message.JobId)
+	}
+
+	return nil
+}
+
+func (p *RabbitPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.channel != nil {
+		p.channel.Close()
+	}
+	return p.Connection.Close()
+}
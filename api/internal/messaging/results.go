@@ -0,0 +1,325 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log"
+	"time"
+)
+
+const (
+	// ResultsExchange is the durable topic exchange compression-service publishes job results to.
+	ResultsExchange = "job_results"
+	// ResultsQueue collects every job result for the api.
+	ResultsQueue = "api.job_results"
+	// ResultsDeadLetterQueue keeps results that couldn't be applied, for someone to look at.
+	ResultsDeadLetterQueue = "api.job_results.dead"
+
+	// maxResultRetries is how many times a result that failed to apply is retried before it is dead-lettered
+	maxResultRetries = 10
+	// retriesHeader counts how many times a result has been retried, classic queues don't count redeliveries
+	retriesHeader = "x-retries"
+)
+
+// ErrPermanent marks a result that will never apply, however many times it is retried. It is dead-lettered straight
+// away rather than requeued.
+var ErrPermanent = errors.New("result can't be applied")
+
+// Job result events
+const (
+	ResultDownloading = "downloading"
+	ResultProbing     = "probing"
+	ResultProbed      = "probed"
+	ResultStarted     = "started"
+	ResultProgress    = "progress"
+	ResultUploading   = "uploading"
+	ResultCompleted   = "completed"
+	ResultFailed      = "failed"
+)
+
+type JobResult struct {
+	Event string `json:"event"`
+	JobId int64  `json:"job_id"`
+	// Sequence orders a job's results, anything not newer than the last result applied to the job is stale.
+	Sequence  int64           `json:"sequence"`
+	Timestamp time.Time       `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// DecodePayload unmarshals the result's payload into v.
+func (r *JobResult) DecodePayload(v interface{}) error {
+	if len(r.Payload) == 0 {
+		return fmt.Errorf("%s result has no payload", r.Event)
+	}
+	return json.Unmarshal(r.Payload, v)
+}
+
+type ProbedPayload struct {
+	Codec    string  `json:"codec"`
+	Format   string  `json:"format"`
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	Size     int64   `json:"size"`
+	Duration float64 `json:"duration"`
+}
+
+type ProgressPayload struct {
+	Percent     float64 `json:"percent"`
+	EtaSeconds  float64 `json:"etaSeconds"`
+	Fps         float64 `json:"fps"`
+	BitrateKbps float64 `json:"bitrateKbps"`
+}
+
+type CompletedPayload struct {
+	Codec  string `json:"codec"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Size   int64  `json:"size"`
+}
+
+type FailedPayload struct {
+	Error string `json:"error"`
+}
+
+// ResultHandler applies a job result. Returning an error puts the result back on the queue to be retried, unless it
+// wraps ErrPermanent.
+type ResultHandler func(ctx context.Context, result *JobResult) error
+
+type ResultConsumer struct {
+	url string
+}
+
+func NewResultConsumer(
+	username string,
+	password string,
+	host string,
+) *ResultConsumer {
+	return &ResultConsumer{
+		url: fmt.Sprintf("amqp://%s:%s@%s/", username, password, host),
+	}
+}
+
+// Consume hands results to handler one at a time until ctx is cancelled, reconnecting with backoff if the broker goes
+// away.
+func (c *ResultConsumer) Consume(
+	ctx context.Context,
+	handler ResultHandler,
+) error {
+	backoff := time.Second
+	for {
+		err := c.consume(ctx, handler)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		log.Printf("result consumer disconnected, reconnecting in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		// Reset the backoff once we have managed to consume again
+		if errors.Is(err, errConsumerClosed) {
+			backoff = time.Second
+		} else {
+			backoff = min(backoff*2, time.Minute)
+		}
+	}
+}
+
+// errConsumerClosed means the consumer was running and then lost its channel, as opposed to failing to start.
+var errConsumerClosed = errors.New("channel closed")
+
+func (c *ResultConsumer) consume(
+	ctx context.Context,
+	handler ResultHandler,
+) error {
+	conn, err := amqp.Dial(c.url)
+	if err != nil {
+		return fmt.Errorf("error connecting to broker: %v", err)
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("error opening channel: %v", err)
+	}
+	defer ch.Close()
+
+	// Must match the declaration in compression-service
+	err = ch.ExchangeDeclare(
+		ResultsExchange,
+		"topic",
+		true,  // Durable
+		false, // Auto-delete
+		false, // Internal
+		false, // No-wait
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error declaring results exchange: %v", err)
+	}
+
+	_, err = ch.QueueDeclare(
+		ResultsQueue,
+		true,  // Durable
+		false, // Auto-delete
+		false, // Exclusive
+		false, // No-wait
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error declaring results queue: %v", err)
+	}
+
+	if err = ch.QueueBind(ResultsQueue, "job.#", ResultsExchange, false, nil); err != nil {
+		return fmt.Errorf("error binding results queue: %v", err)
+	}
+
+	_, err = ch.QueueDeclare(
+		ResultsDeadLetterQueue,
+		true,  // Durable
+		false, // Auto-delete
+		false, // Exclusive
+		false, // No-wait
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error declaring dead letter queue: %v", err)
+	}
+
+	// Results are only acknowledged once the broker has their retry or dead letter copy
+	if err = ch.Confirm(false); err != nil {
+		return fmt.Errorf("error enabling publisher confirms: %v", err)
+	}
+
+	if err = ch.Qos(10, 0, false); err != nil {
+		return fmt.Errorf("error setting prefetch: %v", err)
+	}
+
+	deliveries, err := ch.Consume(
+		ResultsQueue,
+		"",    // Consumer tag, generated by the broker
+		false, // Auto-ack
+		false, // Exclusive
+		false, // No-local
+		false, // No-wait
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error consuming results queue: %v", err)
+	}
+
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case amqpErr := <-closed:
+			return fmt.Errorf("%w: %v", errConsumerClosed, amqpErr)
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return errConsumerClosed
+			}
+			handleResult(ctx, ch, delivery, handler)
+		}
+	}
+}
+
+func handleResult(
+	ctx context.Context,
+	ch *amqp.Channel,
+	delivery amqp.Delivery,
+	handler ResultHandler,
+) {
+	var result JobResult
+	if err := json.Unmarshal(delivery.Body, &result); err != nil {
+		log.Printf("dead-lettering malformed job result: %s", delivery.Body)
+		settleResult(ctx, ch, delivery, ResultsDeadLetterQueue, nil)
+		return
+	}
+
+	err := handler(ctx, &result)
+	if err == nil {
+		if err = delivery.Ack(false); err != nil {
+			log.Printf("error acknowledging job result: %v", err)
+		}
+		return
+	}
+
+	retries, _ := delivery.Headers[retriesHeader].(int32)
+	if errors.Is(err, ErrPermanent) || retries >= maxResultRetries {
+		log.Printf("dead-lettering %s result for job %d after %d retries: %v", result.Event, result.JobId, retries,
+			err)
+		settleResult(ctx, ch, delivery, ResultsDeadLetterQueue, nil)
+		return
+	}
+	log.Printf("error applying %s result for job %d: %v", result.Event, result.JobId, err)
+
+	// Don't spin on a result that can't be applied right now
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+	}
+	settleResult(ctx, ch, delivery, ResultsQueue, amqp.Table{retriesHeader: retries + 1})
+}
+
+// settleResult moves a delivery to queue, acknowledging it once the broker has confirmed the copy. If that fails it
+// is requeued as it was.
+func settleResult(
+	ctx context.Context,
+	ch *amqp.Channel,
+	delivery amqp.Delivery,
+	queue string,
+	headers amqp.Table,
+) {
+	err := publishConfirmed(ctx, ch, queue, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  delivery.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Body:         delivery.Body,
+	})
+	if err != nil {
+		log.Printf("error moving job result to %s: %v", queue, err)
+		if err = delivery.Nack(false, true); err != nil {
+			log.Printf("error requeueing job result: %v", err)
+		}
+		return
+	}
+
+	if err = delivery.Ack(false); err != nil {
+		log.Printf("error acknowledging job result: %v", err)
+	}
+}
+
+func publishConfirmed(
+	ctx context.Context,
+	ch *amqp.Channel,
+	queue string,
+	publishing amqp.Publishing,
+) error {
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx,
+		"", // The default exchange routes straight to the queue
+		queue,
+		false, // Mandatory
+		false, // Immediate
+		publishing,
+	)
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("broker rejected message")
+	}
+	return nil
+}
@@ -5,8 +5,11 @@ import (
 	"errors"
 	"github.com/brysonmco/compressor/internal/auth"
 	"github.com/brysonmco/compressor/internal/db"
+	"github.com/brysonmco/compressor/internal/models"
 	"github.com/brysonmco/compressor/internal/utils"
+	"log"
 	"net/http"
+	"slices"
 	"strings"
 )
 
@@ -22,22 +25,57 @@ func NewAuthMiddleware(auth *auth.Auth, database *db.Database) *AuthMiddleware {
 	}
 }
 
+// API key scopes, access tokens have all of them
+const (
+	ScopeJobsRead    = "jobs:read"
+	ScopeJobsWrite   = "jobs:write"
+	ScopeBillingRead = "billing:read"
+)
+
+var Scopes = []string{ScopeJobsRead, ScopeJobsWrite, ScopeBillingRead}
+
+// Protected requires an access token belonging to a user with a verified email. API keys are turned away, routes that
+// accept them use ProtectedWithScope.
 func (m *AuthMiddleware) Protected(next http.Handler) http.Handler {
+	return m.protected("", next)
+}
+
+// ProtectedWithScope is Protected, but also accepts API keys that have been granted scope.
+func (m *AuthMiddleware) ProtectedWithScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return m.protected(scope, next)
+	}
+}
+
+func (m *AuthMiddleware) protected(scope string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Validate token
-		id, err := m.Auth.ValidateAccessToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
-		if err != nil && errors.Is(err, errors.New("expired_token")) {
-			utils.WriteError(w, r, http.StatusUnauthorized, "token has expired", "expired_token", nil)
-			return
-		} else if err != nil {
-			utils.WriteError(w, r, http.StatusUnauthorized, "invalid token", "invalid_token", nil)
-			return
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		var id int64
+		if strings.HasPrefix(token, auth.ApiKeyPrefix) {
+			key, ok := m.authenticateApiKey(w, r, token, scope)
+			if !ok {
+				return
+			}
+			id = key.UserId
+		} else {
+			// Validate token
+			var err error
+			id, err = m.Auth.ValidateAccessToken(token)
+			if err != nil && errors.Is(err, errors.New("expired_token")) {
+				utils.WriteError(w, r, http.StatusUnauthorized, "token has expired", "expired_token", nil)
+				return
+			} else if err != nil {
+				utils.WriteError(w, r, http.StatusUnauthorized, "invalid token", "invalid_token", nil)
+				return
+			}
 		}
 
 		// Ensure their email is valid
 		user, err := m.Database.FindUserByID(r.Context(), id)
 		if err != nil {
 			utils.WriteError(w, r, http.StatusInternalServerError, "error fetching user", "user_not_found", nil)
+			return
 		}
 		if !user.EmailVerified {
 			utils.WriteError(w, r, http.StatusUnauthorized, "email not verified", "email_not_verified", nil)
@@ -49,6 +87,41 @@ func (m *AuthMiddleware) Protected(next http.Handler) http.Handler {
 	})
 }
 
+// authenticateApiKey checks the key is live and has been granted scope, writing an error if not. An empty scope means
+// the route doesn't take API keys at all.
+func (m *AuthMiddleware) authenticateApiKey(
+	w http.ResponseWriter,
+	r *http.Request,
+	token string,
+	scope string,
+) (*models.ApiKey, bool) {
+	key, err := m.Database.FindApiKeyByHash(r.Context(), m.Auth.HashRefreshToken(token))
+	if err != nil || key.RevokedAt != nil {
+		utils.WriteError(w, r, http.StatusUnauthorized, "invalid api key", "invalid_api_key", nil)
+		return nil, false
+	}
+	if !key.IsActive() {
+		utils.WriteError(w, r, http.StatusUnauthorized, "api key has expired", "expired_api_key", nil)
+		return nil, false
+	}
+
+	if scope == "" {
+		utils.WriteError(w, r, http.StatusForbidden, "api keys can't be used here", "api_key_not_allowed", nil)
+		return nil, false
+	}
+	if !slices.Contains(key.Scopes, scope) {
+		utils.WriteError(w, r, http.StatusForbidden, "api key is missing a scope", "insufficient_scope", scope)
+		return nil, false
+	}
+
+	// Not worth failing the request over
+	if err = m.Database.TouchApiKey(r.Context(), key.Id); err != nil {
+		log.Printf("error recording use of api key %d: %v", key.Id, err)
+	}
+
+	return key, true
+}
+
 func (m *AuthMiddleware) ProtectedAdminOnly(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Validate token
@@ -1,30 +1,283 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+)
 
 type Job struct {
-	Id                         int64     `json:"id"`
-	UserId                     int64     `json:"userId"`
-	CreatedAt                  time.Time `json:"createdAt"`
-	UpdatedAt                  time.Time `json:"updatedAt"`
-	FileUploaded               bool      `json:"fileUploaded"`
-	FileName                   string    `json:"fileName"`
-	Status                     string    `json:"status"`
-	InputCodec                 string    `json:"inputCodec"`
-	InputContainer             string    `json:"inputContainer"`
-	InputResolutionHorizontal  int       `json:"inputResolutionHorizontal"`
-	InputResolutionVertical    int       `json:"inputResolutionVertical"`
-	InputSize                  int64     `json:"inputSize"`
-	OutputCodec                string    `json:"outputCodec"`
-	OutputContainer            string    `json:"output_container"`
-	OutputResolutionHorizontal int       `json:"outputResolutionHorizontal"`
-	OutputResolutionVertical   int       `json:"outputResolutionVertical"`
-	OutputSize                 int64     `json:"output_size"`
+	Id                         int64          `json:"id"`
+	UserId                     int64          `json:"userId"`
+	CreatedAt                  time.Time      `json:"createdAt"`
+	UpdatedAt                  time.Time      `json:"updatedAt"`
+	FileUploaded               bool           `json:"fileUploaded"`
+	FileName                   string         `json:"fileName"`
+	Status                     JobStatus      `json:"status"`
+	InputCodec                 string         `json:"inputCodec"`
+	InputContainer             string         `json:"inputContainer"`
+	InputResolutionHorizontal  int            `json:"inputResolutionHorizontal"`
+	InputResolutionVertical    int            `json:"inputResolutionVertical"`
+	InputSize                  int64          `json:"inputSize"`
+	InputDuration              float64        `json:"inputDuration"`
+	Output                     OutputSettings `json:"output"`
+	OutputResolutionHorizontal int            `json:"outputResolutionHorizontal"`
+	OutputResolutionVertical   int            `json:"outputResolutionVertical"`
+	OutputSize                 int64          `json:"outputSize"`
+	Progress                   JobProgress    `json:"progress"`
+	FailureReason              string         `json:"failureReason,omitempty"`
+	LastResultSequence         int64          `json:"-"`
+}
+
+// MarshalJSON also writes the output fields under the names jobs used to have, until clients have moved over to
+// output and outputSize.
+func (j Job) MarshalJSON() ([]byte, error) {
+	type job Job
+	return json.Marshal(struct {
+		job
+		// Deprecated: use output.codec
+		OutputCodec string `json:"outputCodec"`
+		// Deprecated: use output.container
+		OutputContainer string `json:"output_container"`
+		// Deprecated: use outputSize
+		DeprecatedOutputSize int64 `json:"output_size"`
+	}{
+		job:                  job(j),
+		OutputCodec:          j.Output.Codec,
+		OutputContainer:      j.Output.Container,
+		DeprecatedOutputSize: j.OutputSize,
+	})
+}
+
+type JobProgress struct {
+	Percent     float64    `json:"percent"`
+	EtaSeconds  float64    `json:"etaSeconds"`
+	Fps         float64    `json:"fps"`
+	BitrateKbps float64    `json:"bitrateKbps"`
+	UpdatedAt   *time.Time `json:"updatedAt"`
 }
 
 type CreateJob struct {
-	UserId         int64  `json:"userId"`
-	FileName       string `json:"fileName"`
-	InputContainer string `json:"inputContainer"`
-	InputSize      int64  `json:"inputSize"`
+	UserId         int64          `json:"userId"`
+	FileName       string         `json:"fileName"`
+	InputContainer string         `json:"inputContainer"`
+	InputSize      int64          `json:"inputSize"`
+	Output         OutputSettings `json:"output"`
+}
+
+// OutputSettings are what the user asked the compressed file to look like.
+type OutputSettings struct {
+	Codec        string `json:"codec"`
+	Container    string `json:"container"`
+	Crf          int    `json:"crf"`
+	Preset       string `json:"preset"`
+	MaxWidth     int    `json:"maxWidth"`
+	MaxHeight    int    `json:"maxHeight"`
+	AudioBitrate int    `json:"audioBitrate"` // kbit/s
+}
+
+var DefaultOutputSettings = OutputSettings{
+	Codec:        "h264",
+	Container:    "mp4",
+	Crf:          23,
+	Preset:       "medium",
+	MaxWidth:     1920,
+	MaxHeight:    1080,
+	AudioBitrate: 128,
+}
+
+var (
+	outputCodecs     = []string{"h264", "h265"}
+	outputContainers = []string{"mp4", "mkv", "mov"}
+	outputPresets    = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower",
+		"veryslow"}
+)
+
+// WithDefaults fills in anything left unset from DefaultOutputSettings. A CRF of 0 (lossless) can't be asked for.
+func (o OutputSettings) WithDefaults() OutputSettings {
+	if o.Codec == "" {
+		o.Codec = DefaultOutputSettings.Codec
+	}
+	if o.Container == "" {
+		o.Container = DefaultOutputSettings.Container
+	}
+	if o.Crf == 0 {
+		o.Crf = DefaultOutputSettings.Crf
+	}
+	if o.Preset == "" {
+		o.Preset = DefaultOutputSettings.Preset
+	}
+	if o.MaxWidth == 0 {
+		o.MaxWidth = DefaultOutputSettings.MaxWidth
+	}
+	if o.MaxHeight == 0 {
+		o.MaxHeight = DefaultOutputSettings.MaxHeight
+	}
+	if o.AudioBitrate == 0 {
+		o.AudioBitrate = DefaultOutputSettings.AudioBitrate
+	}
+	return o
+}
+
+// Validate returns a description of the first setting that is out of range.
+func (o OutputSettings) Validate() error {
+	switch {
+	case !slices.Contains(outputCodecs, o.Codec):
+		return fmt.Errorf("codec must be one of %v", outputCodecs)
+	case !slices.Contains(outputContainers, o.Container):
+		return fmt.Errorf("container must be one of %v", outputContainers)
+	case o.Crf < 1 || o.Crf > 51:
+		return fmt.Errorf("crf must be between 1 and 51")
+	case !slices.Contains(outputPresets, o.Preset):
+		return fmt.Errorf("preset must be one of %v", outputPresets)
+	case o.MaxWidth < 16 || o.MaxWidth > 7680:
+		return fmt.Errorf("maxWidth must be between 16 and 7680")
+	case o.MaxHeight < 16 || o.MaxHeight > 4320:
+		return fmt.Errorf("maxHeight must be between 16 and 4320")
+	case o.AudioBitrate < 32 || o.AudioBitrate > 320:
+		return fmt.Errorf("audioBitrate must be between 32 and 320")
+	}
+	return nil
+}
+
+type JobStatus string
+
+const (
+	JobStatusAwaitingUpload JobStatus = "awaiting_upload"
+	JobStatusQueued         JobStatus = "queued"
+	JobStatusDownloading    JobStatus = "downloading"
+	JobStatusProbing        JobStatus = "probing"
+	JobStatusCompressing    JobStatus = "compressing"
+	JobStatusUploading      JobStatus = "uploading"
+	JobStatusCompleted      JobStatus = "completed"
+	JobStatusFailed         JobStatus = "failed"
+	JobStatusCancelled      JobStatus = "cancelled"
+	JobStatusExpired        JobStatus = "expired"
+)
+
+// jobTransitions lists the statuses a job may move to from each status. Processing stages may be skipped, as progress
+// from compression-service is best effort, and a redelivered job starts over from downloading.
+var jobTransitions = map[JobStatus][]JobStatus{
+	JobStatusAwaitingUpload: {JobStatusQueued, JobStatusCancelled, JobStatusExpired},
+	JobStatusQueued: {JobStatusDownloading, JobStatusProbing, JobStatusCompressing, JobStatusUploading,
+		JobStatusCompleted, JobStatusFailed, JobStatusCancelled},
+	JobStatusDownloading: {JobStatusProbing, JobStatusCompressing, JobStatusUploading, JobStatusCompleted,
+		JobStatusFailed, JobStatusCancelled},
+	JobStatusProbing: {JobStatusDownloading, JobStatusCompressing, JobStatusUploading, JobStatusCompleted,
+		JobStatusFailed, JobStatusCancelled},
+	JobStatusCompressing: {JobStatusDownloading, JobStatusUploading, JobStatusCompleted, JobStatusFailed,
+		JobStatusCancelled},
+	JobStatusUploading: {JobStatusDownloading, JobStatusCompleted, JobStatusFailed, JobStatusCancelled},
+	JobStatusCompleted: {JobStatusExpired},
+}
+
+// CanTransitionTo reports whether a job may move from s to status.
+func (s JobStatus) CanTransitionTo(status JobStatus) bool {
+	for _, allowed := range jobTransitions[s] {
+		if allowed == status {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValid reports whether s is a known status.
+func (s JobStatus) IsValid() bool {
+	switch s {
+	case JobStatusAwaitingUpload, JobStatusQueued, JobStatusDownloading, JobStatusProbing, JobStatusCompressing,
+		JobStatusUploading, JobStatusCompleted, JobStatusFailed, JobStatusCancelled, JobStatusExpired:
+		return true
+	}
+	return false
+}
+
+// IsTerminal reports whether a job in this status will never run again.
+func (s JobStatus) IsTerminal() bool {
+	switch s {
+	case JobStatusCompleted, JobStatusFailed, JobStatusCancelled, JobStatusExpired:
+		return true
+	}
+	return false
+}
+
+// JobEvent records a job moving from one status to another.
+type JobEvent struct {
+	Id         int64     `json:"id"`
+	JobId      int64     `json:"jobId"`
+	FromStatus JobStatus `json:"fromStatus"`
+	ToStatus   JobStatus `json:"toStatus"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// JobSort is a field a job listing can be ordered by.
+type JobSort string
+
+const (
+	JobSortCreatedAt JobSort = "createdAt"
+	JobSortUpdatedAt JobSort = "updatedAt"
+	JobSortInputSize JobSort = "inputSize"
+)
+
+func (s JobSort) IsValid() bool {
+	switch s {
+	case JobSortCreatedAt, JobSortUpdatedAt, JobSortInputSize:
+		return true
+	}
+	return false
+}
+
+// JobListOptions filter and order a listing of a user's jobs. Zero values don't filter.
+type JobListOptions struct {
+	Statuses        []JobStatus
+	CreatedAfter    *time.Time
+	CreatedBefore   *time.Time
+	InputContainer  string
+	OutputContainer string
+	Sort            JobSort
+	Descending      bool
+	After           *JobCursor // Continue the listing after this position
+	Limit           int
+}
+
+// JobCursor is a position in a listing, the sorted value of the last job returned and its id to break ties. It is
+// only meaningful for the sort it was made with.
+type JobCursor struct {
+	Sort       JobSort `json:"sort"`
+	Descending bool    `json:"descending"`
+	Value      string  `json:"value"`
+	Id         int64   `json:"id"`
+}
+
+// CursorAfter is the position just after job in a listing sorted by sort.
+func (j *Job) CursorAfter(
+	sort JobSort,
+	descending bool,
+) JobCursor {
+	cursor := JobCursor{Sort: sort, Descending: descending, Id: j.Id}
+	switch sort {
+	case JobSortUpdatedAt:
+		cursor.Value = j.UpdatedAt.Format(time.RFC3339Nano)
+	case JobSortInputSize:
+		cursor.Value = strconv.FormatInt(j.InputSize, 10)
+	default:
+		cursor.Value = j.CreatedAt.Format(time.RFC3339Nano)
+	}
+	return cursor
+}
+
+// IsValid checks the cursor's value is what its sort compares against, anything else would fail in the query.
+func (c JobCursor) IsValid() bool {
+	var err error
+	switch c.Sort {
+	case JobSortCreatedAt, JobSortUpdatedAt:
+		_, err = time.Parse(time.RFC3339Nano, c.Value)
+	case JobSortInputSize:
+		_, err = strconv.ParseInt(c.Value, 10, 64)
+	default:
+		return false
+	}
+	return err == nil
 }
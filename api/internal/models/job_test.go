@@ -0,0 +1,62 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestJobCursorIsValid(t *testing.T) {
+	job := &Job{Id: 1, CreatedAt: time.Now(), UpdatedAt: time.Now(), InputSize: 1024}
+
+	tests := []struct {
+		name   string
+		cursor JobCursor
+		valid  bool
+	}{
+		{"created at", job.CursorAfter(JobSortCreatedAt, false), true},
+		{"updated at", job.CursorAfter(JobSortUpdatedAt, true), true},
+		{"input size", job.CursorAfter(JobSortInputSize, false), true},
+		{"size for a timestamp", JobCursor{Sort: JobSortCreatedAt, Value: "1024", Id: 1}, false},
+		{"timestamp for a size", JobCursor{Sort: JobSortInputSize, Value: time.Now().Format(time.RFC3339Nano), Id: 1}, false},
+		{"garbage", JobCursor{Sort: JobSortUpdatedAt, Value: "'; DROP TABLE jobs", Id: 1}, false},
+		{"unknown sort", JobCursor{Sort: "status", Value: "1", Id: 1}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if valid := test.cursor.IsValid(); valid != test.valid {
+				t.Errorf("expected valid %v, got %v", test.valid, valid)
+			}
+		})
+	}
+}
+
+func TestJobDeprecatedFields(t *testing.T) {
+	job := &Job{Id: 1, Output: OutputSettings{Codec: "h265", Container: "mkv"}, OutputSize: 2048}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("marshalling job: %v", err)
+	}
+	var fields map[string]any
+	if err = json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("unmarshalling job: %v", err)
+	}
+
+	expected := map[string]any{
+		"id":               float64(1),
+		"outputSize":       float64(2048),
+		"output_size":      float64(2048),
+		"outputCodec":      "h265",
+		"output_container": "mkv",
+	}
+	for key, value := range expected {
+		if fields[key] != value {
+			t.Errorf("expected %s to be %v, got %v", key, value, fields[key])
+		}
+	}
+	if output, ok := fields["output"].(map[string]any); !ok || output["codec"] != "h265" {
+		t.Errorf("expected nested output settings, got %v", fields["output"])
+	}
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type OutboxMessage struct {
+	Id            int64           `json:"id"`
+	Exchange      string          `json:"exchange"`
+	RoutingKey    string          `json:"routingKey"`
+	Event         string          `json:"event"`
+	JobId         int64           `json:"jobId"`
+	Payload       json.RawMessage `json:"payload"`
+	Attempts      int             `json:"attempts"`
+	LastError     *string         `json:"lastError"`
+	NextAttemptAt time.Time       `json:"nextAttemptAt"`
+	SentAt        *time.Time      `json:"sentAt"`
+	FailedAt      *time.Time      `json:"failedAt"` // Set once the message is given up on
+	CreatedAt     time.Time       `json:"createdAt"`
+}
+
+type CreateOutboxMessage struct {
+	Exchange   string          `json:"exchange"`   // Empty for the default exchange
+	RoutingKey string          `json:"routingKey"` // The queue, for the default exchange
+	Event      string          `json:"event"`
+	JobId      int64           `json:"jobId"`
+	Payload    json.RawMessage `json:"payload"`
+}
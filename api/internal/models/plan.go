@@ -8,10 +8,22 @@ type Plan struct {
 	Tokens          int           `json:"tokens"`
 	Priority        string        `json:"priority"`
 	StripeProductId string        `json:"stripeProductId"`
-	Price           int           `json:"price"`
 	ConcurrentJobs  int           `json:"concurrentJobs"`
 	MaxResolution   int64         `json:"maxResolution"`
 	MaxFileSize     int64         `json:"maxFileSize"`
 	FileRetention   time.Duration `json:"fileRetention"`
 	Watermark       bool          `json:"watermark"`
 }
+
+// Unlimited is stored in place of a limit for plans that don't have one.
+const Unlimited = -1
+
+// AllowsConcurrentJobs reports whether a user already running the given number of jobs may start another.
+func (p *Plan) AllowsConcurrentJobs(running int) bool {
+	return p.ConcurrentJobs == Unlimited || running < p.ConcurrentJobs
+}
+
+// AllowsResolution reports whether a video of the given dimensions is within the plan's limit.
+func (p *Plan) AllowsResolution(width int, height int) bool {
+	return p.MaxResolution == Unlimited || int64(width)*int64(height) <= p.MaxResolution
+}
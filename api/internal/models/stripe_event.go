@@ -0,0 +1,26 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// StripeEvent is a webhook event received from Stripe, kept until the worker has processed it.
+type StripeEvent struct {
+	Id            string          `json:"id"`
+	Type          string          `json:"type"`
+	Created       time.Time       `json:"created"`
+	Payload       json.RawMessage `json:"payload"`
+	Attempts      int             `json:"attempts"`
+	LastError     *string         `json:"lastError"`
+	NextAttemptAt *time.Time      `json:"nextAttemptAt"` // Nil once it has run out of attempts
+	ProcessedAt   *time.Time      `json:"processedAt"`
+	ReceivedAt    time.Time       `json:"receivedAt"`
+}
+
+type CreateStripeEvent struct {
+	Id      string          `json:"id"`
+	Type    string          `json:"type"`
+	Created time.Time       `json:"created"`
+	Payload json.RawMessage `json:"payload"`
+}
@@ -11,8 +11,11 @@ type Subscription struct {
 	Status               string    `json:"status"`
 	CurrentPeriodStart   time.Time `json:"currentPeriodStart"`
 	CurrentPeriodEnd     time.Time `json:"currentPeriodEnd"`
+	CancelAtPeriodEnd    bool      `json:"cancelAtPeriodEnd"`
 	CreatedAt            time.Time `json:"createdAt"`
 	UpdatedAt            time.Time `json:"updatedAt"`
+	// LastEventAt is when Stripe sent the state this row was last synced from
+	LastEventAt *time.Time `json:"-"`
 }
 
 type CreateSubscription struct {
@@ -23,11 +26,6 @@ type CreateSubscription struct {
 	Status               string    `json:"status"`
 	CurrentPeriodStart   time.Time `json:"currentPeriodStart"`
 	CurrentPeriodEnd     time.Time `json:"currentPeriodEnd"`
-}
-
-type TokenBalance struct {
-	UserId       int64     `json:"userId"`
-	TokenBalance int       `json:"tokenBalance"`
-	PeriodStart  time.Time `json:"periodStart"`
-	PeriodEnd    time.Time `json:"periodEnd"`
+	CancelAtPeriodEnd    bool      `json:"cancelAtPeriodEnd"`
+	LastEventAt          time.Time `json:"lastEventAt"`
 }
@@ -0,0 +1,59 @@
+package models
+
+import "time"
+
+type TokenTransactionKind string
+
+const (
+	TokenGrant       TokenTransactionKind = "grant"
+	TokenPurchase    TokenTransactionKind = "purchase"
+	TokenReservation TokenTransactionKind = "reservation"
+	TokenDebit       TokenTransactionKind = "debit"
+	TokenRefund      TokenTransactionKind = "refund"
+	TokenExpiration  TokenTransactionKind = "expiration"
+)
+
+// TokenAccount is one side of a ledger entry. Only available and reserved belong to the user, the rest record where
+// tokens came from and went to.
+type TokenAccount string
+
+const (
+	TokenAccountAvailable TokenAccount = "available"
+	TokenAccountReserved  TokenAccount = "reserved"
+	TokenAccountGranted   TokenAccount = "granted"
+	TokenAccountPurchased TokenAccount = "purchased"
+	TokenAccountSpent     TokenAccount = "spent"
+	TokenAccountExpired   TokenAccount = "expired"
+)
+
+type TokenEntry struct {
+	Account TokenAccount `json:"account"`
+	Amount  int          `json:"amount"`
+}
+
+// TokenLedgerBalance is what a user has to spend, derived from the ledger.
+type TokenLedgerBalance struct {
+	Available int `json:"available"`
+	Reserved  int `json:"reserved"`
+}
+
+// TokenPeriod is a span of time a user's plan allocation is granted for.
+type TokenPeriod struct {
+	Id          int64      `json:"id"`
+	UserId      int64      `json:"userId"`
+	PlanId      int64      `json:"planId"`
+	Granted     int        `json:"granted"`    // Tokens granted for the period, including plan upgrades
+	Allocation  int        `json:"allocation"` // The largest plan allocation the period has been granted for
+	PeriodStart time.Time  `json:"periodStart"`
+	PeriodEnd   time.Time  `json:"periodEnd"`
+	ClosedAt    *time.Time `json:"closedAt"`
+}
+
+// TokenPack is a one-off bundle of tokens that can be bought on top of a plan.
+type TokenPack struct {
+	Id            int64  `json:"id"`
+	Name          string `json:"name"`
+	Tokens        int    `json:"tokens"`
+	StripePriceId string `json:"stripePriceId"`
+	Active        bool   `json:"active"`
+}
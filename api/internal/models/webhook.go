@@ -0,0 +1,73 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// WebhookEndpoint is a URL a user wants job events POSTed to.
+type WebhookEndpoint struct {
+	Id        int64     `json:"id"`
+	UserId    int64     `json:"userId"`
+	Url       string    `json:"url"`
+	Secret    string    `json:"-"` // Only shown when the endpoint is created
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type CreateWebhookEndpoint struct {
+	UserId int64    `json:"userId"`
+	Url    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryDelivered WebhookDeliveryStatus = "delivered"
+	WebhookDeliveryFailed    WebhookDeliveryStatus = "failed" // Out of attempts, only sent again if redelivered
+)
+
+// WebhookDelivery is one event being sent to one endpoint.
+type WebhookDelivery struct {
+	Id            int64                 `json:"id"`
+	EndpointId    int64                 `json:"endpointId"`
+	EventId       string                `json:"eventId"`
+	Event         string                `json:"event"`
+	JobId         *int64                `json:"jobId"`
+	Payload       json.RawMessage       `json:"payload"`
+	Status        WebhookDeliveryStatus `json:"status"`
+	Attempts      int                   `json:"attempts"`
+	NextAttemptAt time.Time             `json:"nextAttemptAt"`
+	DeliveredAt   *time.Time            `json:"deliveredAt"`
+	CreatedAt     time.Time             `json:"createdAt"`
+}
+
+// DueWebhookDelivery is a delivery along with where it is going.
+type DueWebhookDelivery struct {
+	WebhookDelivery
+	Url    string
+	Secret string
+}
+
+// WebhookDeliveryAttempt is the outcome of one request made for a delivery.
+type WebhookDeliveryAttempt struct {
+	Id             int64     `json:"id"`
+	DeliveryId     int64     `json:"deliveryId"`
+	ResponseStatus *int      `json:"responseStatus"`
+	ResponseBody   *string   `json:"responseBody"`
+	Error          *string   `json:"error"`
+	DurationMs     int       `json:"durationMs"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+type CreateWebhookDeliveryAttempt struct {
+	DeliveryId     int64  `json:"deliveryId"`
+	ResponseStatus *int   `json:"responseStatus"`
+	ResponseBody   string `json:"responseBody"`
+	Error          string `json:"error"`
+	DurationMs     int    `json:"durationMs"`
+}
@@ -0,0 +1,161 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/brysonmco/compressor/internal/db"
+	"github.com/brysonmco/compressor/internal/messaging"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/brysonmco/compressor/internal/storage"
+	"log"
+	"time"
+)
+
+const (
+	pollInterval = time.Second
+	batchSize    = 50
+	// lease is how long a claimed message is left alone by other relays while it is published
+	lease = time.Minute
+	// maxAttempts is how many times a message is published before it is given up on, retrying for about an hour
+	maxAttempts = 15
+	minBackoff  = time.Second
+	maxBackoff  = 10 * time.Minute
+)
+
+// store is what the relay needs from the database.
+type store interface {
+	ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]*models.OutboxMessage, error)
+	MarkOutboxMessageSent(ctx context.Context, id int64) error
+	MarkOutboxMessageFailed(ctx context.Context, id int64, lastError string, nextAttemptAt *time.Time) error
+	FindJobById(ctx context.Context, id int64) (*models.Job, error)
+}
+
+// Relay publishes messages written to the outbox table. Messages are written in the same transaction as the change
+// that caused them, so a message is never lost if publishing fails and never sent for a change that was rolled back.
+type Relay struct {
+	Database  store
+	Publisher messaging.Publisher
+	Storage   *storage.Storage
+}
+
+func NewRelay(
+	database *db.Database,
+	publisher messaging.Publisher,
+	strge *storage.Storage,
+) *Relay {
+	return &Relay{
+		Database:  database,
+		Publisher: publisher,
+		Storage:   strge,
+	}
+}
+
+// Run relays messages until ctx is cancelled.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Keep going while there are full batches waiting
+			for {
+				sent, err := r.relayBatch(ctx)
+				if err != nil {
+					log.Printf("error relaying outbox messages: %v", err)
+					break
+				}
+				if sent < batchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// relayBatch publishes one batch of pending messages, returning how many were due. Each message is marked sent or
+// failed as soon as it has been published, so a later failure can't undo the mark and have it published twice.
+func (r *Relay) relayBatch(ctx context.Context) (int, error) {
+	messages, err := r.Database.ClaimOutboxMessages(ctx, batchSize, lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, message := range messages {
+		if err = r.relay(ctx, message); err != nil {
+			log.Printf("error relaying outbox message %d: %v", message.Id, err)
+		}
+	}
+
+	return len(messages), nil
+}
+
+// relay publishes a message and records how it went.
+func (r *Relay) relay(
+	ctx context.Context,
+	message *models.OutboxMessage,
+) error {
+	payload, err := r.payload(ctx, message)
+	if err == nil {
+		err = r.Publisher.Publish(ctx, message.Exchange, message.RoutingKey, &messaging.Message{
+			Event:   message.Event,
+			JobId:   message.JobId,
+			Payload: payload,
+		})
+	}
+	if err == nil {
+		return r.Database.MarkOutboxMessageSent(ctx, message.Id)
+	}
+
+	log.Printf("error publishing outbox message %d (attempt %d): %v", message.Id, message.Attempts+1, err)
+	var nextAttemptAt *time.Time
+	if message.Attempts+1 < maxAttempts {
+		next := time.Now().Add(backoff(message.Attempts))
+		nextAttemptAt = &next
+	} else {
+		log.Printf("giving up on outbox message %d after %d attempts", message.Id, maxAttempts)
+	}
+	return r.Database.MarkOutboxMessageFailed(ctx, message.Id, err.Error(), nextAttemptAt)
+}
+
+// payload returns what to publish for a message. New jobs are stored without their pre-signed URLs, which are
+// generated here so they never sit in the database and are valid for as long as possible once sent.
+func (r *Relay) payload(
+	ctx context.Context,
+	message *models.OutboxMessage,
+) (json.RawMessage, error) {
+	if message.Event != messaging.NewJobEvent {
+		return message.Payload, nil
+	}
+
+	var payload messaging.NewJobPayload
+	if err := json.Unmarshal(message.Payload, &payload); err != nil {
+		return nil, fmt.Errorf("error parsing new job payload: %v", err)
+	}
+
+	job, err := r.Database.FindJobById(ctx, message.JobId)
+	if err != nil {
+		return nil, fmt.Errorf("error finding job: %v", err)
+	}
+
+	if payload.DownloadUrl, err = r.Storage.GenerateDownloadURLForUploads(ctx, job); err != nil {
+		return nil, fmt.Errorf("error generating download URL: %v", err)
+	}
+	if payload.UploadUrl, err = r.Storage.GenerateUploadURLForDownloads(ctx, job); err != nil {
+		return nil, fmt.Errorf("error generating upload URL: %v", err)
+	}
+
+	return json.Marshal(payload)
+}
+
+// backoff doubles the delay with every failed attempt, up to maxBackoff.
+func backoff(attempts int) time.Duration {
+	delay := minBackoff
+	for i := 0; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
@@ -0,0 +1,175 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/brysonmco/compressor/internal/messaging"
+	"github.com/brysonmco/compressor/internal/models"
+	"testing"
+	"time"
+)
+
+// memoryStore is an outbox table kept in memory.
+type memoryStore struct {
+	messages []*models.OutboxMessage
+	sent     map[int64]bool
+	failed   map[int64]*time.Time // The next attempt of each failed message, nil once given up on
+	markErr  map[int64]error      // Returned when marking a message sent
+}
+
+func newMemoryStore(messages ...*models.OutboxMessage) *memoryStore {
+	return &memoryStore{
+		messages: messages,
+		sent:     map[int64]bool{},
+		failed:   map[int64]*time.Time{},
+		markErr:  map[int64]error{},
+	}
+}
+
+func (s *memoryStore) ClaimOutboxMessages(
+	ctx context.Context,
+	limit int,
+	lease time.Duration,
+) ([]*models.OutboxMessage, error) {
+	var claimed []*models.OutboxMessage
+	for _, message := range s.messages {
+		if len(claimed) < limit && !s.sent[message.Id] {
+			claimed = append(claimed, message)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *memoryStore) MarkOutboxMessageSent(
+	ctx context.Context,
+	id int64,
+) error {
+	if err := s.markErr[id]; err != nil {
+		return err
+	}
+	s.sent[id] = true
+	return nil
+}
+
+func (s *memoryStore) MarkOutboxMessageFailed(
+	ctx context.Context,
+	id int64,
+	lastError string,
+	nextAttemptAt *time.Time,
+) error {
+	s.failed[id] = nextAttemptAt
+	return nil
+}
+
+func (s *memoryStore) FindJobById(
+	ctx context.Context,
+	id int64,
+) (*models.Job, error) {
+	return nil, errors.New("job not found")
+}
+
+func cancelMessage(id int64, attempts int) *models.OutboxMessage {
+	return &models.OutboxMessage{
+		Id:       id,
+		Exchange: messaging.CancellationsExchange,
+		Event:    messaging.CancelJobEvent,
+		JobId:    id,
+		Payload:  json.RawMessage(`{"reason":"cancelled"}`),
+		Attempts: attempts,
+	}
+}
+
+func TestRelayBatch(t *testing.T) {
+	database := newMemoryStore(cancelMessage(1, 0), cancelMessage(2, 0))
+	publisher := messaging.NewMemoryPublisher()
+	relay := &Relay{Database: database, Publisher: publisher}
+
+	count, err := relay.relayBatch(context.Background())
+	if err != nil {
+		t.Fatalf("relaying: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 messages due, got %d", count)
+	}
+
+	published := publisher.Published()
+	if len(published) != 2 {
+		t.Fatalf("expected 2 messages published, got %d", len(published))
+	}
+	for i, p := range published {
+		if p.Exchange != messaging.CancellationsExchange || p.RoutingKey != "" {
+			t.Errorf("expected message %d on the cancellations exchange, got %q %q", i, p.Exchange, p.RoutingKey)
+		}
+		if p.Message.JobId != int64(i+1) || p.Message.Event != messaging.CancelJobEvent {
+			t.Errorf("expected cancel for job %d, got %s for job %d", i+1, p.Message.Event, p.Message.JobId)
+		}
+		if !database.sent[int64(i+1)] {
+			t.Errorf("expected message %d marked sent", i+1)
+		}
+	}
+}
+
+func TestRelayBatchMarkError(t *testing.T) {
+	database := newMemoryStore(cancelMessage(1, 0), cancelMessage(2, 0))
+	database.markErr[1] = errors.New("connection reset")
+	publisher := messaging.NewMemoryPublisher()
+	relay := &Relay{Database: database, Publisher: publisher}
+
+	if _, err := relay.relayBatch(context.Background()); err != nil {
+		t.Fatalf("relaying: %v", err)
+	}
+
+	// One message failing to be marked doesn't hold up or undo the rest
+	if len(publisher.Published()) != 2 {
+		t.Errorf("expected both messages published, got %d", len(publisher.Published()))
+	}
+	if !database.sent[2] {
+		t.Error("expected message 2 marked sent")
+	}
+}
+
+func TestRelayBatchPublishError(t *testing.T) {
+	database := newMemoryStore(cancelMessage(1, 0), cancelMessage(2, maxAttempts-1))
+	publisher := messaging.NewMemoryPublisher()
+	publisher.Err = errors.New("broker unavailable")
+	relay := &Relay{Database: database, Publisher: publisher}
+
+	if _, err := relay.relayBatch(context.Background()); err != nil {
+		t.Fatalf("relaying: %v", err)
+	}
+
+	if len(database.sent) != 0 {
+		t.Errorf("expected nothing marked sent, got %v", database.sent)
+	}
+	if next, ok := database.failed[1]; !ok || next == nil || !next.After(time.Now()) {
+		t.Errorf("expected message 1 to be retried later, got %v", next)
+	}
+	if next, ok := database.failed[2]; !ok || next != nil {
+		t.Errorf("expected message 2 to be given up on, got %v", next)
+	}
+}
+
+func TestRelayNewJobWithoutJob(t *testing.T) {
+	database := newMemoryStore(&models.OutboxMessage{
+		Id:         1,
+		RoutingKey: messaging.JobsQueue,
+		Event:      messaging.NewJobEvent,
+		JobId:      1,
+		Payload:    json.RawMessage(`{}`),
+	})
+	publisher := messaging.NewMemoryPublisher()
+	relay := &Relay{Database: database, Publisher: publisher}
+
+	if _, err := relay.relayBatch(context.Background()); err != nil {
+		t.Fatalf("relaying: %v", err)
+	}
+
+	// Without its URLs the worker can't do anything with it
+	if len(publisher.Published()) != 0 {
+		t.Errorf("expected nothing published, got %v", publisher.Published())
+	}
+	if _, ok := database.failed[1]; !ok {
+		t.Error("expected the message marked failed")
+	}
+}
@@ -0,0 +1,38 @@
+package plans
+
+import (
+	"context"
+	"errors"
+	"github.com/brysonmco/compressor/internal/db"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/jackc/pgx/v5"
+)
+
+// FreePlanName is the plan anyone without an active subscription is on.
+const FreePlanName = "Free"
+
+// Resolver works out which plan's limits apply to a user.
+type Resolver struct {
+	Database *db.Database
+}
+
+func NewResolver(database *db.Database) *Resolver {
+	return &Resolver{
+		Database: database,
+	}
+}
+
+// ForUser returns the plan of the user's active subscription, or the free plan if they don't have one.
+func (r *Resolver) ForUser(
+	ctx context.Context,
+	userId int64,
+) (*models.Plan, error) {
+	subscription, err := r.Database.FindActiveSubscriptionByUserId(ctx, userId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return r.Database.FindPlanByName(ctx, FreePlanName)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return r.Database.FindPlanById(ctx, subscription.PlanId)
+}
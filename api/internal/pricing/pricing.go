@@ -0,0 +1,147 @@
+// Package pricing decides what jobs cost. Estimates shown to users, token reservations and the final charge for a job
+// all come from EstimateJob, so they only ever differ by how much was known about the input at the time.
+package pricing
+
+import (
+	"github.com/brysonmco/compressor/internal/models"
+	"math"
+)
+
+const (
+	// tokensPerMegapixelMinute is the base rate, for h264 at the medium preset
+	tokensPerMegapixelMinute = 1.0
+	// bytesPerToken is charged instead when the input's duration or resolution isn't known yet
+	bytesPerToken = 1024 * 1024
+	// assumedFps is used for output size estimates, we don't probe the frame rate
+	assumedFps = 30
+)
+
+// codecFactors are how much more work each codec is than h264.
+var codecFactors = map[string]float64{
+	"h264": 1,
+	"h265": 2,
+}
+
+// presetFactors are how much more work each x264/x265 preset is than medium.
+var presetFactors = map[string]float64{
+	"ultrafast": 0.25,
+	"superfast": 0.35,
+	"veryfast":  0.5,
+	"faster":    0.65,
+	"fast":      0.8,
+	"medium":    1,
+	"slow":      1.5,
+	"slower":    2.5,
+	"veryslow":  4,
+}
+
+// Input is what is known about the file being compressed, anything unknown is left zero.
+type Input struct {
+	Size     int64   `json:"size"`     // Bytes
+	Duration float64 `json:"duration"` // Seconds
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+}
+
+// JobInput is what has been recorded about a job's input, which is everything once it has been probed.
+func JobInput(job *models.Job) Input {
+	return Input{
+		Size:     job.InputSize,
+		Duration: job.InputDuration,
+		Width:    job.InputResolutionHorizontal,
+		Height:   job.InputResolutionVertical,
+	}
+}
+
+type Estimate struct {
+	Tokens     int   `json:"tokens"`
+	OutputSize int64 `json:"outputSize,omitempty"` // Bytes, only estimated when the duration and resolution are known
+}
+
+// EstimateJob estimates what compressing input with the given output settings costs and produces. Jobs are charged
+// by the megapixel-minutes encoded, scaled by codec and preset. Without a duration and resolution it falls back to a
+// token per started MiB of input.
+func EstimateJob(
+	input Input,
+	output models.OutputSettings,
+) Estimate {
+	if input.Duration <= 0 || input.Width <= 0 || input.Height <= 0 {
+		tokens := int((input.Size + bytesPerToken - 1) / bytesPerToken)
+		return Estimate{Tokens: max(tokens, 1)}
+	}
+
+	width, height := OutputResolution(input.Width, input.Height, output.MaxWidth, output.MaxHeight)
+	megapixels := float64(width*height) / 1_000_000
+	work := megapixels * input.Duration / 60 * codecFactor(output.Codec) * presetFactor(output.Preset)
+	tokens := int(math.Ceil(work * tokensPerMegapixelMinute))
+
+	return Estimate{
+		Tokens:     max(tokens, 1),
+		OutputSize: outputSize(input, output, width, height),
+	}
+}
+
+// Reservation is how many tokens to hold for a job before its input has been probed. The duration and resolution
+// come from the client and can't be trusted yet, so it never reserves less than the size-based fallback. The
+// reservation is checked again against the probed input.
+func Reservation(
+	input Input,
+	output models.OutputSettings,
+) int {
+	fallback := EstimateJob(Input{Size: input.Size}, output)
+	return max(EstimateJob(input, output).Tokens, fallback.Tokens)
+}
+
+// OutputResolution is the size ffmpeg will scale the input to, it fits inside the limits keeping the aspect ratio
+// and is never scaled up.
+func OutputResolution(
+	width int,
+	height int,
+	maxWidth int,
+	maxHeight int,
+) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 {
+		scale = math.Min(scale, float64(maxWidth)/float64(width))
+	}
+	if maxHeight > 0 {
+		scale = math.Min(scale, float64(maxHeight)/float64(height))
+	}
+	return int(float64(width) * scale), int(float64(height) * scale)
+}
+
+// outputSize estimates the compressed file's size from the CRF, which roughly halves the bitrate every 6 steps.
+func outputSize(
+	input Input,
+	output models.OutputSettings,
+	width int,
+	height int,
+) int64 {
+	bitsPerPixel := 0.07 * math.Pow(2, float64(23-output.Crf)/6)
+	if output.Codec == "h265" {
+		bitsPerPixel *= 0.6
+	}
+	videoBitrate := bitsPerPixel * float64(width*height) * assumedFps
+
+	// Compressing never makes the video meaningfully bigger
+	if input.Size > 0 {
+		videoBitrate = math.Min(videoBitrate, float64(input.Size*8)/input.Duration)
+	}
+
+	bitrate := videoBitrate + float64(output.AudioBitrate*1000)
+	return int64(bitrate / 8 * input.Duration)
+}
+
+func codecFactor(codec string) float64 {
+	if factor, ok := codecFactors[codec]; ok {
+		return factor
+	}
+	return 1
+}
+
+func presetFactor(preset string) float64 {
+	if factor, ok := presetFactors[preset]; ok {
+		return factor
+	}
+	return 1
+}
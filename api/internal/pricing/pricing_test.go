@@ -0,0 +1,107 @@
+package pricing
+
+import (
+	"github.com/brysonmco/compressor/internal/models"
+	"testing"
+)
+
+func TestEstimateJob(t *testing.T) {
+	output := models.OutputSettings{}.WithDefaults()
+	h265 := output
+	h265.Codec = "h265"
+	veryslow := output
+	veryslow.Preset = "veryslow"
+	capped := output
+	capped.MaxWidth = 1280
+	capped.MaxHeight = 720
+
+	tests := []struct {
+		name   string
+		input  Input
+		output models.OutputSettings
+		tokens int
+	}{
+		{"size only rounds up", Input{Size: 3*bytesPerToken + 1}, output, 4},
+		{"size only exact", Input{Size: 2 * bytesPerToken}, output, 2},
+		{"nothing known", Input{}, output, 1},
+		{"missing resolution", Input{Size: 5 * bytesPerToken, Duration: 60}, output, 5},
+		{"1080p minute", Input{Duration: 60, Width: 1920, Height: 1080}, output, 3},
+		{"1080p ten minutes", Input{Duration: 600, Width: 1920, Height: 1080}, output, 21},
+		{"h265 costs double", Input{Duration: 600, Width: 1920, Height: 1080}, h265, 42},
+		{"veryslow costs four times", Input{Duration: 600, Width: 1920, Height: 1080}, veryslow, 83},
+		{"charged on output resolution", Input{Duration: 600, Width: 1920, Height: 1080}, capped, 10},
+		{"short clip costs one", Input{Duration: 1, Width: 640, Height: 360}, output, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if tokens := EstimateJob(test.input, test.output).Tokens; tokens != test.tokens {
+				t.Errorf("expected %d tokens, got %d", test.tokens, tokens)
+			}
+		})
+	}
+}
+
+func TestEstimateJobOutputSize(t *testing.T) {
+	output := models.OutputSettings{}.WithDefaults()
+
+	if size := EstimateJob(Input{Size: bytesPerToken}, output).OutputSize; size != 0 {
+		t.Errorf("expected no output size without a duration and resolution, got %d", size)
+	}
+
+	// Compressing never makes the video bigger than the input, only the audio is added
+	input := Input{Size: bytesPerToken, Duration: 60, Width: 1920, Height: 1080}
+	size := EstimateJob(input, output).OutputSize
+	if maxSize := input.Size + int64(output.AudioBitrate*1000/8*60); size <= 0 || size > maxSize {
+		t.Errorf("expected an output size up to %d, got %d", maxSize, size)
+	}
+}
+
+func TestReservation(t *testing.T) {
+	output := models.OutputSettings{}.WithDefaults()
+
+	tests := []struct {
+		name   string
+		input  Input
+		tokens int
+	}{
+		// A client can't make the job cheaper by claiming a tiny duration or resolution
+		{"understated details", Input{Size: 500 * bytesPerToken, Duration: 1, Width: 16, Height: 16}, 500},
+		{"size only", Input{Size: 500 * bytesPerToken}, 500},
+		{"details cost more", Input{Size: 10 * bytesPerToken, Duration: 600, Width: 1920, Height: 1080}, 21},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if tokens := Reservation(test.input, output); tokens != test.tokens {
+				t.Errorf("expected %d tokens, got %d", test.tokens, tokens)
+			}
+		})
+	}
+}
+
+func TestOutputResolution(t *testing.T) {
+	tests := []struct {
+		name                string
+		width, height       int
+		maxWidth, maxHeight int
+		outWidth, outHeight int
+	}{
+		{"no limits", 1920, 1080, 0, 0, 1920, 1080},
+		{"within limits", 1280, 720, 1920, 1080, 1280, 720},
+		{"never scaled up", 640, 360, 3840, 2160, 640, 360},
+		{"width limited", 3840, 2160, 1920, 0, 1920, 1080},
+		{"height limited", 3840, 2160, 0, 720, 1280, 720},
+		{"tighter limit wins", 1920, 1080, 1280, 1080, 1280, 720},
+		{"portrait", 1080, 1920, 1280, 720, 405, 720},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			width, height := OutputResolution(test.width, test.height, test.maxWidth, test.maxHeight)
+			if width != test.outWidth || height != test.outHeight {
+				t.Errorf("expected %dx%d, got %dx%d", test.outWidth, test.outHeight, width, height)
+			}
+		})
+	}
+}
@@ -3,22 +3,45 @@ package storage
 import (
 	"context"
 	"fmt"
+	"github.com/brysonmco/compressor/internal/models"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
 	"time"
 )
 
+// Expiries are how long each kind of pre-signed URL stays valid for.
+type Expiries struct {
+	ClientUpload   time.Duration
+	ClientDownload time.Duration
+	// Worker URLs must outlive the time a job can sit in the queue before it runs
+	Worker time.Duration
+}
+
+var DefaultExpiries = Expiries{
+	ClientUpload:   time.Hour,
+	ClientDownload: 15 * time.Minute,
+	Worker:         12 * time.Hour,
+}
+
 type Storage struct {
-	Client        *minio.Client
-	UploadsBucket string
+	Client          *minio.Client
+	UploadsBucket   string
+	DownloadsBucket string
+	Expiries        Expiries
 }
 
 func NewStorage(
 	uploadsBucket string,
+	downloadsBucket string,
 	endpoint string,
 	accessKey string,
 	secretKey string,
 	secure bool,
+	expiries Expiries,
 ) (*Storage, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -31,26 +54,38 @@ func NewStorage(
 		return nil, fmt.Errorf("failed to create S3 client: %v", err)
 	}
 
-	// Check if the bucket exists
-	bucketExists, err := client.BucketExists(ctx, uploadsBucket)
-	if err != nil {
-		return nil, fmt.Errorf("failed to check if bucket exists: %v", err)
-	} else if !bucketExists {
-		return nil, fmt.Errorf("bucket does not exist")
+	// Check if the buckets exist
+	for _, bucket := range []string{uploadsBucket, downloadsBucket} {
+		bucketExists, err := client.BucketExists(ctx, bucket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if bucket %s exists: %v", bucket, err)
+		} else if !bucketExists {
+			return nil, fmt.Errorf("bucket %s does not exist", bucket)
+		}
 	}
 
 	return &Storage{
-		Client:        client,
-		UploadsBucket: uploadsBucket,
+		Client:          client,
+		UploadsBucket:   uploadsBucket,
+		DownloadsBucket: downloadsBucket,
+		Expiries:        expiries,
 	}, nil
 }
 
+// uploadKey is where a job's uncompressed file lives in the uploads bucket.
+func uploadKey(job *models.Job) string {
+	return fmt.Sprintf("users/%d/jobs/%d/input.%s", job.UserId, job.Id, job.InputContainer)
+}
+
+// downloadKey is where a job's compressed file lives in the downloads bucket.
+func downloadKey(job *models.Job) string {
+	return fmt.Sprintf("users/%d/jobs/%d/output.%s", job.UserId, job.Id, job.Output.Container)
+}
+
 // GenerateUploadURLForUploads generates a pre-signed URL for the client to upload an uncompressed file.
 func (s *Storage) GenerateUploadURLForUploads(
 	ctx context.Context,
-	id int64,
-	fileType string,
-	expires time.Time,
+	job *models.Job,
 	maxFileSize int64,
 ) (string, map[string]string, error) {
 	policy := minio.NewPostPolicy()
@@ -59,7 +94,7 @@ func (s *Storage) GenerateUploadURLForUploads(
 	if err != nil {
 		return "", nil, err
 	}
-	err = policy.SetKey(fmt.Sprintf("%d.%s", id, fileType))
+	err = policy.SetKey(uploadKey(job))
 	if err != nil {
 		return "", nil, err
 	}
@@ -67,7 +102,7 @@ func (s *Storage) GenerateUploadURLForUploads(
 	if err != nil {
 		return "", nil, err
 	}
-	err = policy.SetExpires(expires)
+	err = policy.SetExpires(time.Now().Add(s.Expiries.ClientUpload))
 	if err != nil {
 		return "", nil, err
 	}
@@ -79,50 +114,109 @@ func (s *Storage) GenerateUploadURLForUploads(
 	return url.String(), formData, nil
 }
 
-// GenerateUploadURLForDownloads generates a pre-signed URL for the VM to upload a compressed file.
+// GenerateUploadURLForDownloads generates a pre-signed URL for the VM to upload a compressed file with a single PUT.
 func (s *Storage) GenerateUploadURLForDownloads(
 	ctx context.Context,
-	id int64,
-	expires time.Time,
+	job *models.Job,
 ) (string, error) {
-	return "", fmt.Errorf("not implemented")
+	url, err := s.Client.PresignedPutObject(
+		ctx,
+		s.DownloadsBucket,
+		downloadKey(job),
+		s.Expiries.Worker,
+	)
+	if err != nil {
+		return "", err
+	}
+	return url.String(), nil
 }
 
 // GenerateDownloadURLForUploads generates a pre-signed URL for the VM to download an uncompressed file.
 func (s *Storage) GenerateDownloadURLForUploads(
 	ctx context.Context,
-	id int64,
-	expires time.Time,
+	job *models.Job,
 ) (string, error) {
-	return "", fmt.Errorf("not implemented")
+	url, err := s.Client.PresignedGetObject(
+		ctx,
+		s.UploadsBucket,
+		uploadKey(job),
+		s.Expiries.Worker,
+		nil,
+	)
+	if err != nil {
+		return "", err
+	}
+	return url.String(), nil
 }
 
-// GenerateDownloadURLForDownloads generates a pre-signed URL for the client to download a compressed file.
+// GenerateDownloadURLForDownloads generates a pre-signed URL for the client to download a compressed file. The file
+// is served under the name it was uploaded with, with the extension swapped for the output container.
 func (s *Storage) GenerateDownloadURLForDownloads(
 	ctx context.Context,
-	id int64,
-	expires time.Time,
-) (string, error) {
-	return "", fmt.Errorf("not implemented")
+	job *models.Job,
+) (string, time.Time, error) {
+	fileName := strings.TrimSuffix(job.FileName, path.Ext(job.FileName)) + "." + job.Output.Container
+	reqParams := url.Values{}
+	reqParams.Set("response-content-disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": fileName,
+	}))
+
+	expires := time.Now().Add(s.Expiries.ClientDownload)
+	presigned, err := s.Client.PresignedGetObject(
+		ctx,
+		s.DownloadsBucket,
+		downloadKey(job),
+		s.Expiries.ClientDownload,
+		reqParams,
+	)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return presigned.String(), expires, nil
 }
 
 func (s *Storage) FileInUploads(
 	ctx context.Context,
-	id int64,
-	extension string,
+	job *models.Job,
 ) (bool, error) {
-	_, err := s.Client.GetObject(ctx, s.UploadsBucket, fmt.Sprintf("%d.%v", id, extension), minio.GetObjectOptions{})
-	if err != nil && minio.ToErrorResponse(err).Code == "NoSuchKey" {
-		return false, nil
-	} else if err != nil {
-		return false, err
-	}
-	return true, nil
+	return s.fileExists(ctx, s.UploadsBucket, uploadKey(job))
 }
 
 func (s *Storage) FileInDownloads(
 	ctx context.Context,
-	id int64,
+	job *models.Job,
+) (bool, error) {
+	return s.fileExists(ctx, s.DownloadsBucket, downloadKey(job))
+}
+
+// FileSizeInDownloads returns the size of a job's compressed file in bytes, or -1 if it isn't there.
+func (s *Storage) FileSizeInDownloads(
+	ctx context.Context,
+	job *models.Job,
+) (int64, error) {
+	return s.fileSize(ctx, s.DownloadsBucket, downloadKey(job))
+}
+
+func (s *Storage) fileExists(
+	ctx context.Context,
+	bucket string,
+	key string,
 ) (bool, error) {
-	return false, fmt.Errorf("not implemented")
+	size, err := s.fileSize(ctx, bucket, key)
+	return size >= 0, err
+}
+
+func (s *Storage) fileSize(
+	ctx context.Context,
+	bucket string,
+	key string,
+) (int64, error) {
+	// GetObject is lazy and never fails for a missing key, StatObject actually asks
+	info, err := s.Client.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+	if err != nil && minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return -1, nil
+	} else if err != nil {
+		return -1, err
+	}
+	return info.Size, nil
 }
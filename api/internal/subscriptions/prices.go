@@ -0,0 +1,110 @@
+package subscriptions
+
+import (
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/price"
+	"sync"
+	"time"
+)
+
+// DefaultPriceCacheTTL is how long prices fetched from Stripe are used for before being fetched again.
+const DefaultPriceCacheTTL = 10 * time.Minute
+
+// Price is a recurring Stripe price a plan can be subscribed at.
+type Price struct {
+	Id       string `json:"id"`
+	Amount   int64  `json:"amount"` // In the currency's smallest unit
+	Currency string `json:"currency"`
+}
+
+// PlanPrices are the current prices of a plan's product, either may be missing.
+type PlanPrices struct {
+	Monthly *Price `json:"monthly"`
+	Yearly  *Price `json:"yearly"`
+}
+
+// PriceCatalog looks up the active prices of plan products in Stripe, caching them so the plans endpoint doesn't
+// call Stripe on every request.
+type PriceCatalog struct {
+	TTL time.Duration
+
+	mu        sync.Mutex
+	prices    map[string]*PlanPrices // By product id
+	fetchedAt map[string]time.Time
+}
+
+func NewPriceCatalog(ttl time.Duration) *PriceCatalog {
+	return &PriceCatalog{
+		TTL:       ttl,
+		prices:    make(map[string]*PlanPrices),
+		fetchedAt: make(map[string]time.Time),
+	}
+}
+
+// ForProduct returns the monthly and yearly prices of a product. The lock isn't held while calling Stripe, so a slow
+// fetch doesn't hold up lookups of other products.
+func (c *PriceCatalog) ForProduct(productId string) (*PlanPrices, error) {
+	c.mu.Lock()
+	prices, ok := c.prices[productId]
+	fresh := ok && time.Since(c.fetchedAt[productId]) < c.TTL
+	c.mu.Unlock()
+	if fresh {
+		return prices, nil
+	}
+
+	prices, err := fetchPrices(productId)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.prices[productId] = prices
+	c.fetchedAt[productId] = time.Now()
+	c.mu.Unlock()
+	return prices, nil
+}
+
+// fetchPrices lists a product's active monthly and yearly prices from Stripe.
+func fetchPrices(productId string) (*PlanPrices, error) {
+	prices := &PlanPrices{}
+	iter := price.List(&stripe.PriceListParams{
+		Product: stripe.String(productId),
+		Active:  stripe.Bool(true),
+		Type:    stripe.String(string(stripe.PriceTypeRecurring)),
+	})
+	for iter.Next() {
+		p := iter.Price()
+		if p.Recurring == nil || p.Recurring.IntervalCount != 1 {
+			continue
+		}
+
+		found := &Price{
+			Id:       p.ID,
+			Amount:   p.UnitAmount,
+			Currency: string(p.Currency),
+		}
+		switch p.Recurring.Interval {
+		case stripe.PriceRecurringIntervalMonth:
+			prices.Monthly = found
+		case stripe.PriceRecurringIntervalYear:
+			prices.Yearly = found
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return prices, nil
+}
+
+// Includes reports whether priceId is one of the product's current prices.
+func (c *PriceCatalog) Includes(
+	productId string,
+	priceId string,
+) (bool, error) {
+	prices, err := c.ForProduct(productId)
+	if err != nil {
+		return false, err
+	}
+	return (prices.Monthly != nil && prices.Monthly.Id == priceId) ||
+		(prices.Yearly != nil && prices.Yearly.Id == priceId), nil
+}
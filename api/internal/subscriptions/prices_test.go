@@ -0,0 +1,62 @@
+package subscriptions
+
+import "testing"
+
+const testPrices = `{
+	"object": "list",
+	"url": "/v1/prices",
+	"has_more": false,
+	"data": [
+		{"id": "price_month", "object": "price", "unit_amount": 500, "currency": "usd",
+			"recurring": {"interval": "month", "interval_count": 1}},
+		{"id": "price_quarter", "object": "price", "unit_amount": 1400, "currency": "usd",
+			"recurring": {"interval": "month", "interval_count": 3}},
+		{"id": "price_year", "object": "price", "unit_amount": 5000, "currency": "usd",
+			"recurring": {"interval": "year", "interval_count": 1}}
+	]
+}`
+
+func TestPriceCatalog(t *testing.T) {
+	requests := useStripeServer(t, testPrices)
+	catalog := NewPriceCatalog(DefaultPriceCacheTTL)
+
+	prices, err := catalog.ForProduct("prod_123")
+	if err != nil {
+		t.Fatalf("fetching prices: %v", err)
+	}
+	if prices.Monthly == nil || prices.Monthly.Id != "price_month" || prices.Monthly.Amount != 500 {
+		t.Errorf("expected the monthly price, got %+v", prices.Monthly)
+	}
+	if prices.Yearly == nil || prices.Yearly.Id != "price_year" {
+		t.Errorf("expected the yearly price, got %+v", prices.Yearly)
+	}
+
+	for _, priceId := range []string{"price_month", "price_year", "price_quarter"} {
+		included, err := catalog.Includes("prod_123", priceId)
+		if err != nil {
+			t.Fatalf("checking %s: %v", priceId, err)
+		}
+		if included != (priceId != "price_quarter") {
+			t.Errorf("expected %s included to be %v", priceId, !included)
+		}
+	}
+
+	// Everything after the first lookup comes from the cache
+	if got := requests(); len(got) != 1 || got[0].Params.Get("product") != "prod_123" {
+		t.Errorf("expected a single price listing for prod_123, got %v", got)
+	}
+}
+
+func TestPriceCatalogExpiry(t *testing.T) {
+	requests := useStripeServer(t, testPrices)
+	catalog := NewPriceCatalog(0)
+
+	for range 2 {
+		if _, err := catalog.ForProduct("prod_123"); err != nil {
+			t.Fatalf("fetching prices: %v", err)
+		}
+	}
+	if got := requests(); len(got) != 2 {
+		t.Errorf("expected prices to be fetched again once expired, got %d requests", len(got))
+	}
+}
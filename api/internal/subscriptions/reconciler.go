@@ -0,0 +1,212 @@
+package subscriptions
+
+import (
+	"context"
+	"fmt"
+	"github.com/brysonmco/compressor/internal/db"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/subscription"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	reconcileInterval  = time.Hour
+	reconcileBatchSize = 100
+	// reconcilerLockKey is the advisory lock held by whichever API instance is reconciling
+	reconcilerLockKey = 0x737472697065 // "stripe"
+)
+
+// Reconciler catches the subscriptions table up with Stripe when webhooks have been lost. Every subscription Stripe
+// has for a customer is compared with the local row and synced if they differ, and local subscriptions Stripe doesn't
+// know about are cancelled. Only one API instance does this at a time.
+type Reconciler struct {
+	Database  *db.Database
+	Processor *WebhookProcessor
+}
+
+func NewReconciler(
+	database *db.Database,
+	processor *WebhookProcessor,
+) *Reconciler {
+	return &Reconciler{
+		Database:  database,
+		Processor: processor,
+	}
+}
+
+// Report is what reconciling a user found.
+type Report struct {
+	UserId   int64    `json:"userId"`
+	Checked  int      `json:"checked"`  // Subscriptions compared
+	Repaired []string `json:"repaired"` // What was wrong with each subscription that was synced
+}
+
+// Run reconciles every user with a Stripe customer until ctx is cancelled.
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.reconcileAll(ctx); err != nil {
+			log.Printf("error reconciling subscriptions: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcileAll reconciles every user, logging what was repaired. A user that fails is logged and skipped. Each user
+// is reconciled on its own, only the lock is held throughout.
+func (r *Reconciler) reconcileAll(ctx context.Context) error {
+	unlock, err := r.Database.TryAdvisoryLock(ctx, reconcilerLockKey)
+	if err != nil || unlock == nil {
+		return err
+	}
+	defer unlock()
+
+	var users, checked, repaired, failed int
+	var afterId int64
+	for {
+		batch, err := r.Database.FindUsersWithStripeCustomer(ctx, afterId, reconcileBatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, user := range batch {
+			afterId = user.Id
+			users++
+
+			report, err := r.ReconcileUser(ctx, user)
+			if err != nil {
+				log.Printf("error reconciling subscriptions of user %d: %v", user.Id, err)
+				failed++
+				continue
+			}
+			checked += report.Checked
+			repaired += len(report.Repaired)
+		}
+
+		if len(batch) < reconcileBatchSize {
+			break
+		}
+	}
+
+	log.Printf("reconciled subscriptions of %d users: %d checked, %d repaired, %d users failed",
+		users, checked, repaired, failed)
+	return nil
+}
+
+// ReconcileUser brings one user's subscriptions in line with Stripe.
+func (r *Reconciler) ReconcileUser(
+	ctx context.Context,
+	user *models.User,
+) (*Report, error) {
+	report := &Report{
+		UserId:   user.Id,
+		Repaired: []string{},
+	}
+
+	locals, err := r.Database.FindSubscriptionsByUserId(ctx, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	unseen := make(map[string]*models.Subscription, len(locals))
+	for _, local := range locals {
+		unseen[local.StripeSubscriptionId] = local
+	}
+
+	iter := subscription.List(&stripe.SubscriptionListParams{
+		Customer: stripe.String(user.StripeCustomerId),
+		Status:   stripe.String("all"),
+	})
+	for iter.Next() {
+		sub := iter.Subscription()
+		local := unseen[sub.ID]
+		delete(unseen, sub.ID)
+		report.Checked++
+
+		differences := subscriptionDifferences(local, sub)
+		if len(differences) == 0 {
+			continue
+		}
+
+		if _, err = r.Processor.Sync(ctx, sub); err != nil {
+			return nil, fmt.Errorf("error syncing subscription %s: %v", sub.ID, err)
+		}
+		repair := fmt.Sprintf("%s: %s", sub.ID, strings.Join(differences, ", "))
+		log.Printf("repaired subscription of user %d, %s", user.Id, repair)
+		report.Repaired = append(report.Repaired, repair)
+	}
+	if err = iter.Err(); err != nil {
+		return nil, err
+	}
+
+	// Whatever Stripe didn't list no longer exists there
+	for _, local := range unseen {
+		report.Checked++
+		if local.Status == string(stripe.SubscriptionStatusCanceled) {
+			continue
+		}
+
+		now := time.Now().UTC()
+		local.Status = string(stripe.SubscriptionStatusCanceled)
+		local.LastEventAt = &now
+		err = r.Database.WithTx(ctx, func(tx pgx.Tx) error {
+			if err := r.Database.UpdateSubscriptionTx(ctx, tx, local); err != nil {
+				return err
+			}
+			return r.Processor.Tokens.RollOverUserTx(ctx, tx, user.Id)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		repair := fmt.Sprintf("%s: missing from stripe, cancelled", local.StripeSubscriptionId)
+		log.Printf("repaired subscription of user %d, %s", user.Id, repair)
+		report.Repaired = append(report.Repaired, repair)
+	}
+
+	return report, nil
+}
+
+// subscriptionDifferences describes how the local row differs from Stripe's subscription.
+func subscriptionDifferences(
+	local *models.Subscription,
+	sub *stripe.Subscription,
+) []string {
+	if local == nil {
+		return []string{"missing locally"}
+	}
+	if sub.Items == nil || len(sub.Items.Data) == 0 {
+		return nil
+	}
+	item := sub.Items.Data[0]
+
+	var differences []string
+	if local.Status != string(sub.Status) {
+		differences = append(differences, fmt.Sprintf("status %s, stripe has %s", local.Status, sub.Status))
+	}
+	if local.StripePriceId != item.Price.ID {
+		differences = append(differences, fmt.Sprintf("price %s, stripe has %s", local.StripePriceId, item.Price.ID))
+	}
+	if local.CurrentPeriodStart.Unix() != item.CurrentPeriodStart ||
+		local.CurrentPeriodEnd.Unix() != item.CurrentPeriodEnd {
+		differences = append(differences, fmt.Sprintf("period %s to %s, stripe has %s to %s",
+			local.CurrentPeriodStart.Format(time.RFC3339), local.CurrentPeriodEnd.Format(time.RFC3339),
+			time.Unix(item.CurrentPeriodStart, 0).UTC().Format(time.RFC3339),
+			time.Unix(item.CurrentPeriodEnd, 0).UTC().Format(time.RFC3339)))
+	}
+	if local.CancelAtPeriodEnd != sub.CancelAtPeriodEnd {
+		differences = append(differences, fmt.Sprintf("cancel at period end %v, stripe has %v",
+			local.CancelAtPeriodEnd, sub.CancelAtPeriodEnd))
+	}
+	return differences
+}
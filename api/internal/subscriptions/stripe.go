@@ -1,13 +1,22 @@
 package subscriptions
 
 import (
+	"fmt"
 	"github.com/brysonmco/compressor/internal/models"
 	"github.com/stripe/stripe-go/v82"
 	"github.com/stripe/stripe-go/v82/customer"
 	"github.com/stripe/stripe-go/v82/price"
+	"github.com/stripe/stripe-go/v82/subscription"
 	"strconv"
 )
 
+// UseAPIBase points the Stripe client at another API, such as a local stripe-mock.
+func UseAPIBase(url string) {
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL: stripe.String(url),
+	}))
+}
+
 func CreateStripeCustomer(user *models.User) (*stripe.Customer, error) {
 	params := &stripe.CustomerParams{
 		Email: stripe.String(user.Email),
@@ -27,3 +36,49 @@ func GetProductIdFromPrice(priceId string) (string, error) {
 
 	return p.Product.ID, nil
 }
+
+// CancelSubscription cancels a subscription, either straight away or once the period that has been paid for ends.
+func CancelSubscription(
+	stripeSubscriptionId string,
+	atPeriodEnd bool,
+) (*stripe.Subscription, error) {
+	if atPeriodEnd {
+		return subscription.Update(stripeSubscriptionId, &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: stripe.Bool(true),
+		})
+	}
+	return subscription.Cancel(stripeSubscriptionId, &stripe.SubscriptionCancelParams{
+		Prorate: stripe.Bool(true),
+	})
+}
+
+// ResumeSubscription undoes a cancellation at the end of the period, as long as the period hasn't ended yet.
+func ResumeSubscription(stripeSubscriptionId string) (*stripe.Subscription, error) {
+	return subscription.Update(stripeSubscriptionId, &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(false),
+	})
+}
+
+// ChangeSubscriptionPrice moves a subscription onto another price, prorating the rest of the current period.
+func ChangeSubscriptionPrice(
+	stripeSubscriptionId string,
+	priceId string,
+) (*stripe.Subscription, error) {
+	sub, err := subscription.Get(stripeSubscriptionId, nil)
+	if err != nil {
+		return nil, err
+	}
+	if sub.Items == nil || len(sub.Items.Data) == 0 {
+		return nil, fmt.Errorf("subscription %s has no items", sub.ID)
+	}
+
+	return subscription.Update(stripeSubscriptionId, &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				ID:    stripe.String(sub.Items.Data[0].ID),
+				Price: stripe.String(priceId),
+			},
+		},
+		ProrationBehavior: stripe.String("create_prorations"),
+	})
+}
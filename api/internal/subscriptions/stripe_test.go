@@ -0,0 +1,161 @@
+package subscriptions
+
+import (
+	"github.com/stripe/stripe-go/v82"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+const testSubscription = `{
+	"id": "sub_123",
+	"object": "subscription",
+	"items": {"object": "list", "data": [{"id": "si_123", "object": "subscription_item"}]}
+}`
+
+// stripeRequest is a call the Stripe client made, with its form encoded params.
+type stripeRequest struct {
+	Method string
+	Path   string
+	Params url.Values
+}
+
+// useStripeServer points the Stripe client at a test server answering every call with body, and returns the calls
+// made to it.
+func useStripeServer(
+	t *testing.T,
+	body string,
+) func() []stripeRequest {
+	var mu sync.Mutex
+	var requests []stripeRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Params are sent in the query for some methods and the body for others
+		data, _ := io.ReadAll(r.Body)
+		params, err := url.ParseQuery(r.URL.RawQuery + "&" + string(data))
+		if err != nil {
+			t.Errorf("could not parse params: %v", err)
+		}
+
+		mu.Lock()
+		requests = append(requests, stripeRequest{Method: r.Method, Path: r.URL.Path, Params: params})
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+
+	previous := stripe.GetBackend(stripe.APIBackend)
+	stripe.Key = "sk_test_123"
+	UseAPIBase(server.URL)
+	t.Cleanup(func() {
+		stripe.SetBackend(stripe.APIBackend, previous)
+		server.Close()
+	})
+
+	return func() []stripeRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]stripeRequest(nil), requests...)
+	}
+}
+
+// expectRequests checks the calls made, only comparing the params each expected call lists.
+func expectRequests(
+	t *testing.T,
+	got []stripeRequest,
+	want []stripeRequest,
+) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("expected %d requests, got %d: %v", len(want), len(got), got)
+	}
+	for i := range want {
+		if got[i].Method != want[i].Method || got[i].Path != want[i].Path {
+			t.Errorf("expected request %d to be %s %s, got %s %s", i, want[i].Method, want[i].Path, got[i].Method,
+				got[i].Path)
+		}
+		for key := range want[i].Params {
+			if got[i].Params.Get(key) != want[i].Params.Get(key) {
+				t.Errorf("expected request %d to send %s=%q, got %q", i, key, want[i].Params.Get(key),
+					got[i].Params.Get(key))
+			}
+		}
+	}
+}
+
+func TestCancelSubscription(t *testing.T) {
+	tests := []struct {
+		name        string
+		atPeriodEnd bool
+		request     stripeRequest
+	}{
+		{"at period end", true, stripeRequest{
+			Method: http.MethodPost,
+			Path:   "/v1/subscriptions/sub_123",
+			Params: url.Values{"cancel_at_period_end": {"true"}},
+		}},
+		{"immediately", false, stripeRequest{
+			Method: http.MethodDelete,
+			Path:   "/v1/subscriptions/sub_123",
+			Params: url.Values{"prorate": {"true"}},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := useStripeServer(t, testSubscription)
+
+			if _, err := CancelSubscription("sub_123", test.atPeriodEnd); err != nil {
+				t.Fatalf("cancelling: %v", err)
+			}
+			expectRequests(t, requests(), []stripeRequest{test.request})
+		})
+	}
+}
+
+func TestResumeSubscription(t *testing.T) {
+	requests := useStripeServer(t, testSubscription)
+
+	if _, err := ResumeSubscription("sub_123"); err != nil {
+		t.Fatalf("resuming: %v", err)
+	}
+	expectRequests(t, requests(), []stripeRequest{{
+		Method: http.MethodPost,
+		Path:   "/v1/subscriptions/sub_123",
+		Params: url.Values{"cancel_at_period_end": {"false"}},
+	}})
+}
+
+func TestChangeSubscriptionPrice(t *testing.T) {
+	requests := useStripeServer(t, testSubscription)
+
+	if _, err := ChangeSubscriptionPrice("sub_123", "price_456"); err != nil {
+		t.Fatalf("changing price: %v", err)
+	}
+	expectRequests(t, requests(), []stripeRequest{
+		{Method: http.MethodGet, Path: "/v1/subscriptions/sub_123"},
+		{
+			Method: http.MethodPost,
+			Path:   "/v1/subscriptions/sub_123",
+			Params: url.Values{
+				"items[0][id]":       {"si_123"},
+				"items[0][price]":    {"price_456"},
+				"proration_behavior": {"create_prorations"},
+			},
+		},
+	})
+}
+
+func TestChangeSubscriptionPriceWithoutItems(t *testing.T) {
+	requests := useStripeServer(t, `{"id": "sub_123", "object": "subscription"}`)
+
+	if _, err := ChangeSubscriptionPrice("sub_123", "price_456"); err == nil {
+		t.Fatal("expected an error changing a subscription without items")
+	}
+	// Nothing should be updated
+	expectRequests(t, requests(), []stripeRequest{{Method: http.MethodGet, Path: "/v1/subscriptions/sub_123"}})
+}
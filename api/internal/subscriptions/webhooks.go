@@ -0,0 +1,300 @@
+package subscriptions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/brysonmco/compressor/internal/db"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/brysonmco/compressor/internal/tokens"
+	"github.com/jackc/pgx/v5"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/subscription"
+	"log"
+	"strconv"
+	"time"
+)
+
+// WebhookProcessor keeps the subscriptions table, and the token periods that depend on it, in line with Stripe.
+type WebhookProcessor struct {
+	Database *db.Database
+	Tokens   *tokens.Scheduler
+}
+
+func NewWebhookProcessor(
+	database *db.Database,
+	tokenScheduler *tokens.Scheduler,
+) *WebhookProcessor {
+	return &WebhookProcessor{
+		Database: database,
+		Tokens:   tokenScheduler,
+	}
+}
+
+// Metadata set on token pack checkout sessions.
+const (
+	TokenPackIdMetadataKey     = "token_pack_id"
+	TokenPackTokensMetadataKey = "tokens"
+)
+
+// errStaleEvent is returned when an event is older than the state already synced from Stripe.
+var errStaleEvent = errors.New("stale event")
+
+// PreparedEvent is a webhook event along with anything applying it needs from Stripe.
+type PreparedEvent struct {
+	Event stripe.Event
+	// Subscription is the subscription an invoice was raised for, as of FetchedAt. It is only fetched for invoice
+	// events, and is nil for one-off invoices.
+	Subscription *stripe.Subscription
+	FetchedAt    time.Time
+}
+
+// Prepare fetches whatever an event needs from Stripe. It is called before the transaction the event is applied in
+// is opened, so the transaction isn't held open waiting on Stripe.
+func (p *WebhookProcessor) Prepare(evnt stripe.Event) (*PreparedEvent, error) {
+	prepared := &PreparedEvent{Event: evnt}
+
+	switch evnt.Type {
+	case stripe.EventTypeInvoicePaid,
+		stripe.EventTypeInvoicePaymentFailed:
+		sub, err := p.invoiceSubscription(evnt)
+		if err != nil {
+			return nil, err
+		}
+		prepared.Subscription = sub
+		prepared.FetchedAt = time.Now().UTC()
+	}
+
+	return prepared, nil
+}
+
+// ApplyTx applies a prepared event in tx. Event types we don't act on are ignored, as are events that arrive after
+// something newer for the same subscription.
+func (p *WebhookProcessor) ApplyTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	prepared *PreparedEvent,
+) error {
+	err := p.apply(ctx, tx, prepared)
+	if errors.Is(err, errStaleEvent) {
+		log.Printf("skipping stale stripe event %s of type %s", prepared.Event.ID, prepared.Event.Type)
+		return nil
+	}
+	return err
+}
+
+func (p *WebhookProcessor) apply(
+	ctx context.Context,
+	tx pgx.Tx,
+	prepared *PreparedEvent,
+) error {
+	evnt := prepared.Event
+	switch evnt.Type {
+	case stripe.EventTypeCustomerSubscriptionCreated,
+		stripe.EventTypeCustomerSubscriptionUpdated,
+		stripe.EventTypeCustomerSubscriptionDeleted:
+		var sub stripe.Subscription
+		if err := json.Unmarshal(evnt.Data.Raw, &sub); err != nil {
+			return fmt.Errorf("error unmarshalling subscription: %v", err)
+		}
+		return p.subscriptionChanged(ctx, tx, &sub, time.Unix(evnt.Created, 0).UTC())
+	case stripe.EventTypeInvoicePaid:
+		return p.invoicePaid(ctx, tx, prepared)
+	case stripe.EventTypeInvoicePaymentFailed:
+		return p.invoicePaymentFailed(ctx, tx, prepared)
+	case stripe.EventTypeCheckoutSessionCompleted,
+		stripe.EventTypeCheckoutSessionAsyncPaymentSucceeded:
+		return p.checkoutPaid(ctx, tx, evnt)
+	default:
+		log.Printf("ignoring stripe event %s of type %s", evnt.ID, evnt.Type)
+		return nil
+	}
+}
+
+// subscriptionChanged syncs the subscription and moves the user onto whatever plan it leaves them with. Deleted
+// subscriptions arrive with a canceled status, which drops the user back to the free plan.
+func (p *WebhookProcessor) subscriptionChanged(
+	ctx context.Context,
+	tx pgx.Tx,
+	sub *stripe.Subscription,
+	asOf time.Time,
+) error {
+	local, err := p.syncSubscription(ctx, tx, sub, asOf)
+	if err != nil {
+		return err
+	}
+	return p.Tokens.RollOverUserTx(ctx, tx, local.UserId)
+}
+
+// Sync applies a subscription just returned by Stripe, which is newer than any event still on its way.
+func (p *WebhookProcessor) Sync(
+	ctx context.Context,
+	sub *stripe.Subscription,
+) (*models.Subscription, error) {
+	var local *models.Subscription
+	err := p.Database.WithTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		if local, err = p.syncSubscription(ctx, tx, sub, time.Now().UTC()); err != nil {
+			return err
+		}
+		return p.Tokens.RollOverUserTx(ctx, tx, local.UserId)
+	})
+	return local, err
+}
+
+// invoicePaid grants the tokens for the period the invoice paid for. Stripe is asked for the subscription rather
+// than trusting the invoice, so its period is the one that was just paid for.
+func (p *WebhookProcessor) invoicePaid(
+	ctx context.Context,
+	tx pgx.Tx,
+	prepared *PreparedEvent,
+) error {
+	if prepared.Subscription == nil {
+		return nil
+	}
+
+	local, err := p.syncSubscription(ctx, tx, prepared.Subscription, prepared.FetchedAt)
+	if err != nil {
+		return err
+	}
+	return p.Tokens.RollOverUserTx(ctx, tx, local.UserId)
+}
+
+// invoicePaymentFailed records the subscription going past due, which puts the user on the free plan's limits until
+// a retry succeeds. Tokens already granted for the period are left alone.
+func (p *WebhookProcessor) invoicePaymentFailed(
+	ctx context.Context,
+	tx pgx.Tx,
+	prepared *PreparedEvent,
+) error {
+	sub := prepared.Subscription
+	if sub == nil {
+		return nil
+	}
+
+	local, err := p.syncSubscription(ctx, tx, sub, prepared.FetchedAt)
+	if err != nil {
+		return err
+	}
+	log.Printf("payment failed for subscription %s of user %d, now %s", sub.ID, local.UserId, local.Status)
+	return nil
+}
+
+// checkoutPaid credits the tokens from a paid token pack checkout. Subscription checkouts are left to the
+// subscription events. Payment methods that settle later complete unpaid, and are credited when the payment succeeds.
+func (p *WebhookProcessor) checkoutPaid(
+	ctx context.Context,
+	tx pgx.Tx,
+	evnt stripe.Event,
+) error {
+	var sess stripe.CheckoutSession
+	if err := json.Unmarshal(evnt.Data.Raw, &sess); err != nil {
+		return fmt.Errorf("error unmarshalling checkout session: %v", err)
+	}
+
+	if sess.Mode != stripe.CheckoutSessionModePayment || sess.Metadata[TokenPackIdMetadataKey] == "" {
+		return nil
+	}
+	if sess.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
+		log.Printf("checkout session %s completed with payment %s, waiting for it to succeed", sess.ID,
+			sess.PaymentStatus)
+		return nil
+	}
+
+	tokens, err := strconv.Atoi(sess.Metadata[TokenPackTokensMetadataKey])
+	if err != nil || tokens <= 0 {
+		return fmt.Errorf("checkout session %s has invalid tokens %q", sess.ID, sess.Metadata[TokenPackTokensMetadataKey])
+	}
+
+	user, err := p.Database.FindUserByStripeCustomerID(ctx, sess.Customer.ID)
+	if err != nil {
+		return fmt.Errorf("error finding user for customer %s: %v", sess.Customer.ID, err)
+	}
+
+	return p.Database.PurchaseTokensTx(ctx, tx, user.Id, tokens, sess.ID,
+		fmt.Sprintf("token pack %s", sess.Metadata[TokenPackIdMetadataKey]))
+}
+
+// invoiceSubscription fetches the subscription an invoice was raised for, or nil for one-off invoices. What it
+// returns is Stripe's state as of now, not as of the event.
+func (p *WebhookProcessor) invoiceSubscription(evnt stripe.Event) (*stripe.Subscription, error) {
+	var invoice stripe.Invoice
+	if err := json.Unmarshal(evnt.Data.Raw, &invoice); err != nil {
+		return nil, fmt.Errorf("error unmarshalling invoice: %v", err)
+	}
+
+	if invoice.Parent == nil || invoice.Parent.SubscriptionDetails == nil ||
+		invoice.Parent.SubscriptionDetails.Subscription == nil {
+		return nil, nil
+	}
+
+	sub, err := subscription.Get(invoice.Parent.SubscriptionDetails.Subscription.ID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching subscription: %v", err)
+	}
+	return sub, nil
+}
+
+// syncSubscription writes Stripe's view of a subscription as of asOf to the subscriptions table, creating the row if
+// we haven't seen it before. The plan follows the product of the subscription's price. Returns errStaleEvent if the
+// row has already been synced from something newer.
+func (p *WebhookProcessor) syncSubscription(
+	ctx context.Context,
+	tx pgx.Tx,
+	sub *stripe.Subscription,
+	asOf time.Time,
+) (*models.Subscription, error) {
+	if sub.Items == nil || len(sub.Items.Data) == 0 {
+		return nil, fmt.Errorf("subscription %s has no items", sub.ID)
+	}
+	item := sub.Items.Data[0]
+
+	plan, err := p.Database.FindPlanByStripeProductId(ctx, item.Price.Product.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error finding plan for product %s: %v", item.Price.Product.ID, err)
+	}
+
+	local, err := p.Database.FindSubscriptionByStripeSubscriptionIdForUpdateTx(ctx, tx, sub.ID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		user, err := p.Database.FindUserByStripeCustomerID(ctx, sub.Customer.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error finding user for customer %s: %v", sub.Customer.ID, err)
+		}
+
+		return p.Database.CreateSubscriptionTx(ctx, tx, models.CreateSubscription{
+			UserId:               user.Id,
+			StripeSubscriptionId: sub.ID,
+			StripePriceId:        item.Price.ID,
+			PlanId:               plan.Id,
+			Status:               string(sub.Status),
+			CurrentPeriodStart:   time.Unix(item.CurrentPeriodStart, 0).UTC(),
+			CurrentPeriodEnd:     time.Unix(item.CurrentPeriodEnd, 0).UTC(),
+			CancelAtPeriodEnd:    sub.CancelAtPeriodEnd,
+			LastEventAt:          asOf,
+		})
+	} else if err != nil {
+		return nil, err
+	}
+
+	if local.LastEventAt != nil && local.LastEventAt.After(asOf) {
+		return nil, errStaleEvent
+	}
+
+	if local.PlanId != plan.Id {
+		log.Printf("subscription %s changed from plan %d to %d", sub.ID, local.PlanId, plan.Id)
+	}
+
+	local.StripePriceId = item.Price.ID
+	local.PlanId = plan.Id
+	local.Status = string(sub.Status)
+	local.CurrentPeriodStart = time.Unix(item.CurrentPeriodStart, 0).UTC()
+	local.CurrentPeriodEnd = time.Unix(item.CurrentPeriodEnd, 0).UTC()
+	local.CancelAtPeriodEnd = sub.CancelAtPeriodEnd
+	local.LastEventAt = &asOf
+	if err = p.Database.UpdateSubscriptionTx(ctx, tx, local); err != nil {
+		return nil, err
+	}
+
+	return local, nil
+}
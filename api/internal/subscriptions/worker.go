@@ -0,0 +1,136 @@
+package subscriptions
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/brysonmco/compressor/internal/db"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/stripe/stripe-go/v82"
+	"log"
+	"time"
+)
+
+const (
+	pollInterval = time.Second
+	batchSize    = 50
+	minBackoff   = time.Second
+	maxBackoff   = 10 * time.Minute
+	// maxAttempts is how many times an event is tried before it is left for someone to look at
+	maxAttempts = 15
+)
+
+// EventWorker processes the webhook events stored by the webhook handler, oldest first, so the handler can answer
+// Stripe straight away. Each event is applied in its own transaction, along with everything it changes. Failed events
+// are retried with backoff until they run out of attempts.
+type EventWorker struct {
+	Database  *db.Database
+	Processor *WebhookProcessor
+}
+
+func NewEventWorker(
+	database *db.Database,
+	processor *WebhookProcessor,
+) *EventWorker {
+	return &EventWorker{
+		Database:  database,
+		Processor: processor,
+	}
+}
+
+// Run processes events until ctx is cancelled.
+func (w *EventWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Keep going while there are full batches waiting
+			for {
+				processed, err := w.processBatch(ctx)
+				if err != nil {
+					log.Printf("error processing stripe events: %v", err)
+					break
+				}
+				if processed < batchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// processBatch processes one batch of pending events, returning how many were due.
+func (w *EventWorker) processBatch(ctx context.Context) (int, error) {
+	events, err := w.Database.FindPendingStripeEvents(ctx, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, event := range events {
+		if err = w.processEvent(ctx, event); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(events), nil
+}
+
+// processEvent applies one event, recording the failure against the event if it can't be. Only errors recording that
+// are returned.
+func (w *EventWorker) processEvent(
+	ctx context.Context,
+	event *models.StripeEvent,
+) error {
+	var evnt stripe.Event
+	err := json.Unmarshal(event.Payload, &evnt)
+
+	// Stripe is called before the transaction is opened
+	var prepared *PreparedEvent
+	if err == nil {
+		prepared, err = w.Processor.Prepare(evnt)
+	}
+
+	if err == nil {
+		err = w.Database.WithTx(ctx, func(tx pgx.Tx) error {
+			// Another worker may have got to it first
+			claimed, err := w.Database.ClaimStripeEventTx(ctx, tx, event.Id)
+			if err != nil || !claimed {
+				return err
+			}
+
+			if err = w.Processor.ApplyTx(ctx, tx, prepared); err != nil {
+				return err
+			}
+			return w.Database.MarkStripeEventProcessedTx(ctx, tx, event.Id)
+		})
+	}
+	if err == nil {
+		return nil
+	}
+
+	var nextAttemptAt *time.Time
+	if event.Attempts+1 < maxAttempts {
+		log.Printf("error processing stripe event %s (attempt %d): %v", event.Id, event.Attempts+1, err)
+		next := time.Now().Add(backoff(event.Attempts))
+		nextAttemptAt = &next
+	} else {
+		log.Printf("giving up on stripe event %s after %d attempts: %v", event.Id, maxAttempts, err)
+	}
+
+	return w.Database.WithTx(ctx, func(tx pgx.Tx) error {
+		return w.Database.MarkStripeEventFailedTx(ctx, tx, event.Id, err.Error(), nextAttemptAt)
+	})
+}
+
+// backoff doubles the delay with every failed attempt, up to maxBackoff.
+func backoff(attempts int) time.Duration {
+	delay := minBackoff
+	for i := 0; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
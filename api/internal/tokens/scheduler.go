@@ -0,0 +1,244 @@
+package tokens
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/brysonmco/compressor/internal/db"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/brysonmco/compressor/internal/plans"
+	"github.com/jackc/pgx/v5"
+	"log"
+	"time"
+)
+
+const (
+	pollInterval = time.Minute
+	batchSize    = 100
+	// schedulerLockKey is the advisory lock held by whichever API instance is rolling periods over
+	schedulerLockKey = 0x746f6b656e73 // "tokens"
+)
+
+// Scheduler rolls users over into a new token period when their current one ends, on their subscription's billing
+// period or the calendar month for free users. Unused tokens granted for the old period expire, tokens from anywhere
+// else are kept. Changing plan part way through a period tops it up rather than starting a new one. Only one API
+// instance does this at a time.
+type Scheduler struct {
+	Database *db.Database
+}
+
+func NewScheduler(database *db.Database) *Scheduler {
+	return &Scheduler{
+		Database: database,
+	}
+}
+
+// Run rolls periods over until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.rollOverAll(ctx); err != nil {
+			log.Printf("error rolling over token periods: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rollOverAll rolls over every user who is due, each in their own transaction so one that fails doesn't hold up
+// everyone else. It does nothing if another instance is already doing it.
+func (s *Scheduler) rollOverAll(ctx context.Context) error {
+	unlock, err := s.Database.TryAdvisoryLock(ctx, schedulerLockKey)
+	if err != nil || unlock == nil {
+		return err
+	}
+	defer unlock()
+
+	var afterId int64
+	for {
+		userIds, err := s.Database.FindUsersDueTokenPeriod(ctx, afterId, batchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, userId := range userIds {
+			afterId = userId
+			if err = s.RollOverUser(ctx, userId); err != nil {
+				log.Printf("error rolling over user %d: %v", userId, err)
+			}
+		}
+
+		if len(userIds) < batchSize {
+			return nil
+		}
+	}
+}
+
+// RollOverUser moves one user into the period they should be in now, without waiting for the next batch. It does
+// nothing if they're already in it.
+func (s *Scheduler) RollOverUser(
+	ctx context.Context,
+	userId int64,
+) error {
+	return s.Database.WithTx(ctx, func(tx pgx.Tx) error {
+		return s.rollOver(ctx, tx, userId)
+	})
+}
+
+// RollOverUserTx is RollOverUser as part of a larger transaction, which sees any subscription changes already made
+// in it.
+func (s *Scheduler) RollOverUserTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+) error {
+	return s.rollOver(ctx, tx, userId)
+}
+
+// rollOver closes the user's open period, if they have one, and opens the next.
+func (s *Scheduler) rollOver(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+) error {
+	if err := s.Database.LockUserTx(ctx, tx, userId); err != nil {
+		return err
+	}
+
+	plan, periodStart, periodEnd, err := s.nextPeriod(ctx, tx, userId)
+	if err != nil {
+		return err
+	}
+
+	period, err := s.Database.FindOpenTokenPeriodByUserIdTx(ctx, tx, userId)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	if period != nil {
+		// A new period only starts once it has been paid for, changing plan within one just tops it up
+		if !periodEnd.After(period.PeriodEnd) {
+			if period.PlanId == plan.Id {
+				return nil
+			}
+			return s.changePlan(ctx, tx, userId, period, plan)
+		}
+
+		// Grants are spent before purchased tokens, so whatever the period's jobs didn't use of it is unused
+		balance, err := s.Database.FindTokenBalanceByUserIdTx(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+		spent, err := s.Database.FindTokensSpentSinceTx(ctx, tx, userId, period.PeriodStart)
+		if err != nil {
+			return err
+		}
+		if unused := min(balance.Available, period.Granted-spent); unused > 0 {
+			err = s.Database.ExpireTokensTx(ctx, tx, userId, unused, fmt.Sprintf(
+				"unused allocation for %s to %s", period.PeriodStart.Format(time.DateOnly),
+				period.PeriodEnd.Format(time.DateOnly)))
+			if err != nil {
+				return err
+			}
+		}
+
+		if err = s.Database.CloseTokenPeriodTx(ctx, tx, period.Id); err != nil {
+			return err
+		}
+	}
+
+	// Unlimited plans don't draw on the ledger
+	granted := max(plan.Tokens, 0)
+	if granted > 0 {
+		err = s.Database.GrantTokensTx(ctx, tx, userId, granted, fmt.Sprintf("%s allocation for %s to %s",
+			plan.Name, periodStart.Format(time.DateOnly), periodEnd.Format(time.DateOnly)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.Database.CreateTokenPeriodTx(ctx, tx, &models.TokenPeriod{
+		UserId:      userId,
+		PlanId:      plan.Id,
+		Granted:     granted,
+		Allocation:  granted,
+		PeriodStart: periodStart,
+		PeriodEnd:   periodEnd,
+	})
+}
+
+// changePlan moves the user's open period onto another plan. An upgrade grants the difference between the new
+// allocation and the largest one the period has had, prorated to what is left of the period, the same way Stripe
+// bills it. Downgrades grant nothing and take nothing back.
+func (s *Scheduler) changePlan(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+	period *models.TokenPeriod,
+	plan *models.Plan,
+) error {
+	if plan.Tokens > period.Allocation {
+		granted := prorate(plan.Tokens-period.Allocation, time.Now(), period.PeriodStart, period.PeriodEnd)
+		if granted > 0 {
+			err := s.Database.GrantTokensTx(ctx, tx, userId, granted, fmt.Sprintf("%s upgrade for %s to %s",
+				plan.Name, period.PeriodStart.Format(time.DateOnly), period.PeriodEnd.Format(time.DateOnly)))
+			if err != nil {
+				return err
+			}
+		}
+
+		period.Granted += granted
+		period.Allocation = plan.Tokens
+	}
+
+	period.PlanId = plan.Id
+	return s.Database.UpdateTokenPeriodPlanTx(ctx, tx, period)
+}
+
+// prorate returns the share of tokens for what is left of the period at now, rounded down.
+func prorate(
+	tokens int,
+	now time.Time,
+	periodStart time.Time,
+	periodEnd time.Time,
+) int {
+	length := periodEnd.Sub(periodStart)
+	remaining := periodEnd.Sub(now)
+	if length <= 0 || remaining <= 0 {
+		return 0
+	}
+	return int(float64(tokens) * float64(min(remaining, length)) / float64(length))
+}
+
+// nextPeriod works out the plan and bounds of the period the user should be in now.
+func (s *Scheduler) nextPeriod(
+	ctx context.Context,
+	tx pgx.Tx,
+	userId int64,
+) (*models.Plan, time.Time, time.Time, error) {
+	subscription, err := s.Database.FindActiveSubscriptionByUserIdTx(ctx, tx, userId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		plan, err := s.Database.FindPlanByName(ctx, plans.FreePlanName)
+		if err != nil {
+			return nil, time.Time{}, time.Time{}, err
+		}
+
+		now := time.Now().UTC()
+		monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return plan, monthStart, monthStart.AddDate(0, 1, 0), nil
+	} else if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+
+	plan, err := s.Database.FindPlanById(ctx, subscription.PlanId)
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	return plan, subscription.CurrentPeriodStart, subscription.CurrentPeriodEnd, nil
+}
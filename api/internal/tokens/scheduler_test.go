@@ -0,0 +1,32 @@
+package tokens
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProrate(t *testing.T) {
+	start := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 30)
+
+	tests := []struct {
+		name   string
+		now    time.Time
+		tokens int
+	}{
+		{"at the start", start, 1000},
+		{"before the start", start.AddDate(0, 0, -5), 1000},
+		{"halfway", start.AddDate(0, 0, 15), 500},
+		{"rounds down", start.AddDate(0, 0, 20), 333},
+		{"at the end", end, 0},
+		{"after the end", end.Add(time.Hour), 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if tokens := prorate(1000, test.now, start, end); tokens != test.tokens {
+				t.Errorf("expected %d tokens, got %d", test.tokens, tokens)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/brysonmco/compressor/internal/db"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/jackc/pgx/v5"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	pollInterval = time.Second
+	batchSize    = 20
+	// maxAttempts is how many times a delivery is tried before it is marked failed, retrying for about 15 hours
+	maxAttempts    = 12
+	minBackoff     = 30 * time.Second
+	maxBackoff     = 6 * time.Hour
+	requestTimeout = 10 * time.Second
+	// lease is how long a claimed delivery is left alone by other dispatchers while it is sent
+	lease = time.Minute
+	// maxLoggedBody is how much of an endpoint's response is kept in the delivery log
+	maxLoggedBody = 1024
+)
+
+// Dispatcher sends queued deliveries to their endpoints. Any 2xx response counts as delivered, everything else is
+// retried with exponential backoff until the delivery runs out of attempts.
+type Dispatcher struct {
+	Database *db.Database
+	Client   *http.Client
+}
+
+func NewDispatcher(database *db.Database) *Dispatcher {
+	return &Dispatcher{
+		Database: database,
+		Client:   newClient(),
+	}
+}
+
+// Run dispatches deliveries until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Keep going while there are full batches waiting
+			for {
+				sent, err := d.dispatchBatch(ctx)
+				if err != nil {
+					log.Printf("error dispatching webhook deliveries: %v", err)
+					break
+				}
+				if sent < batchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// dispatchBatch sends one batch of due deliveries at once, returning how many were due. No transaction is held open
+// while endpoints are called, each result is recorded on its own once they have all answered.
+func (d *Dispatcher) dispatchBatch(ctx context.Context) (int, error) {
+	deliveries, err := d.Database.ClaimDueWebhookDeliveries(ctx, batchSize, lease)
+	if err != nil {
+		return 0, err
+	}
+
+	// One slow endpoint shouldn't hold up everyone else's
+	attempts := make([]models.CreateWebhookDeliveryAttempt, len(deliveries))
+	var wg sync.WaitGroup
+	for i, delivery := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attempts[i] = d.send(ctx, delivery)
+		}()
+	}
+	wg.Wait()
+
+	for i, delivery := range deliveries {
+		if err = d.record(ctx, delivery, attempts[i]); err != nil {
+			log.Printf("error recording webhook delivery %d: %v", delivery.Id, err)
+		}
+	}
+
+	return len(deliveries), nil
+}
+
+// record logs an attempt at a delivery and marks it delivered, or failed until its next attempt.
+func (d *Dispatcher) record(
+	ctx context.Context,
+	delivery *models.DueWebhookDelivery,
+	attempt models.CreateWebhookDeliveryAttempt,
+) error {
+	return d.Database.WithTx(ctx, func(tx pgx.Tx) error {
+		if err := d.Database.CreateWebhookDeliveryAttemptTx(ctx, tx, attempt); err != nil {
+			return err
+		}
+
+		if attempt.Error == "" {
+			return d.Database.MarkWebhookDeliveryDeliveredTx(ctx, tx, delivery.Id)
+		}
+
+		var nextAttemptAt *time.Time
+		if delivery.Attempts+1 < maxAttempts {
+			next := time.Now().Add(backoff(delivery.Attempts))
+			nextAttemptAt = &next
+		} else {
+			log.Printf("giving up on webhook delivery %d after %d attempts: %s", delivery.Id, maxAttempts,
+				attempt.Error)
+		}
+		return d.Database.MarkWebhookDeliveryAttemptFailedTx(ctx, tx, delivery.Id, nextAttemptAt)
+	})
+}
+
+// send POSTs a delivery to its endpoint, the attempt's Error is set unless the endpoint accepted it.
+func (d *Dispatcher) send(
+	ctx context.Context,
+	delivery *models.DueWebhookDelivery,
+) (attempt models.CreateWebhookDeliveryAttempt) {
+	attempt.DeliveryId = delivery.Id
+	started := time.Now()
+	defer func() {
+		attempt.DurationMs = int(time.Since(started).Milliseconds())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		attempt.Error = fmt.Sprintf("could not create request: %v", err)
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Compressor-Webhooks/1.0")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(EventIdHeader, delivery.EventId)
+	req.Header.Set(SignatureHeader, Sign(delivery.Secret, started, delivery.Payload))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		attempt.Error = fmt.Sprintf("request failed: %v", err)
+		return attempt
+	}
+	defer resp.Body.Close()
+
+	attempt.ResponseStatus = &resp.StatusCode
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxLoggedBody))
+	// Postgres text can't hold invalid UTF-8 or NUL bytes
+	attempt.ResponseBody = string(bytes.ReplaceAll(bytes.ToValidUTF8(body, nil), []byte{0}, nil))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("endpoint responded with status code %d", resp.StatusCode)
+	}
+	return attempt
+}
+
+// backoff doubles the delay with every failed attempt, up to maxBackoff.
+func backoff(attempts int) time.Duration {
+	delay := minBackoff
+	for i := 0; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
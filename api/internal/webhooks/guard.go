@@ -0,0 +1,92 @@
+package webhooks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrBlockedAddress is returned when an endpoint resolves to an address inside our network.
+var ErrBlockedAddress = errors.New("address is not publicly routable")
+
+// ValidateURL checks a URL a user wants deliveries sent to. It has to be HTTPS, unless allowHTTP is set, and name a
+// host rather than an IP or localhost. Hostnames can still resolve anywhere, the dispatcher checks the address it
+// actually connects to.
+func ValidateURL(
+	rawUrl string,
+	allowHTTP bool,
+) (*url.URL, error) {
+	endpointUrl, err := url.Parse(rawUrl)
+	if err != nil || endpointUrl.Host == "" {
+		return nil, errors.New("url must be absolute")
+	}
+	if endpointUrl.Scheme != "https" && !(allowHTTP && endpointUrl.Scheme == "http") {
+		return nil, errors.New("url must use HTTPS")
+	}
+	if endpointUrl.User != nil {
+		return nil, errors.New("url must not contain credentials")
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(endpointUrl.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return nil, errors.New("url must not point at localhost")
+	}
+	if _, err = netip.ParseAddr(host); err == nil {
+		return nil, errors.New("url must use a hostname, not an IP address")
+	}
+
+	return endpointUrl, nil
+}
+
+// checkAddress rejects connections to anything that isn't a public unicast address. It runs after DNS resolution,
+// for every address dialed, so a hostname that resolves (or is rebound) to an internal address is caught too.
+func checkAddress(
+	network string,
+	address string,
+	_ syscall.RawConn,
+) error {
+	hostPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, address)
+	}
+
+	addr := hostPort.Addr().Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() ||
+		addr.IsUnspecified() || sharedAddressSpace.Contains(addr) {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, addr)
+	}
+	return nil
+}
+
+// sharedAddressSpace is carrier-grade NAT space, which IsPrivate doesn't cover but is just as internal.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// newClient creates the HTTP client deliveries are sent with. It never goes through a proxy, which would connect to
+// the endpoint on our behalf without checkAddress seeing where.
+func newClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: requestTimeout,
+		Control: checkAddress,
+	}
+
+	return &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: requestTimeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		// A redirect is a misconfigured endpoint, the body would be resent somewhere the user didn't register
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,117 @@
+// Package webhooks sends job events to the endpoints users have registered. Events are queued in the same transaction
+// as the change that caused them and sent by the Dispatcher, which retries with backoff until the endpoint accepts.
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/brysonmco/compressor/internal/db"
+	"github.com/brysonmco/compressor/internal/models"
+	"github.com/jackc/pgx/v5"
+	"strconv"
+	"time"
+)
+
+// Events endpoints can subscribe to
+const (
+	EventJobCompleted = "job.completed"
+	EventJobFailed    = "job.failed"
+	EventJobCancelled = "job.cancelled"
+)
+
+var Events = []string{EventJobCompleted, EventJobFailed, EventJobCancelled}
+
+// jobEvents is the event sent when a job reaches each status.
+var jobEvents = map[models.JobStatus]string{
+	models.JobStatusCompleted: EventJobCompleted,
+	models.JobStatusFailed:    EventJobFailed,
+	models.JobStatusCancelled: EventJobCancelled,
+}
+
+// Headers sent with every delivery
+const (
+	SignatureHeader = "Compressor-Signature"
+	EventHeader     = "Compressor-Event"
+	EventIdHeader   = "Compressor-Event-Id"
+)
+
+// Payload is the body POSTed to endpoints.
+type Payload struct {
+	Id        string      `json:"id"` // The same for every endpoint and redelivery, for receivers to deduplicate on
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// QueueJobEventTx queues the event for the job moving to status, if there is one, for every endpoint of the job's
+// owner that is subscribed to it.
+func QueueJobEventTx(
+	ctx context.Context,
+	database *db.Database,
+	tx pgx.Tx,
+	job *models.Job,
+	status models.JobStatus,
+) error {
+	event, ok := jobEvents[status]
+	if !ok {
+		return nil
+	}
+
+	eventId, err := newEventId()
+	if err != nil {
+		return err
+	}
+
+	data := *job
+	data.Status = status
+	payload, err := json.Marshal(Payload{
+		Id:        eventId,
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Data:      map[string]interface{}{"job": data},
+	})
+	if err != nil {
+		return err
+	}
+
+	return database.CreateWebhookDeliveriesTx(ctx, tx, job.UserId, eventId, event, job.Id, payload)
+}
+
+// Sign returns the signature header for a body sent at timestamp. The HMAC-SHA256 covers the timestamp as well as the
+// body, so receivers can reject old requests being replayed.
+func Sign(
+	secret string,
+	timestamp time.Time,
+	body []byte,
+) string {
+	unix := strconv.FormatInt(timestamp.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unix))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return fmt.Sprintf("t=%s,v1=%s", unix, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// GenerateSecret creates a signing secret for endpoints registered without one.
+func GenerateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+func newEventId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "evt_" + hex.EncodeToString(b), nil
+}
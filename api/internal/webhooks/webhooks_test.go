@@ -0,0 +1,37 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	secret := "whsec_test"
+	body := []byte(`{"event":"job.completed"}`)
+	timestamp := time.Unix(1718000000, 0)
+
+	signature := Sign(secret, timestamp, body)
+
+	timestampPart, macPart, found := strings.Cut(signature, ",")
+	if !found || timestampPart != "t=1718000000" || !strings.HasPrefix(macPart, "v1=") {
+		t.Fatalf("unexpected signature format %q", signature)
+	}
+
+	// What a receiver would do to verify it
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("1718000000." + string(body)))
+	if expected := hex.EncodeToString(mac.Sum(nil)); strings.TrimPrefix(macPart, "v1=") != expected {
+		t.Errorf("expected v1=%s, got %s", expected, macPart)
+	}
+
+	if Sign(secret, timestamp.Add(time.Second), body) == signature {
+		t.Error("signature does not depend on the timestamp")
+	}
+	if Sign("whsec_other", timestamp, body) == signature {
+		t.Error("signature does not depend on the secret")
+	}
+}
@@ -0,0 +1,6 @@
+ALTER TABLE jobs
+    ADD COLUMN progress_percent     real      NOT NULL DEFAULT 0, -- 0 to 100
+    ADD COLUMN progress_eta_seconds real      NOT NULL DEFAULT 0,
+    ADD COLUMN progress_fps         real      NOT NULL DEFAULT 0,
+    ADD COLUMN progress_bitrate     real      NOT NULL DEFAULT 0, -- Current output bitrate in kbit/s
+    ADD COLUMN progress_updated_at  timestamp;
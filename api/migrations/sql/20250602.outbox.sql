@@ -0,0 +1,16 @@
+CREATE TABLE outbox
+(
+    id              serial PRIMARY KEY,
+    queue           text      NOT NULL,
+    event           text      NOT NULL,
+    job_id          integer   NOT NULL REFERENCES jobs (id),
+    payload         jsonb     NOT NULL,
+    attempts        integer   NOT NULL DEFAULT 0,
+    last_error      text,
+    next_attempt_at timestamp NOT NULL DEFAULT now(),
+    sent_at         timestamp,
+    created_at      timestamp DEFAULT now()
+);
+
+-- The relay only ever looks at unsent messages
+CREATE INDEX outbox_pending_idx ON outbox (next_attempt_at) WHERE sent_at IS NULL;
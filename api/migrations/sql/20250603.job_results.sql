@@ -0,0 +1,4 @@
+ALTER TABLE jobs
+    ADD COLUMN input_duration       real,                       -- Seconds, from probing the upload
+    ADD COLUMN failure_reason       text,
+    ADD COLUMN last_result_sequence bigint NOT NULL DEFAULT 0;  -- Newest result from compression-service applied
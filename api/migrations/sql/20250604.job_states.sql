@@ -0,0 +1,23 @@
+-- Map the old free-form statuses onto the state machine
+UPDATE jobs SET status = 'queued' WHERE status = 'pending' AND file_uploaded;
+UPDATE jobs SET status = 'awaiting_upload' WHERE status = 'pending';
+UPDATE jobs SET status = 'compressing' WHERE status = 'processing';
+
+ALTER TABLE jobs
+    ALTER COLUMN status SET DEFAULT 'awaiting_upload',
+    ALTER COLUMN status SET NOT NULL,
+    ADD CONSTRAINT jobs_status_check CHECK (status IN ('awaiting_upload', 'queued', 'downloading', 'probing',
+                                                      'compressing', 'uploading', 'completed', 'failed',
+                                                      'cancelled', 'expired'));
+
+CREATE TABLE job_events
+(
+    id          serial PRIMARY KEY,
+    job_id      integer NOT NULL REFERENCES jobs (id),
+    from_status text    NOT NULL,
+    to_status   text    NOT NULL,
+    reason      text    NOT NULL,
+    created_at  timestamp DEFAULT now()
+);
+
+CREATE INDEX job_events_job_id_idx ON job_events (job_id, created_at);
@@ -0,0 +1,7 @@
+-- output_codec and output_container now hold what the user asked for
+ALTER TABLE jobs
+    ADD COLUMN output_crf           integer,
+    ADD COLUMN output_preset        text,
+    ADD COLUMN output_max_width     integer,
+    ADD COLUMN output_max_height    integer,
+    ADD COLUMN output_audio_bitrate integer; -- kbit/s
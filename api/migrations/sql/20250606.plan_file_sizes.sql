@@ -0,0 +1,5 @@
+-- max_file_size was seeded in megabytes, the column is documented (and enforced) in bytes
+UPDATE plans SET max_file_size = 100::bigint * 1024 * 1024 WHERE name = 'Free';
+UPDATE plans SET max_file_size = 1000::bigint * 1024 * 1024 WHERE name = 'Basic';
+UPDATE plans SET max_file_size = 10000::bigint * 1024 * 1024 WHERE name = 'Pro';
+UPDATE plans SET max_file_size = 100000::bigint * 1024 * 1024 WHERE name = 'Ultimate';
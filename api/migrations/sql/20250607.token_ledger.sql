@@ -0,0 +1,24 @@
+-- Every movement of tokens is a transaction made up of entries that sum to zero. A user's balance is the sum of their
+-- entries in the available account, tokens held for running jobs sit in the reserved account.
+CREATE TABLE token_transactions
+(
+    id          serial PRIMARY KEY,
+    user_id     integer NOT NULL REFERENCES users (id),
+    job_id      integer REFERENCES jobs (id),
+    kind        text    NOT NULL CHECK (kind IN ('grant', 'reservation', 'debit', 'refund', 'expiration')),
+    description text    NOT NULL DEFAULT '',
+    created_at  timestamp DEFAULT now()
+);
+
+CREATE TABLE token_entries
+(
+    id             serial PRIMARY KEY,
+    transaction_id integer NOT NULL REFERENCES token_transactions (id),
+    user_id        integer NOT NULL REFERENCES users (id),
+    account        text    NOT NULL CHECK (account IN ('available', 'reserved', 'granted', 'spent', 'expired')),
+    amount         integer NOT NULL, -- Positive credits the account, negative debits it
+    created_at     timestamp DEFAULT now()
+);
+
+CREATE INDEX token_entries_user_account_idx ON token_entries (user_id, account);
+CREATE INDEX token_transactions_job_id_idx ON token_transactions (job_id) WHERE job_id IS NOT NULL;
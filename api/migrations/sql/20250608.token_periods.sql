@@ -0,0 +1,17 @@
+-- Balances are derived from the token ledger now, nothing ever wrote to token_balances
+DROP TABLE token_balances;
+
+-- The allocation periods tokens are granted for, a user has at most one open period at a time
+CREATE TABLE token_periods
+(
+    id           serial PRIMARY KEY,
+    user_id      integer   NOT NULL REFERENCES users (id),
+    plan_id      integer   NOT NULL REFERENCES plans (id),
+    granted      integer   NOT NULL, -- Tokens granted at the start of the period
+    period_start timestamp NOT NULL,
+    period_end   timestamp NOT NULL,
+    closed_at    timestamp,
+    created_at   timestamp DEFAULT now()
+);
+
+CREATE UNIQUE INDEX token_periods_open_idx ON token_periods (user_id) WHERE closed_at IS NULL;
@@ -0,0 +1,19 @@
+CREATE TABLE stripe_events
+(
+    id              text PRIMARY KEY,   -- Stripe's event id, deliveries of the same event are only stored once
+    type            text      NOT NULL,
+    created         timestamp NOT NULL, -- When Stripe created the event, which is the order they're processed in
+    payload         jsonb     NOT NULL,
+    attempts        integer   NOT NULL DEFAULT 0,
+    last_error      text,
+    next_attempt_at timestamp NOT NULL DEFAULT now(),
+    processed_at    timestamp,
+    received_at     timestamp DEFAULT now()
+);
+
+-- The worker only ever looks at unprocessed events
+CREATE INDEX stripe_events_pending_idx ON stripe_events (created) WHERE processed_at IS NULL;
+
+-- The newest Stripe state applied to each subscription, anything older that arrives late is skipped
+ALTER TABLE subscriptions
+    ADD COLUMN last_event_at timestamp;
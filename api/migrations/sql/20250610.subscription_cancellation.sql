@@ -0,0 +1,3 @@
+-- Subscriptions cancelled at the end of their period stay active until then
+ALTER TABLE subscriptions
+    ADD COLUMN cancel_at_period_end bool NOT NULL DEFAULT FALSE;
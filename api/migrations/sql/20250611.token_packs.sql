@@ -0,0 +1,29 @@
+-- One-off packs of tokens bought through Checkout, on top of a plan's allocation
+CREATE TABLE token_packs
+(
+    id              serial PRIMARY KEY,
+    name            text UNIQUE NOT NULL,
+    tokens          integer     NOT NULL,
+    stripe_price_id text UNIQUE, -- One-off price in Stripe, packs without one can't be bought
+    active          bool        NOT NULL DEFAULT TRUE
+);
+
+INSERT INTO token_packs (name, tokens, stripe_price_id)
+VALUES ('Small', 500, null),
+       ('Medium', 2000, null),
+       ('Large', 10000, null);
+
+-- Purchased tokens come from their own account so they're never mistaken for a plan allocation and expired
+ALTER TABLE token_transactions
+    DROP CONSTRAINT token_transactions_kind_check,
+    ADD CONSTRAINT token_transactions_kind_check
+        CHECK (kind IN ('grant', 'purchase', 'reservation', 'debit', 'refund', 'expiration'));
+
+ALTER TABLE token_entries
+    DROP CONSTRAINT token_entries_account_check,
+    ADD CONSTRAINT token_entries_account_check
+        CHECK (account IN ('available', 'reserved', 'granted', 'purchased', 'spent', 'expired'));
+
+-- Purchases record the checkout session they were paid by, so a checkout is never credited twice
+ALTER TABLE token_transactions
+    ADD COLUMN reference text UNIQUE;
@@ -0,0 +1,3 @@
+-- Job listings are per user, ordered by one of these with the id breaking ties
+CREATE INDEX jobs_user_created_at_idx ON jobs (user_id, created_at, id);
+CREATE INDEX jobs_user_updated_at_idx ON jobs (user_id, updated_at, id);
@@ -0,0 +1,45 @@
+CREATE TABLE webhook_endpoints
+(
+    id         serial PRIMARY KEY,
+    user_id    integer   NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    url        text      NOT NULL,
+    secret     text      NOT NULL, -- Signs every delivery, so it has to be kept as is
+    events     text[]    NOT NULL,
+    created_at timestamp NOT NULL DEFAULT now(),
+    updated_at timestamp NOT NULL DEFAULT now()
+);
+
+CREATE INDEX webhook_endpoints_user_id_idx ON webhook_endpoints (user_id);
+
+CREATE TABLE webhook_deliveries
+(
+    id              serial PRIMARY KEY,
+    endpoint_id     integer   NOT NULL REFERENCES webhook_endpoints (id) ON DELETE CASCADE,
+    event_id        text      NOT NULL, -- Shared by every endpoint the event went to, and kept across redeliveries
+    event           text      NOT NULL,
+    job_id          integer REFERENCES jobs (id) ON DELETE SET NULL,
+    payload         jsonb     NOT NULL,
+    status          text      NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'failed')),
+    attempts        integer   NOT NULL DEFAULT 0,
+    next_attempt_at timestamp NOT NULL DEFAULT now(),
+    delivered_at    timestamp,
+    created_at      timestamp NOT NULL DEFAULT now()
+);
+
+-- The dispatcher only ever looks at pending deliveries
+CREATE INDEX webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX webhook_deliveries_endpoint_id_idx ON webhook_deliveries (endpoint_id, id);
+
+-- Every request made for a delivery, for users debugging their endpoints
+CREATE TABLE webhook_delivery_attempts
+(
+    id              serial PRIMARY KEY,
+    delivery_id     integer   NOT NULL REFERENCES webhook_deliveries (id) ON DELETE CASCADE,
+    response_status integer,
+    response_body   text,
+    error           text,
+    duration_ms     integer   NOT NULL,
+    created_at      timestamp NOT NULL DEFAULT now()
+);
+
+CREATE INDEX webhook_delivery_attempts_delivery_id_idx ON webhook_delivery_attempts (delivery_id, id);
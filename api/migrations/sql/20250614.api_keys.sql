@@ -0,0 +1,15 @@
+CREATE TABLE api_keys
+(
+    id           serial PRIMARY KEY,
+    user_id      integer   NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name         text      NOT NULL,
+    prefix       text      NOT NULL,        -- The start of the key, so users can tell their keys apart
+    key_hash     text      NOT NULL UNIQUE, -- The key itself is only shown when it is created
+    scopes       text[]    NOT NULL,
+    expires_at   timestamp,
+    last_used_at timestamp,
+    revoked_at   timestamp,
+    created_at   timestamp NOT NULL DEFAULT now()
+);
+
+CREATE INDEX api_keys_user_id_idx ON api_keys (user_id);
@@ -0,0 +1,7 @@
+-- The largest plan allocation a period has been granted for. Changing plan part way through a period only grants the
+-- prorated difference above it, so switching plans back and forth never grants the same allocation twice.
+ALTER TABLE token_periods
+    ADD COLUMN allocation integer NOT NULL DEFAULT 0;
+
+UPDATE token_periods
+SET allocation = granted;
@@ -0,0 +1,3 @@
+-- Events that run out of attempts are left without a next attempt, for someone to look at
+ALTER TABLE stripe_events
+    ALTER COLUMN next_attempt_at DROP NOT NULL;
@@ -0,0 +1,12 @@
+-- Messages are published to an exchange with a routing key rather than straight to a queue. The default exchange, '',
+-- routes to the queue the key names.
+ALTER TABLE outbox
+    RENAME COLUMN queue TO routing_key;
+
+ALTER TABLE outbox
+    ADD COLUMN exchange text NOT NULL DEFAULT '';
+
+UPDATE outbox
+SET exchange    = 'job_cancellations',
+    routing_key = ''
+WHERE routing_key = 'job_cancellations';
@@ -0,0 +1,6 @@
+-- Messages that keep failing to publish are given up on rather than retried forever
+ALTER TABLE outbox
+    ADD COLUMN failed_at timestamp;
+
+DROP INDEX outbox_pending_idx;
+CREATE INDEX outbox_pending_idx ON outbox (next_attempt_at) WHERE sent_at IS NULL AND failed_at IS NULL;
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"github.com/brysonmco/compressor/compression-service/internal/compression"
 	"github.com/brysonmco/compressor/compression-service/internal/containers"
 	"github.com/brysonmco/compressor/compression-service/internal/messaging"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 )
 
 func main() {
+	// Stop taking jobs on shutdown, anything unfinished is redelivered by the broker
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Container service
 	containerService := containers.NewService(os.Getenv("WORKER_IMAGE"))
 	err := containerService.InitializeClient()
@@ -28,4 +38,30 @@ func main() {
 	}
 	defer messagingService.Close()
 
+	// Compression service
+	compressionService := compression.NewService()
+	compressionService.ContainerService = containerService
+	compressionService.MessagingService = messagingService
+
+	// How many jobs this instance will run at once
+	concurrency := 4
+	if value := os.Getenv("MAX_CONCURRENT_JOBS"); value != "" {
+		concurrency, err = strconv.Atoi(value)
+		if err != nil || concurrency < 1 {
+			log.Fatalf("invalid MAX_CONCURRENT_JOBS: %v", value)
+		}
+	}
+
+	// Any instance could be running a job the API cancels
+	go func() {
+		err := messagingService.ConsumeCancellations(ctx, compressionService.CancelJob)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Print(err)
+		}
+	}()
+
+	err = messagingService.ConsumeJobs(ctx, concurrency, compressionService.HandleNewJob)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Print(err)
+	}
 }
@@ -1,26 +1,124 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"github.com/brysonmco/compressor/compression-service/internal/events"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+var emitter *events.Emitter
+
+// jobCtx is cancelled by POST /cancel, everything the worker starts for the job runs under it.
+var jobCtx, cancelJob = context.WithCancel(context.Background())
+
+// active tracks the curl, ffmpeg and upload work running in the background, so /cancel can wait for it to stop.
+var active sync.WaitGroup
+
+// stopping is set by /cancel, nothing is added to active after that, so it can be waited on. workMu is held while
+// checking it and adding to active.
+var (
+	workMu   sync.Mutex
+	stopping bool
+)
+
+// stopTimeout is how long processes are given to exit after SIGTERM before they are killed.
+const stopTimeout = 5 * time.Second
+
 func main() {
-	fmt.Println("APPLICATION_STARTED")
+	// The job ID is set by compression-service when it creates the container
+	jobId, err := strconv.ParseInt(os.Getenv("JOB_ID"), 10, 64)
+	if err != nil {
+		log.Printf("invalid JOB_ID, events will not be attributed to a job: %v", err)
+	}
+	emitter = events.NewEmitter(os.Stdout, jobId)
+
 	http.HandleFunc("POST /download", handleDownload)
 	http.HandleFunc("POST /probe", handleProbe)
 	http.HandleFunc("POST /compress", handleCompress)
+	http.HandleFunc("POST /upload", handleUpload)
+	http.HandleFunc("POST /cancel", handleCancel)
+
+	// Only announce ourselves once we are actually accepting connections
+	listener, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		emitFailure(events.ServerFailed, err.Error())
+		return
+	}
+	emit(events.ApplicationStarted, nil)
 
 	// Start the HTTP server
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		fmt.Println("SERVER_FAILED")
+	if err := http.Serve(listener, nil); err != nil {
+		emitFailure(events.ServerFailed, err.Error())
+	}
+}
+
+func emit(
+	eventType events.Type,
+	payload interface{},
+) {
+	if err := emitter.Emit(eventType, payload); err != nil {
+		log.Printf("error emitting %s event: %v", eventType, err)
+	}
+}
+
+func emitFailure(
+	eventType events.Type,
+	reason string,
+) {
+	emit(eventType, events.Failure{Error: reason})
+}
+
+// command creates a command that is stopped when the job is cancelled. It is sent SIGTERM first, so ffmpeg gets the
+// chance to close its output and curl its connection, and is killed if it hasn't exited within stopTimeout.
+func command(
+	name string,
+	args ...string,
+) *exec.Cmd {
+	cmd := exec.CommandContext(jobCtx, name, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
 	}
+	cmd.WaitDelay = stopTimeout
+	return cmd
+}
+
+// begin reserves a place in active for background work a handler is about to start. It reports false once the job is
+// being cancelled, in which case nothing may be started. active.Done must be called if the work isn't started after all.
+func begin() bool {
+	workMu.Lock()
+	defer workMu.Unlock()
+
+	if stopping {
+		return false
+	}
+	active.Add(1)
+	return true
+}
+
+// writeCancelled answers a request to start work once the job is being cancelled.
+func writeCancelled(w http.ResponseWriter) {
+	WriteError(w, http.StatusConflict, "job cancelled", "job_cancelled", nil)
+}
+
+// cancelled reports whether the job has been cancelled, failures after that are expected and not reported.
+func cancelled() bool {
+	return jobCtx.Err() != nil
 }
 
 // POST /download
@@ -32,13 +130,13 @@ type downloadRequest struct {
 func handleDownload(w http.ResponseWriter, r *http.Request) {
 	var req downloadRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		fmt.Println("DOWNLOAD_FAILED")
+		emitFailure(events.DownloadFailed, "invalid request body")
 		WriteError(w, http.StatusBadRequest, "invalid request body", "invalid_request_body", err)
 		return
 	}
 
 	if req.URL == "" || req.Container == "" {
-		fmt.Println("DOWNLOAD_FAILED")
+		emitFailure(events.DownloadFailed, "missing required fields")
 		WriteError(w, http.StatusBadRequest, "missing required fields", "missing_fields", "URL and Container are required")
 		return
 	}
@@ -46,34 +144,40 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 	// Get the expected length of the file
 	headResp, err := http.Head(req.URL)
 	if err != nil {
-		fmt.Println("DOWNLOAD_FAILED")
+		emitFailure(events.DownloadFailed, "could not fetch file info")
 		WriteError(w, http.StatusInternalServerError, "could not fetch file info", "fetch_error", err)
 		return
 	}
 	if headResp.StatusCode != http.StatusOK {
-		fmt.Println("DOWNLOAD_FAILED")
+		emitFailure(events.DownloadFailed, "file not found")
 		WriteError(w, http.StatusBadRequest, "file not found", "file_not_found", fmt.Sprintf("status code: %d", headResp.StatusCode))
 		return
 	}
 	contentLengthStr := headResp.Header.Get("Content-Length")
 	if contentLengthStr == "" {
-		fmt.Println("DOWNLOAD_FAILED")
+		emitFailure(events.DownloadFailed, "missing Content-Length header")
 		WriteError(w, http.StatusBadRequest, "missing Content-Length header", "missing_header", "Content-Length is required for download")
 		return
 	}
 	contentLength, err := strconv.ParseInt(contentLengthStr, 10, 64)
 	if err != nil {
-		fmt.Println("DOWNLOAD_FAILED")
+		emitFailure(events.DownloadFailed, "invalid Content-Length header")
 		WriteError(w, http.StatusBadRequest, "invalid Content-Length header", "invalid_header", err)
 		return
 	}
 
 	path := fmt.Sprintf("./input.%s", req.Container)
 
+	if !begin() {
+		writeCancelled(w)
+		return
+	}
+
 	// Download the file from the URL
 	cmd, err := downloadFile(req.URL, path)
 	if err != nil {
-		fmt.Println("DOWNLOAD_FAILED")
+		active.Done()
+		emitFailure(events.DownloadFailed, "could not download file")
 		WriteError(w, http.StatusInternalServerError, "could not download file", "download_error", err)
 		return
 	}
@@ -86,7 +190,7 @@ func downloadFile(
 	url string,
 	path string,
 ) (*exec.Cmd, error) {
-	cmd := exec.Command(
+	cmd := command(
 		"curl",
 		"-L",       // Follow redirects
 		"-o", path, // Output to the specified path
@@ -104,81 +208,84 @@ func watchDownload(
 	filePath string,
 	expectedLength int64,
 ) {
+	defer active.Done()
+
 	err := cmd.Wait()
+	if cancelled() {
+		return
+	}
 	if err != nil {
-		fmt.Println("DOWNLOAD_FAILED")
+		emitFailure(events.DownloadFailed, fmt.Sprintf("curl exited with error: %v", err))
 		return
 	}
 
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
-		fmt.Println("DOWNLOAD_FAILED")
+		emitFailure(events.DownloadFailed, "downloaded file not found")
 		return
 	}
 
 	if fileInfo.Size() != expectedLength {
-		fmt.Println("DOWNLOAD_FAILED")
+		emitFailure(events.DownloadFailed, fmt.Sprintf("expected %d bytes, got %d", expectedLength, fileInfo.Size()))
 		return
 	}
 
-	fmt.Println("DOWNLOAD_COMPLETED")
+	emit(events.DownloadCompleted, nil)
 }
 
 // POST /probe
-type fFProbeStream struct {
-	CodecName  string `json:"codec_name"`
-	CodecType  string `json:"codec_type"`
-	Width      int    `json:"width,omitempty"`
-	Height     int    `json:"height,omitempty"`
-	SampleRate string `json:"sample_rate,omitempty"`
+type probeRequest struct {
+	Container string `json:"container"`
 }
 
-type fFProbeFormat struct {
-	Filename   string `json:"filename"`
-	NbStreams  int    `json:"nb_streams"`
-	FormatName string `json:"format_name"`
-}
+func handleProbe(w http.ResponseWriter, r *http.Request) {
+	var req probeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		emitFailure(events.ProbeFailed, "invalid request body")
+		WriteError(w, http.StatusBadRequest, "invalid request body", "invalid_request_body", err)
+		return
+	}
 
-type fFProbeOutput struct {
-	Streams []fFProbeStream `json:"streams"`
-	Format  fFProbeFormat   `json:"format"`
+	if req.Container == "" {
+		emitFailure(events.ProbeFailed, "missing required fields")
+		WriteError(w, http.StatusBadRequest, "missing required fields", "missing_fields", "Container is required")
+		return
+	}
+
+	probeOutput, err := probeFile(fmt.Sprintf("./input.%s", req.Container))
+	if err != nil {
+		emitFailure(events.ProbeFailed, "could not probe input")
+		WriteError(w, http.StatusInternalServerError, "could not probe input", "ffprobe_error", err)
+		return
+	}
+
+	emit(events.ProbeData, probeOutput)
+
+	WriteSuccess(w, http.StatusOK, "probe data retrieved", probeOutput)
 }
 
-func handleProbe(w http.ResponseWriter, r *http.Request) {
-	cmd := exec.Command("ffprobe",
+func probeFile(
+	path string,
+) (*events.Probe, error) {
+	cmd := command("ffprobe",
 		"-v", "quiet",
 		"-print_format", "json",
 		"-show_format",
 		"-show_streams",
-		"",
+		path,
 	)
 
 	output, err := cmd.Output()
 	if err != nil {
-		fmt.Println("PROBE_FAILED")
-		WriteError(w, http.StatusInternalServerError, "could not run ffprobe", "ffprobe_error", err)
-		return
+		return nil, fmt.Errorf("could not run ffprobe: %v", err)
 	}
 
-	var probeOutput fFProbeOutput
+	var probeOutput events.Probe
 	if err = json.Unmarshal(output, &probeOutput); err != nil {
-		fmt.Println("PROBE_FAILED")
-		WriteError(w, http.StatusInternalServerError, "could not parse ffprobe output", "json_unmarshal_error", err)
-		return
+		return nil, fmt.Errorf("could not parse ffprobe output: %v", err)
 	}
 
-	probeBytes, err := json.Marshal(probeOutput)
-	if err != nil {
-		fmt.Println("PROBE_FAILED")
-		WriteError(w, http.StatusInternalServerError, "could not marshal ffprobe output", "json_marshal_error", err)
-		return
-	}
-
-	fmt.Println("START_PROBE_DATA")
-	fmt.Println(string(probeBytes))
-	fmt.Println("END_PROBE_DATA")
-
-	WriteSuccess(w, http.StatusOK, "probe data retrieved", probeOutput)
+	return &probeOutput, nil
 }
 
 // POST /compress
@@ -193,36 +300,97 @@ type compressRequest struct {
 	AudioBitrate    int    `json:"audioBitrate"`
 }
 
+// encoders maps the codecs users can pick to the ffmpeg encoder used for them.
+var encoders = map[string]string{
+	"h264": "libx264",
+	"h265": "libx265",
+}
+
 func handleCompress(w http.ResponseWriter, r *http.Request) {
 	var req compressRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		fmt.Println("COMPRESSION_FAILED")
+		emitFailure(events.CompressionFailed, "invalid request body")
 		WriteError(w, http.StatusBadRequest, "invalid request body", "invalid_request_body", err)
 		return
 	}
 
-	outputPath := fmt.Sprintf("./output.%s", req.InputContainer)
+	if req.InputContainer == "" || req.OutputContainer == "" || req.MaxWidth <= 0 || req.MaxHeight <= 0 ||
+		req.Preset == "" || req.AudioBitrate <= 0 {
+		emitFailure(events.CompressionFailed, "missing required fields")
+		WriteError(w, http.StatusBadRequest, "missing required fields", "missing_fields", nil)
+		return
+	}
 
-	cmd, err := compress(
-		fmt.Sprintf("./input.%s", req.InputContainer),
+	encoder, ok := encoders[req.Codec]
+	if !ok {
+		emitFailure(events.CompressionFailed, fmt.Sprintf("unsupported codec %q", req.Codec))
+		WriteError(w, http.StatusBadRequest, "unsupported codec", "unsupported_codec", req.Codec)
+		return
+	}
+
+	inputPath := fmt.Sprintf("./input.%s", req.InputContainer)
+	outputPath := fmt.Sprintf("./output.%s", req.OutputContainer)
+
+	// The probed duration is what progress percentages and ETAs are measured against
+	duration, err := probeDuration(inputPath)
+	if err != nil {
+		emitFailure(events.CompressionFailed, "could not determine input duration")
+		WriteError(w, http.StatusInternalServerError, "could not determine input duration", "ffprobe_error", err)
+		return
+	}
+
+	if !begin() {
+		writeCancelled(w)
+		return
+	}
+
+	cmd, progress, err := compress(
+		inputPath,
 		outputPath,
 		req.MaxWidth,
 		req.MaxHeight,
-		req.Codec,
+		encoder,
 		req.Crf,
 		req.Preset,
 		req.AudioBitrate,
 	)
 	if err != nil {
-		fmt.Println("COMPRESSION_FAILED")
+		active.Done()
+		emitFailure(events.CompressionFailed, "could not start compression")
 		WriteError(w, http.StatusInternalServerError, "could not start compression", "internal_error", err)
 		return
 	}
 
 	WriteSuccess(w, http.StatusCreated, "compression started", nil)
-	fmt.Println("STARTED_COMPRESSION")
+	emit(events.CompressionStarted, nil)
+
+	go watchCompression(cmd, progress, outputPath, duration)
+}
+
+func probeDuration(
+	inputPath string,
+) (float64, error) {
+	cmd := command("ffprobe",
+		"-v", "quiet",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		inputPath,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, err
+	}
+
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+	if err != nil {
+		return 0, err
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("invalid duration: %f", duration)
+	}
 
-	go watchCompression(cmd, outputPath)
+	return duration, nil
 }
 
 // TODO: currently only works for H.264 and H.265 codecs
@@ -231,21 +399,23 @@ func compress(
 	outputPath string,
 	maxWidth int,
 	maxHeight int,
-	codec string,
+	encoder string,
 	crf int,
 	preset string,
 	audioBitrate int,
-) (*exec.Cmd, error) {
+) (*exec.Cmd, io.ReadCloser, error) {
 	vf := fmt.Sprintf(
 		"scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease,pad=ceil(iw/2)*2:ceil(ih/2)*2",
 		maxWidth, maxHeight,
 	)
 
-	cmd := exec.Command(
+	cmd := command(
 		"ffmpeg",
+		"-nostats",
+		"-progress", "pipe:1", // Machine-readable progress on ffmpeg's stdout
 		"-i", inputPath,
 		"-vf", vf,
-		"-c:v", codec,
+		"-c:v", encoder,
 		"-crf", strconv.Itoa(crf),
 		"-preset", preset,
 		"-c:a", "aac",
@@ -253,29 +423,120 @@ func compress(
 		"-ar", "44100",
 		outputPath,
 	)
+
+	progress, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
 	if err := cmd.Start(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return cmd, nil
+	return cmd, progress, nil
+}
+
+// watchProgress reads the key=value blocks written by ffmpeg's -progress flag and reports each completed block.
+func watchProgress(
+	progress io.Reader,
+	duration float64,
+) {
+	scanner := bufio.NewScanner(progress)
+	values := map[string]string{}
+
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found {
+			continue
+		}
+		values[key] = strings.TrimSpace(value)
+
+		// Every block ends with progress=continue, or progress=end for the final one
+		if key != "progress" {
+			continue
+		}
+
+		emit(events.CompressionProgress, parseProgress(values, duration))
+
+		values = map[string]string{}
+	}
+}
+
+func parseProgress(
+	values map[string]string,
+	duration float64,
+) events.Progress {
+	p := events.Progress{Duration: duration}
+
+	// Despite the name, out_time_ms is reported in microseconds
+	if outTimeUs, err := strconv.ParseInt(values["out_time_us"], 10, 64); err == nil && outTimeUs > 0 {
+		p.OutTime = float64(outTimeUs) / 1e6
+	} else if outTimeMs, err := strconv.ParseInt(values["out_time_ms"], 10, 64); err == nil && outTimeMs > 0 {
+		p.OutTime = float64(outTimeMs) / 1e6
+	}
+
+	if fps, err := strconv.ParseFloat(values["fps"], 64); err == nil {
+		p.Fps = fps
+	}
+
+	if bitrate, err := strconv.ParseFloat(strings.TrimSuffix(values["bitrate"], "kbits/s"), 64); err == nil {
+		p.BitrateKbps = bitrate
+	}
+
+	if speed, err := strconv.ParseFloat(strings.TrimSuffix(values["speed"], "x"), 64); err == nil {
+		p.Speed = speed
+	}
+
+	if duration > 0 {
+		p.Percent = math.Min(p.OutTime/duration*100, 100)
+	}
+	if p.Speed > 0 {
+		p.EtaSeconds = math.Max(duration-p.OutTime, 0) / p.Speed
+	}
+
+	if values["progress"] == "end" {
+		p.Percent = 100
+		p.EtaSeconds = 0
+	}
+
+	return p
 }
 
 func watchCompression(
 	cmd *exec.Cmd,
+	progress io.Reader,
 	filePath string,
+	duration float64,
 ) {
+	defer active.Done()
+
+	// The progress pipe must be drained before waiting on the command
+	watchProgress(progress, duration)
+
 	err := cmd.Wait()
+	if cancelled() {
+		return
+	}
 	if err != nil {
-		fmt.Println("COMPRESSION_FAILED")
+		emitFailure(events.CompressionFailed, fmt.Sprintf("ffmpeg exited with error: %v", err))
+		return
 	}
 
 	// Ensure file is present
 	_, err = os.Stat(filePath)
 	if err != nil {
-		fmt.Println("COMPRESSION_FAILED")
+		emitFailure(events.CompressionFailed, "output file not found")
+		return
+	}
+
+	// Report what we actually produced
+	outputProbe, err := probeFile(filePath)
+	if err != nil {
+		emitFailure(events.CompressionFailed, "could not probe output")
+		return
 	}
 
-	fmt.Println("COMPRESSION_COMPLETED")
+	emit(events.CompressionCompleted, outputProbe)
 }
 
 // POST /upload
@@ -287,24 +548,155 @@ type uploadRequest struct {
 func handleUpload(w http.ResponseWriter, r *http.Request) {
 	var req uploadRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		fmt.Println("UPLOAD_FAILED")
+		emitFailure(events.UploadFailed, "invalid request body")
 		WriteError(w, http.StatusBadRequest, "invalid request body", "invalid_request_body", err)
 		return
 	}
 
 	if req.URL == "" || req.Container == "" {
-		fmt.Println("UPLOAD_FAILED")
+		emitFailure(events.UploadFailed, "missing required fields")
 		WriteError(w, http.StatusBadRequest, "missing required fields", "missing_fields", "URL and Container are required")
 		return
 	}
 
-	// Upload the file to the specified URL
-	cmd := exec.Command(
-		"curl",
-		"-X", "POST",
-		"-F", fmt.Sprintf("file=@%s", fmt.Sprintf("./output.%s", req.Container)),
-		"-F", fmt.Sprintf("container=%s", req.Container))
-	fmt.Println(cmd)
+	file, err := os.Open(fmt.Sprintf("./output.%s", req.Container))
+	if err != nil {
+		emitFailure(events.UploadFailed, "output file not found")
+		WriteError(w, http.StatusBadRequest, "output file not found", "file_not_found", err)
+		return
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		emitFailure(events.UploadFailed, "could not read output file")
+		WriteError(w, http.StatusInternalServerError, "could not read output file", "file_error", err)
+		return
+	}
+
+	if !begin() {
+		file.Close()
+		writeCancelled(w)
+		return
+	}
+
+	WriteSuccess(w, http.StatusCreated, "file upload started", nil)
+	go uploadFile(file, fileInfo.Size(), req.URL)
+}
+
+// uploadFile PUTs the file to a presigned URL. The object's ETag is checked against the MD5 of what we sent, which
+// confirms the stored object has the same size and contents as the local file.
+func uploadFile(
+	file *os.File,
+	size int64,
+	url string,
+) {
+	defer active.Done()
+	defer file.Close()
+
+	hash := md5.New()
+	body := &uploadReader{
+		reader:     io.TeeReader(file, hash),
+		total:      size,
+		lastReport: time.Now(),
+	}
+
+	req, err := http.NewRequestWithContext(jobCtx, http.MethodPut, url, body)
+	if err != nil {
+		emitFailure(events.UploadFailed, fmt.Sprintf("could not create request: %v", err))
+		return
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	emit(events.UploadStarted, events.Upload{TotalBytes: size})
+
+	resp, err := http.DefaultClient.Do(req)
+	if cancelled() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return
+	}
+	if err != nil {
+		emitFailure(events.UploadFailed, fmt.Sprintf("upload request failed: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		emitFailure(events.UploadFailed, fmt.Sprintf("upload rejected with status code %d", resp.StatusCode))
+		return
+	}
+
+	if body.sent != size {
+		emitFailure(events.UploadFailed, fmt.Sprintf("expected to send %d bytes, sent %d", size, body.sent))
+		return
+	}
+
+	// Multipart ETags aren't an MD5 of the object, we only ever do a single PUT though
+	etag := strings.Trim(resp.Header.Get("ETag"), `"`)
+	if etag == "" {
+		emitFailure(events.UploadFailed, "upload response has no ETag")
+		return
+	}
+	if checksum := hex.EncodeToString(hash.Sum(nil)); !strings.Contains(etag, "-") && etag != checksum {
+		emitFailure(events.UploadFailed, fmt.Sprintf("ETag %s does not match checksum %s", etag, checksum))
+		return
+	}
+
+	emit(events.UploadCompleted, events.UploadResult{
+		Size: size,
+		ETag: etag,
+	})
+}
+
+// uploadReader counts the bytes read from the underlying reader, emitting UPLOAD_PROGRESS at most once a second.
+type uploadReader struct {
+	reader     io.Reader
+	total      int64
+	sent       int64
+	lastReport time.Time
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.reader.Read(p)
+	u.sent += int64(n)
+
+	if time.Since(u.lastReport) >= time.Second {
+		u.lastReport = time.Now()
+		emit(events.UploadProgress, events.Upload{
+			BytesSent:  u.sent,
+			TotalBytes: u.total,
+			Percent:    math.Min(float64(u.sent)/float64(u.total)*100, 100),
+		})
+	}
+
+	return n, err
+}
+
+// POST /cancel
+func handleCancel(w http.ResponseWriter, r *http.Request) {
+	workMu.Lock()
+	stopping = true
+	workMu.Unlock()
+	cancelJob()
+
+	// Give whatever was running the chance to exit, it is killed after stopTimeout so this doesn't wait forever
+	stopped := make(chan struct{})
+	go func() {
+		active.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(stopTimeout + time.Second):
+		WriteError(w, http.StatusInternalServerError, "job did not stop", "stop_timeout", nil)
+		return
+	}
+
+	emit(events.JobCancelled, nil)
+	WriteSuccess(w, http.StatusOK, "job cancelled", nil)
 }
 
 type ErrorResponse struct { // Human-readable
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/brysonmco/compressor/compression-service/internal/events"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestParseProgress(t *testing.T) {
+	progress := parseProgress(map[string]string{
+		"fps":         "48.5",
+		"bitrate":     "1250.4kbits/s",
+		"out_time_us": "30000000",
+		"speed":       "2x",
+		"progress":    "continue",
+	}, 120)
+
+	if progress.Percent != 25 {
+		t.Errorf("Expected percent 25, got %f", progress.Percent)
+	}
+	if progress.EtaSeconds != 45 {
+		t.Errorf("Expected ETA 45 seconds, got %f", progress.EtaSeconds)
+	}
+	if progress.Fps != 48.5 {
+		t.Errorf("Expected fps 48.5, got %f", progress.Fps)
+	}
+	if progress.BitrateKbps != 1250.4 {
+		t.Errorf("Expected bitrate 1250.4, got %f", progress.BitrateKbps)
+	}
+}
+
+func TestParseProgressEnd(t *testing.T) {
+	progress := parseProgress(map[string]string{
+		"bitrate":     "N/A",
+		"out_time_us": "119500000",
+		"speed":       "N/A",
+		"progress":    "end",
+	}, 120)
+
+	if progress.Percent != 100 {
+		t.Errorf("Expected percent 100, got %f", progress.Percent)
+	}
+	if progress.EtaSeconds != 0 {
+		t.Errorf("Expected ETA 0 seconds, got %f", progress.EtaSeconds)
+	}
+	if progress.BitrateKbps != 0 {
+		t.Errorf("Expected bitrate 0 for N/A, got %f", progress.BitrateKbps)
+	}
+}
+
+func TestCancelStopsNewWork(t *testing.T) {
+	emitter = events.NewEmitter(io.Discard, 1)
+
+	// Work keeps trying to start while the job is cancelled
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for begin() {
+				active.Done()
+			}
+		}()
+	}
+
+	recorder := httptest.NewRecorder()
+	handleCancel(recorder, httptest.NewRequest(http.MethodPost, "/cancel", nil))
+	wg.Wait()
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", recorder.Code)
+	}
+	if begin() {
+		t.Error("Expected no work to start once the job is cancelled")
+	}
+	if !cancelled() {
+		t.Error("Expected the job to be cancelled")
+	}
+}
@@ -4,163 +4,455 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/brysonmco/compressor/compression-service/internal/containers"
+	workerevents "github.com/brysonmco/compressor/compression-service/internal/events"
+	"github.com/brysonmco/compressor/compression-service/internal/messaging"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type Service struct {
 	ContainerService *containers.Service
+	MessagingService *messaging.Service
+	mu               sync.Mutex
+	running          map[int64]context.CancelCauseFunc // Stops each job this instance is running
+	cancelled        map[int64]time.Time               // When jobs were cancelled, in case they are still queued
 }
 
 func NewService() *Service {
-	return &Service{}
+	return &Service{
+		running:   map[int64]context.CancelCauseFunc{},
+		cancelled: map[int64]time.Time{},
+	}
 }
 
-type fFProbeStream struct {
-	CodecName  string `json:"codec_name"`
-	CodecType  string `json:"codec_type"`
-	Width      int    `json:"width,omitempty"`
-	Height     int    `json:"height,omitempty"`
-	SampleRate string `json:"sample_rate,omitempty"`
-}
+// cancelledRetention is how long a cancellation is remembered for, a job still queued after this long runs anyway and
+// the API ignores its results.
+const cancelledRetention = 24 * time.Hour
+
+// errJobCancelled is the cause given to a job's context when the API cancels it.
+var errJobCancelled = errors.New("job cancelled")
 
-type fFProbeFormat struct {
-	Filename   string `json:"filename"`
-	NbStreams  int    `json:"nb_streams"`
-	FormatName string `json:"format_name"`
+// compressSettings are the options sent to the worker's /compress endpoint
+type compressSettings struct {
+	InputContainer  string `json:"inputContainer"`
+	OutputContainer string `json:"outputContainer"`
+	MaxWidth        int    `json:"maxWidth"`
+	MaxHeight       int    `json:"maxHeight"`
+	Codec           string `json:"codec"`
+	Crf             int    `json:"crf"`
+	Preset          string `json:"preset"`
+	AudioBitrate    int    `json:"audioBitrate"`
 }
 
-type fFProbeOutput struct {
-	Streams []fFProbeStream `json:"streams"`
-	Format  fFProbeFormat   `json:"format"`
+func newCompressSettings(job messaging.NewJobPayload) compressSettings {
+	return compressSettings{
+		InputContainer:  job.InputContainer,
+		OutputContainer: job.Output.Container,
+		MaxWidth:        job.Output.MaxWidth,
+		MaxHeight:       job.Output.MaxHeight,
+		Codec:           job.Output.Codec,
+		Crf:             job.Output.Crf,
+		Preset:          job.Output.Preset,
+		AudioBitrate:    job.Output.AudioBitrate,
+	}
 }
 
+// HandleNewJob runs a job in a fresh worker container, returning once the job has completed or failed. The outcome is
+// published to the API and the container is removed before returning.
 func (s *Service) HandleNewJob(
+	ctx context.Context,
 	jobId int64,
-	downloadUrl string,
-) {
-	var err error
+	job messaging.NewJobPayload,
+) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
 
-	// Create a new container, retrying up to 3 times if it fails
-	var container *containers.Container
-	for i := 0; i < 3; i++ {
-		container, err = s.ContainerService.NewContainer(jobId)
-		if err == nil {
-			break
-		}
-		if container != nil {
-			// If the container was created but failed to start, remove it
-			if err = s.ContainerService.RemoveContainer(container.Id); err != nil {
-				log.Printf("error removing container %s: %v", container.Id, err)
-			}
-		}
+	if !s.track(jobId, cancel) {
+		log.Printf("skipping job %d, it was cancelled while queued", jobId)
+		return nil
+	}
+	defer s.untrack(jobId)
 
-		if i == 2 {
-			log.Printf("failed to create container for job %d after 3 attempts: %v", jobId, err)
-			return
-		}
+	err := s.runJob(ctx, jobId, job)
+
+	// The API has already settled cancelled jobs, there is nothing to report
+	if errors.Is(context.Cause(ctx), errJobCancelled) {
+		log.Printf("job %d cancelled", jobId)
+		return nil
 	}
 
-	// Ensure the container was made
-	if container == nil || container.Id == "" {
-		log.Printf("failed to create container for job %d after 3 attempts: %v", jobId, err)
-		return
+	// Jobs interrupted by a shutdown are redelivered, they haven't failed
+	if err != nil && ctx.Err() == nil {
+		s.publishTerminalResult(jobId, messaging.ResultFailed, messaging.FailedPayload{Error: err.Error()})
 	}
+	return err
+}
+
+func (s *Service) runJob(
+	ctx context.Context,
+	jobId int64,
+	job messaging.NewJobPayload,
+) error {
+	container, err := s.createContainer(jobId)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := s.ContainerService.RemoveContainer(container.Id); err != nil {
+			log.Printf("error removing container %s: %v", container.Id, err)
+		}
+	}()
+
+	// Let the worker stop ffmpeg or curl itself before the container is removed
+	defer func() {
+		if errors.Is(context.Cause(ctx), errJobCancelled) {
+			s.stopWorker(container)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	events := make(chan containers.ContainerEvent)
 
 	go func() {
-		if err := s.ContainerService.MonitorOutput(context.TODO(), container.Id, events); err != nil {
+		defer close(events)
+		if err := s.ContainerService.MonitorOutput(ctx, container.Id, events); err != nil && ctx.Err() == nil {
 			log.Printf("error monitoring output for container %s: %v", container.Id, err)
-			return
 		}
 	}()
 
+	var lastSequence uint64
+	var outputData workerevents.Probe
 	for event := range events {
+		// Worker events are numbered, anything we have already seen is a replay of the container's logs
+		if event.Sequence != 0 {
+			if event.JobId != jobId {
+				log.Printf("ignoring event %s for job %d from container %s of job %d", event.Type, event.JobId, container.Id, jobId)
+				continue
+			}
+
+			if event.Sequence <= lastSequence {
+				continue
+			}
+			lastSequence = event.Sequence
+		}
+
 		switch event.Type {
-		case "APPLICATION_STARTED":
+		case workerevents.ApplicationStarted:
 			// Send download URL to the container
-			// TODO: This needs error handling and retries
-			body := map[string]string{
-				"url":       downloadUrl,
-				"container": "mp4",
-			}
-			bodyBytes, err := json.Marshal(body)
+			// TODO: Retry transient failures
+			err = s.callWorker(ctx, container, "/download", map[string]string{
+				"url":       job.DownloadUrl,
+				"container": job.InputContainer,
+			}, http.StatusCreated)
 			if err != nil {
-				// IRDK
-				return
+				return fmt.Errorf("error starting download: %v", err)
+			}
+			s.publishStage(ctx, jobId, messaging.ResultDownloading)
+
+		case workerevents.ServerFailed,
+			workerevents.DownloadFailed,
+			workerevents.ProbeFailed,
+			workerevents.CompressionFailed,
+			workerevents.UploadFailed:
+			var failure workerevents.Failure
+			if err := event.DecodePayload(&failure); err != nil {
+				failure.Error = "no reason given"
 			}
+			return fmt.Errorf("worker reported %s: %s", event.Type, failure.Error)
 
-			r, err := http.NewRequest("POST", fmt.Sprintf("http://localhost:%d/download", container.Port), bytes.NewBuffer(bodyBytes))
+		case workerevents.DownloadCompleted:
+			// Probe downloaded file
+			s.publishStage(ctx, jobId, messaging.ResultProbing)
+			err = s.callWorker(ctx, container, "/probe", map[string]string{
+				"container": job.InputContainer,
+			}, http.StatusOK)
 			if err != nil {
-				// IRDK
-				return
+				return fmt.Errorf("error probing input: %v", err)
 			}
-			r.Header.Add("Content-Type", "application/json")
-			client := &http.Client{}
-			resp, err := client.Do(r)
+
+		case workerevents.ProbeData:
+			var probeData workerevents.Probe
+			if err := event.DecodePayload(&probeData); err != nil {
+				return fmt.Errorf("error parsing probe data: %v", err)
+			}
+
+			probed := probedPayload(&probeData)
+			err = s.MessagingService.PublishResult(ctx, jobId, messaging.ResultProbed, probed)
 			if err != nil {
-				// IRDK
-				return
+				return fmt.Errorf("error publishing probe data: %v", err)
 			}
 
-			if resp.StatusCode != http.StatusCreated {
-				// IRDK
+			// The API only knows the input's resolution once it has been probed
+			if job.MaxResolution > 0 && int64(probed.Width)*int64(probed.Height) > job.MaxResolution {
+				return fmt.Errorf("input resolution %dx%d exceeds the plan's limit", probed.Width, probed.Height)
 			}
-			resp.Body.Close()
 
-		case "SERVER_FAILED":
-			// Try again??
-			// TODO: Implement
+			if err = s.callWorker(ctx, container, "/compress", newCompressSettings(job), http.StatusCreated); err != nil {
+				return fmt.Errorf("error starting compression: %v", err)
+			}
 
-		case "DOWNLOAD_FAILED":
-			// Try again??
-			// TODO: Implement
+		case workerevents.CompressionStarted:
+			s.publishStage(ctx, jobId, messaging.ResultStarted)
 
-		case "DOWNLOAD_COMPLETED":
-			// Probe downloaded file
-			// TODO: This needs error handling and retries
-			r, err := http.NewRequest("POST", fmt.Sprintf("http://localhost:%d/probe", container.Port), nil)
-			if err != nil {
-				// IRDK
+		case workerevents.CompressionProgress:
+			var progress workerevents.Progress
+			if err := event.DecodePayload(&progress); err != nil {
+				log.Printf("error parsing progress data for container %s: %v", container.Id, err)
+				break
 			}
 
-			client := &http.Client{}
-			resp, err := client.Do(r)
+			// Progress is best effort, the next update supersedes a lost one anyway
+			err = s.MessagingService.PublishResult(ctx, jobId, messaging.ResultProgress, messaging.ProgressPayload{
+				Percent:     progress.Percent,
+				EtaSeconds:  progress.EtaSeconds,
+				Fps:         progress.Fps,
+				BitrateKbps: progress.BitrateKbps,
+			})
 			if err != nil {
-				// IRDK
+				log.Printf("error publishing progress of job %d: %v", jobId, err)
 			}
-			defer resp.Body.Close()
 
-			if resp.StatusCode != http.StatusOK {
-				// IRDK
+		case workerevents.CompressionCompleted:
+			// Held on to until the output has been uploaded
+			if err := event.DecodePayload(&outputData); err != nil {
+				return fmt.Errorf("error parsing output data: %v", err)
 			}
 
-		case "PROBE_FAILED":
-			// Try again??
-			// TODO: Implement
-
-		case "PROBE_DATA":
-			var probeData fFProbeOutput
-			data, ok := event.Data.(map[string]interface{})
-			if !ok {
-				// IRDK
-			}
-			dataBytes, err := json.Marshal(data)
+			err = s.callWorker(ctx, container, "/upload", map[string]string{
+				"url":       job.UploadUrl,
+				"container": job.Output.Container,
+			}, http.StatusCreated)
 			if err != nil {
-				// IRDK
+				return fmt.Errorf("error starting upload: %v", err)
 			}
-			if err := json.Unmarshal(dataBytes, &probeData); err != nil {
-				// IRDK
+
+		case workerevents.UploadStarted:
+			s.publishStage(ctx, jobId, messaging.ResultUploading)
+
+		case workerevents.UploadProgress:
+
+		case workerevents.UploadCompleted:
+			var upload workerevents.UploadResult
+			if err := event.DecodePayload(&upload); err != nil {
+				return fmt.Errorf("error parsing upload data: %v", err)
 			}
 
-			// TODO: Pass this data back to the api
+			probed := probedPayload(&outputData)
+			s.publishTerminalResult(jobId, messaging.ResultCompleted, messaging.CompletedPayload{
+				Codec:  probed.Codec,
+				Width:  probed.Width,
+				Height: probed.Height,
+				Size:   upload.Size,
+			})
+			return nil
+
+		case containers.EventUnrecognized:
+			// Output from the worker that is not part of the protocol, e.g. ffmpeg or curl
+
+		case containers.EventError:
+			log.Printf("error reading events from container %s: %s", container.Id, event.Payload)
+
+		case containers.EventEOF:
+			return fmt.Errorf("container %s exited before the job finished", container.Id)
 
 		default:
 			log.Printf("Unknown event type for container %s: %s", container.Id, event.Type)
 		}
 	}
 
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("lost output of container %s before the job finished", container.Id)
+}
+
+// CancelJob stops a job if this instance is running it, and makes sure it won't be started if it is still queued.
+func (s *Service) CancelJob(jobId int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, cancelledAt := range s.cancelled {
+		if now.Sub(cancelledAt) > cancelledRetention {
+			delete(s.cancelled, id)
+		}
+	}
+	s.cancelled[jobId] = now
+
+	if cancel, ok := s.running[jobId]; ok {
+		cancel(errJobCancelled)
+	}
+}
+
+// track records that a job is running, returning false if it has already been cancelled.
+func (s *Service) track(
+	jobId int64,
+	cancel context.CancelCauseFunc,
+) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.cancelled[jobId]; ok {
+		return false
+	}
+	s.running[jobId] = cancel
+	return true
+}
+
+func (s *Service) untrack(jobId int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, jobId)
+}
+
+// stopWorker asks the worker to cancel whatever it is running. Failing isn't fatal, removing the container kills
+// everything in it anyway.
+func (s *Service) stopWorker(container *containers.Container) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if err := s.callWorker(ctx, container, "/cancel", nil, http.StatusOK); err != nil {
+		log.Printf("error stopping worker in container %s: %v", container.Id, err)
+	}
+}
+
+// createContainer creates the job's worker container, retrying up to 3 times if it fails.
+func (s *Service) createContainer(
+	jobId int64,
+) (*containers.Container, error) {
+	var err error
+	var container *containers.Container
+	for i := 0; i < 3; i++ {
+		container, err = s.ContainerService.NewContainer(jobId)
+		if err == nil {
+			break
+		}
+		if container != nil {
+			// If the container was created but failed to start, remove it
+			if err := s.ContainerService.RemoveContainer(container.Id); err != nil {
+				log.Printf("error removing container %s: %v", container.Id, err)
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container for job %d after 3 attempts: %v", jobId, err)
+	}
+
+	// Ensure the container was made
+	if container == nil || container.Id == "" {
+		return nil, fmt.Errorf("failed to create container for job %d", jobId)
+	}
+
+	return container, nil
+}
+
+// callWorker sends a request to one of the worker's endpoints, body is sent as JSON unless it is nil.
+func (s *Service) callWorker(
+	ctx context.Context,
+	container *containers.Container,
+	path string,
+	body interface{},
+	expectedStatus int,
+) error {
+	var reqBody io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewBuffer(bodyBytes)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	r, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("http://localhost:%d%s", container.Port, path), reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		r.Header.Add("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("worker returned %d for %s: %s", resp.StatusCode, path, respBody)
+	}
+	return nil
+}
+
+// publishStage publishes a result marking the job's progress through the pipeline. These are best effort, the API
+// accepts a job skipping ahead a stage.
+func (s *Service) publishStage(
+	ctx context.Context,
+	jobId int64,
+	event string,
+) {
+	if err := s.MessagingService.PublishResult(ctx, jobId, event, nil); err != nil {
+		log.Printf("error publishing %s result for job %d: %v", event, jobId, err)
+	}
+}
+
+// publishTerminalResult publishes a completed or failed result, retrying as the API has no other way of finding out
+// how the job ended.
+func (s *Service) publishTerminalResult(
+	jobId int64,
+	event string,
+	payload interface{},
+) {
+	backoff := time.Second
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := s.MessagingService.PublishResult(ctx, jobId, event, payload)
+		cancel()
+		if err == nil {
+			return
+		}
+
+		log.Printf("error publishing %s result for job %d (attempt %d): %v", event, jobId, i+1, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	log.Printf("giving up publishing %s result for job %d", event, jobId)
+}
+
+// probedPayload summarises ffprobe output, using the first video stream.
+func probedPayload(probe *workerevents.Probe) messaging.ProbedPayload {
+	payload := messaging.ProbedPayload{
+		Format: probe.Format.FormatName,
+	}
+
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "video" {
+			payload.Codec = stream.CodecName
+			payload.Width = stream.Width
+			payload.Height = stream.Height
+			break
+		}
+	}
+
+	// ffprobe reports these as strings
+	if size, err := strconv.ParseInt(probe.Format.Size, 10, 64); err == nil {
+		payload.Size = size
+	}
+	if duration, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		payload.Duration = duration
+	}
+
+	return payload
 }
@@ -0,0 +1,65 @@
+package compression
+
+import (
+	"context"
+	"errors"
+	"github.com/brysonmco/compressor/compression-service/internal/messaging"
+	"testing"
+	"time"
+)
+
+func TestCancelledWhileQueued(t *testing.T) {
+	s := NewService()
+	s.CancelJob(1)
+
+	// Containers and messaging are never touched, a nil service would panic if they were
+	if err := s.HandleNewJob(context.Background(), 1, messaging.NewJobPayload{}); err != nil {
+		t.Fatalf("Expected cancelled job to be skipped, got %v", err)
+	}
+
+	if s.track(1, func(error) {}) {
+		t.Error("Expected cancelled job not to be tracked")
+	}
+	if !s.track(2, func(error) {}) {
+		t.Error("Expected other jobs to be tracked")
+	}
+}
+
+func TestCancelRunningJob(t *testing.T) {
+	s := NewService()
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	if !s.track(1, cancel) {
+		t.Fatal("Failed to track job")
+	}
+
+	s.CancelJob(2)
+	if ctx.Err() != nil {
+		t.Fatal("Cancelling another job cancelled this one")
+	}
+
+	s.CancelJob(1)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Running job was not cancelled")
+	}
+	if !errors.Is(context.Cause(ctx), errJobCancelled) {
+		t.Errorf("Expected cause %v, got %v", errJobCancelled, context.Cause(ctx))
+	}
+}
+
+func TestCancelFinishedJob(t *testing.T) {
+	s := NewService()
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	s.track(1, cancel)
+	s.untrack(1)
+
+	s.CancelJob(1)
+	if ctx.Err() != nil {
+		t.Error("Cancelling a finished job cancelled its context")
+	}
+}
@@ -7,13 +7,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/brysonmco/compressor/compression-service/internal/events"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/registry"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
 	"io"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,8 +26,12 @@ type Service struct {
 	Client      *client.Client
 	WorkerImage string
 	Containers  []*Container
+	mu          sync.Mutex
 }
 
+// workerPort is the port the worker's HTTP server listens on inside the container
+const workerPort = nat.Port("8080/tcp")
+
 type Container struct {
 	Id    string `json:"id"`
 	JobId int64  `json:"jobId"`
@@ -94,8 +103,13 @@ func (s *Service) NewContainer(
 	containerName := fmt.Sprintf("worker-%d", jobId)
 
 	resp, err := s.Client.ContainerCreate(ctx, &container.Config{
-		Image: s.WorkerImage,
-	}, nil, nil, nil, containerName)
+		Image:        s.WorkerImage,
+		Env:          []string{fmt.Sprintf("JOB_ID=%d", jobId)},
+		ExposedPorts: nat.PortSet{workerPort: struct{}{}},
+	}, &container.HostConfig{
+		// Let Docker pick a free port on loopback, the worker is only ever reached from this host
+		PortBindings: nat.PortMap{workerPort: []nat.PortBinding{{HostIP: "127.0.0.1"}}},
+	}, nil, nil, containerName)
 	if err != nil {
 		return nil, fmt.Errorf("error creating container: %v", err)
 	}
@@ -105,13 +119,29 @@ func (s *Service) NewContainer(
 		JobId: jobId,
 	}
 
+	s.mu.Lock()
 	s.Containers = append(s.Containers, cont)
+	s.mu.Unlock()
 
 	err = s.Client.ContainerStart(ctx, resp.ID, container.StartOptions{})
 	if err != nil {
 		return cont, fmt.Errorf("error starting container: %v", err)
 	}
 
+	// Find out which host port we were given
+	inspect, err := s.Client.ContainerInspect(ctx, resp.ID)
+	if err != nil {
+		return cont, fmt.Errorf("error inspecting container: %v", err)
+	}
+	bindings := inspect.NetworkSettings.Ports[workerPort]
+	if len(bindings) == 0 {
+		return cont, fmt.Errorf("container has no port binding for %s", workerPort)
+	}
+	cont.Port, err = strconv.Atoi(bindings[0].HostPort)
+	if err != nil {
+		return cont, fmt.Errorf("invalid host port %q: %v", bindings[0].HostPort, err)
+	}
+
 	return cont, nil
 }
 
@@ -128,6 +158,8 @@ func (s *Service) RemoveContainer(
 		return fmt.Errorf("error removing container: %v", err)
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for i, cont := range s.Containers {
 		if cont.Id == containerId {
 			s.Containers = append(s.Containers[:i], s.Containers[i+1:]...)
@@ -139,6 +171,8 @@ func (s *Service) RemoveContainer(
 }
 
 func (s *Service) GetContainer(jobId int64) (*Container, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for _, cont := range s.Containers {
 		if cont.JobId == jobId {
 			return cont, nil
@@ -147,9 +181,39 @@ func (s *Service) GetContainer(jobId int64) (*Container, error) {
 	return nil, fmt.Errorf("container for job %d not found", jobId)
 }
 
+// Events raised by the monitor itself rather than the worker
+const (
+	EventEOF          events.Type = "EOF"
+	EventError        events.Type = "ERROR"
+	EventUnrecognized events.Type = "UNRECOGNIZED"
+)
+
 type ContainerEvent struct {
-	Type string      `json:"type"`
-	Data interface{} `json:"data"`
+	Type      events.Type     `json:"type"`
+	JobId     int64           `json:"jobId"`
+	Sequence  uint64          `json:"sequence"`
+	Timestamp time.Time       `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// DecodePayload unmarshals the event's payload into v.
+func (e *ContainerEvent) DecodePayload(v interface{}) error {
+	if len(e.Payload) == 0 {
+		return fmt.Errorf("event %s has no payload", e.Type)
+	}
+	return json.Unmarshal(e.Payload, v)
+}
+
+func newMonitorEvent(
+	eventType events.Type,
+	data interface{},
+) ContainerEvent {
+	payload, _ := json.Marshal(data)
+	return ContainerEvent{
+		Type:      eventType,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	}
 }
 
 func (s *Service) MonitorOutput(
@@ -168,10 +232,25 @@ func (s *Service) MonitorOutput(
 	}
 	defer resp.Close()
 
-	reader := bufio.NewReader(resp.Reader)
+	// Without a TTY, Docker multiplexes stdout and stderr into frames which have to be split apart before reading lines
+	output, writer := io.Pipe()
+	defer output.Close()
+	go func() {
+		_, err := stdcopy.StdCopy(writer, writer, resp.Reader)
+		writer.CloseWithError(err)
+	}()
 
-	var collectingJSON bool
-	var jsonBuffer strings.Builder
+	reader := bufio.NewReader(output)
+
+	// Don't block forever on a receiver that has stopped listening
+	send := func(event ContainerEvent) error {
+		select {
+		case events <- event:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 
 	for {
 		select {
@@ -181,59 +260,39 @@ func (s *Service) MonitorOutput(
 			line, err := reader.ReadString('\n')
 			if err != nil {
 				if err == io.EOF {
-					events <- ContainerEvent{Type: "EOF", Data: nil}
-					return nil
+					return send(ContainerEvent{Type: EventEOF, Timestamp: time.Now()})
 				}
 				return fmt.Errorf("error reading container output: %v", err)
 			}
 
-			line = strings.TrimSpace(line)
-
-			switch line {
-			case "APPLICATION_STARTED":
-				events <- ContainerEvent{Type: "APPLICATION_STARTED", Data: nil}
-
-			case "SERVER_FAILED":
-				events <- ContainerEvent{Type: "SERVER_FAILED", Data: nil}
-
-			case "DOWNLOAD_FAILED":
-				events <- ContainerEvent{Type: "DOWNLOAD_FAILED", Data: nil}
-
-			case "DOWNLOAD_COMPLETED":
-				events <- ContainerEvent{Type: "DOWNLOAD_COMPLETED", Data: nil}
-
-			case "PROBE_FAILED":
-				events <- ContainerEvent{Type: "PROBE_FAILED", Data: nil}
-
-			case "START_PROBE_DATA":
-				collectingJSON = true
-				jsonBuffer.Reset()
-
-			case "END_PROBE_DATA":
-				collectingJSON = false
-				var probeData map[string]interface{}
-				if err := json.Unmarshal([]byte(jsonBuffer.String()), &probeData); err != nil {
-					events <- ContainerEvent{Type: "ERROR", Data: fmt.Sprintf("error parsing probe data: %v", err)}
-				} else {
-					events <- ContainerEvent{Type: "PROBE_DATA", Data: probeData}
-				}
-
-			case "COMPRESSION_FAILED":
-				events <- ContainerEvent{Type: "COMPRESSION_FAILED", Data: nil}
-
-			case "COMPRESSION_STARTED":
-				events <- ContainerEvent{Type: "COMPRESSION_STARTED", Data: nil}
-
-			case "COMPRESSION_COMPLETED":
-				events <- ContainerEvent{Type: "COMPRESSION_COMPLETED", Data: nil}
-			default:
-				if collectingJSON {
-					jsonBuffer.WriteString(line)
-					jsonBuffer.WriteString("\n")
-				} else {
-					events <- ContainerEvent{Type: "UNRECOGNIZED", Data: line}
-				}
+			event, err := decodeLine(line)
+			if err != nil {
+				event = newMonitorEvent(EventError, err.Error())
+			}
+			if err = send(event); err != nil {
+				return err
 			}
 		}
 	}
 }
+
+// decodeLine turns a line of container output into an event, output that is not part of the protocol is passed
+// through as UNRECOGNIZED.
+func decodeLine(line string) (ContainerEvent, error) {
+	line = strings.TrimSpace(line)
+
+	event, err := events.Decode([]byte(line))
+	if errors.Is(err, events.ErrNotAnEvent) {
+		return newMonitorEvent(EventUnrecognized, line), nil
+	} else if err != nil {
+		return ContainerEvent{}, fmt.Errorf("error decoding event: %v", err)
+	}
+
+	return ContainerEvent{
+		Type:      event.Type,
+		JobId:     event.JobId,
+		Sequence:  event.Sequence,
+		Timestamp: event.Timestamp,
+		Payload:   event.Payload,
+	}, nil
+}
@@ -0,0 +1,186 @@
+// Package events defines the protocol the worker container uses to report back to compression-service.
+//
+// Every event is written to the worker's stdout as a single line of JSON. Anything else on stdout (ffmpeg output,
+// logs, etc.) is not part of the protocol and is ignored by the reader.
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Version is the protocol version written by this build. Readers reject events with any other version.
+const Version = 1
+
+type Type string
+
+const (
+	ApplicationStarted   Type = "APPLICATION_STARTED"
+	ServerFailed         Type = "SERVER_FAILED"
+	DownloadCompleted    Type = "DOWNLOAD_COMPLETED"
+	DownloadFailed       Type = "DOWNLOAD_FAILED"
+	ProbeData            Type = "PROBE_DATA"
+	ProbeFailed          Type = "PROBE_FAILED"
+	CompressionStarted   Type = "COMPRESSION_STARTED"
+	CompressionProgress  Type = "PROGRESS"
+	CompressionCompleted Type = "COMPRESSION_COMPLETED"
+	CompressionFailed    Type = "COMPRESSION_FAILED"
+	UploadStarted        Type = "UPLOAD_STARTED"
+	UploadProgress       Type = "UPLOAD_PROGRESS"
+	UploadCompleted      Type = "UPLOAD_COMPLETED"
+	UploadFailed         Type = "UPLOAD_FAILED"
+	JobCancelled         Type = "JOB_CANCELLED"
+)
+
+var (
+	ErrNotAnEvent         = errors.New("line is not an event")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+)
+
+type Event struct {
+	Version   int             `json:"version"`
+	Type      Type            `json:"type"`
+	JobId     int64           `json:"jobId"`
+	Sequence  uint64          `json:"sequence"`
+	Timestamp time.Time       `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// DecodePayload unmarshals the event's payload into v.
+func (e *Event) DecodePayload(v interface{}) error {
+	if len(e.Payload) == 0 {
+		return fmt.Errorf("event %s has no payload", e.Type)
+	}
+	return json.Unmarshal(e.Payload, v)
+}
+
+// Decode parses a single line of worker output. Lines that are not events return ErrNotAnEvent, events written with
+// a different protocol version return ErrUnsupportedVersion.
+func Decode(line []byte) (*Event, error) {
+	if len(line) == 0 || line[0] != '{' {
+		return nil, ErrNotAnEvent
+	}
+
+	var event Event
+	if err := json.Unmarshal(line, &event); err != nil {
+		return nil, ErrNotAnEvent
+	}
+	if event.Type == "" || event.Version == 0 {
+		return nil, ErrNotAnEvent
+	}
+
+	if event.Version != Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, event.Version)
+	}
+
+	return &event, nil
+}
+
+// Emitter writes events for a single job, numbering them in the order they are emitted.
+type Emitter struct {
+	mu       sync.Mutex
+	writer   io.Writer
+	jobId    int64
+	sequence uint64
+}
+
+func NewEmitter(
+	writer io.Writer,
+	jobId int64,
+) *Emitter {
+	return &Emitter{
+		writer: writer,
+		jobId:  jobId,
+	}
+}
+
+// Emit writes an event with the given payload, payload may be nil.
+func (e *Emitter) Emit(
+	eventType Type,
+	payload interface{},
+) error {
+	var payloadBytes json.RawMessage
+	if payload != nil {
+		var err error
+		payloadBytes, err = json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("error marshalling %s payload: %v", eventType, err)
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.sequence++
+	line, err := json.Marshal(Event{
+		Version:   Version,
+		Type:      eventType,
+		JobId:     e.jobId,
+		Sequence:  e.sequence,
+		Timestamp: time.Now(),
+		Payload:   payloadBytes,
+	})
+	if err != nil {
+		return fmt.Errorf("error marshalling %s event: %v", eventType, err)
+	}
+
+	// A single write keeps the event on its own line even if something else is writing to the same stream
+	_, err = e.writer.Write(append(line, '\n'))
+	return err
+}
+
+// Failure is the payload of every *_FAILED event.
+type Failure struct {
+	Error string `json:"error"`
+}
+
+type ProbeStream struct {
+	CodecName  string `json:"codec_name"`
+	CodecType  string `json:"codec_type"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	SampleRate string `json:"sample_rate,omitempty"`
+}
+
+type ProbeFormat struct {
+	Filename   string `json:"filename"`
+	NbStreams  int    `json:"nb_streams"`
+	FormatName string `json:"format_name"`
+	Duration   string `json:"duration,omitempty"`
+	Size       string `json:"size,omitempty"`
+}
+
+// Probe is the payload of PROBE_DATA and COMPRESSION_COMPLETED, it mirrors the subset of ffprobe's JSON output we
+// care about.
+type Probe struct {
+	Streams []ProbeStream `json:"streams"`
+	Format  ProbeFormat   `json:"format"`
+}
+
+// Progress is the payload of PROGRESS.
+type Progress struct {
+	Percent     float64 `json:"percent"`
+	EtaSeconds  float64 `json:"etaSeconds"`
+	Fps         float64 `json:"fps"`
+	BitrateKbps float64 `json:"bitrateKbps"`
+	Speed       float64 `json:"speed"`
+	OutTime     float64 `json:"outTime"`
+	Duration    float64 `json:"duration"`
+}
+
+// Upload is the payload of UPLOAD_STARTED and UPLOAD_PROGRESS.
+type Upload struct {
+	BytesSent  int64   `json:"bytesSent"`
+	TotalBytes int64   `json:"totalBytes"`
+	Percent    float64 `json:"percent"`
+}
+
+// UploadResult is the payload of UPLOAD_COMPLETED.
+type UploadResult struct {
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+}
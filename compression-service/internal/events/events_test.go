@@ -0,0 +1,62 @@
+package events
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEmitAndDecode(t *testing.T) {
+	var buf bytes.Buffer
+	emitter := NewEmitter(&buf, 32)
+
+	if err := emitter.Emit(ApplicationStarted, nil); err != nil {
+		t.Fatalf("Failed to emit event: %v", err)
+	}
+	if err := emitter.Emit(CompressionProgress, Progress{Percent: 50}); err != nil {
+		t.Fatalf("Failed to emit event: %v", err)
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(lines))
+	}
+
+	event, err := Decode(lines[1])
+	if err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if event.Type != CompressionProgress || event.JobId != 32 || event.Sequence != 2 {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+
+	var progress Progress
+	if err := event.DecodePayload(&progress); err != nil {
+		t.Fatalf("Failed to decode payload: %v", err)
+	}
+	if progress.Percent != 50 {
+		t.Errorf("Expected percent 50, got %f", progress.Percent)
+	}
+}
+
+func TestDecodeRejectsNonEvents(t *testing.T) {
+	lines := []string{
+		"",
+		"APPLICATION_STARTED",
+		"frame=  120 fps= 30 q=28.0 size=     256kB time=00:00:04.00 COMPRESSION_FAILED",
+		`{"streams": []}`,
+	}
+
+	for _, line := range lines {
+		if _, err := Decode([]byte(line)); !errors.Is(err, ErrNotAnEvent) {
+			t.Errorf("Expected ErrNotAnEvent for %q, got %v", line, err)
+		}
+	}
+}
+
+func TestDecodeRejectsUnknownVersion(t *testing.T) {
+	_, err := Decode([]byte(`{"version":2,"type":"APPLICATION_STARTED","jobId":1,"sequence":1}`))
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected ErrUnsupportedVersion, got %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log"
+	"time"
+)
+
+// CancellationsExchange is the durable fanout exchange the API publishes cancel messages to. Every instance binds its
+// own queue to it, as any of them could be running the job.
+const CancellationsExchange = "job_cancellations"
+
+// CancelHandler stops a job if this instance is running it.
+type CancelHandler func(jobId int64)
+
+// ConsumeCancellations passes every cancel message to handler until ctx is cancelled. The queue is exclusive to this
+// connection, so cancellations published while we are disconnected are missed, the API ignores results from jobs it
+// has cancelled either way.
+func (s *Service) ConsumeCancellations(
+	ctx context.Context,
+	handler CancelHandler,
+) error {
+	backoff := time.Second
+	for {
+		err := s.consumeCancellations(ctx, handler)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		log.Printf("cancellation consumer disconnected, reconnecting in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		if errors.Is(err, errConsumerClosed) {
+			backoff = time.Second
+		} else {
+			backoff = min(backoff*2, time.Minute)
+		}
+	}
+}
+
+func (s *Service) consumeCancellations(
+	ctx context.Context,
+	handler CancelHandler,
+) error {
+	ch, err := s.channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	err = ch.ExchangeDeclare(
+		CancellationsExchange,
+		"fanout",
+		true,  // Durable
+		false, // Auto-delete
+		false, // Internal
+		false, // No-wait
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error declaring cancellations exchange: %v", err)
+	}
+
+	queue, err := ch.QueueDeclare(
+		"",    // Named by the broker
+		false, // Durable
+		true,  // Auto-delete
+		true,  // Exclusive
+		false, // No-wait
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error declaring cancellations queue: %v", err)
+	}
+
+	if err = ch.QueueBind(queue.Name, "", CancellationsExchange, false, nil); err != nil {
+		return fmt.Errorf("error binding cancellations queue: %v", err)
+	}
+
+	deliveries, err := ch.Consume(
+		queue.Name,
+		"",    // Consumer tag, generated by the broker
+		true,  // Auto-ack, there is nothing to retry
+		true,  // Exclusive
+		false, // No-local
+		false, // No-wait
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error consuming cancellations queue: %v", err)
+	}
+
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case amqpErr := <-closed:
+			return fmt.Errorf("%w: %v", errConsumerClosed, amqpErr)
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return errConsumerClosed
+			}
+
+			var msg JobMessage
+			if err := json.Unmarshal(delivery.Body, &msg); err != nil || msg.Event != "cancel_job" {
+				log.Printf("discarding malformed cancel message: %s", delivery.Body)
+				continue
+			}
+			handler(msg.JobId)
+		}
+	}
+}
@@ -1,12 +1,26 @@
 package messaging
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"log"
+	"sync"
+	"time"
 )
 
+// JobsQueue is the durable queue the API publishes new jobs to.
+const JobsQueue = "jobs"
+
 type Service struct {
-	Connection *amqp.Connection
+	Connection     *amqp.Connection
+	url            string
+	mu             sync.Mutex
+	publishChannel *amqp.Channel
+	publishMu      sync.Mutex
+	lastSequence   int64
 }
 
 func NewService() *Service {
@@ -18,8 +32,8 @@ func (s *Service) Connect(
 	password string,
 	host string,
 ) error {
-	connStr := fmt.Sprintf("amqp://%s:%s@%s/", username, password, host)
-	conn, err := amqp.Dial(connStr)
+	s.url = fmt.Sprintf("amqp://%s:%s@%s/", username, password, host)
+	conn, err := amqp.Dial(s.url)
 	if err != nil {
 		return err
 	}
@@ -28,5 +42,236 @@ func (s *Service) Connect(
 }
 
 func (s *Service) Close() error {
+	s.publishMu.Lock()
+	if s.publishChannel != nil {
+		s.publishChannel.Close()
+	}
+	s.publishMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.Connection.Close()
 }
+
+// channel opens a channel on the current connection, redialing the broker first if the connection has dropped.
+func (s *Service) channel() (*amqp.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Connection == nil || s.Connection.IsClosed() {
+		conn, err := amqp.Dial(s.url)
+		if err != nil {
+			return nil, fmt.Errorf("error reconnecting to broker: %v", err)
+		}
+		s.Connection = conn
+	}
+
+	return s.Connection.Channel()
+}
+
+type JobMessage struct {
+	Event   string          `json:"event"`
+	JobId   int64           `json:"job_id"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type NewJobPayload struct {
+	DownloadUrl    string         `json:"download_url"`
+	UploadUrl      string         `json:"upload_url"`
+	InputContainer string         `json:"input_container"`
+	MaxResolution  int64          `json:"max_resolution"` // width * height, -1 for unlimited
+	Output         OutputSettings `json:"output"`
+}
+
+type OutputSettings struct {
+	Codec        string `json:"codec"`
+	Container    string `json:"container"`
+	Crf          int    `json:"crf"`
+	Preset       string `json:"preset"`
+	MaxWidth     int    `json:"max_width"`
+	MaxHeight    int    `json:"max_height"`
+	AudioBitrate int    `json:"audio_bitrate"`
+}
+
+// JobHandler runs a job to completion, it must only return once the job has reached a terminal state.
+type JobHandler func(ctx context.Context, jobId int64, payload NewJobPayload) error
+
+// ConsumeJobs consumes the jobs queue until ctx is cancelled, running up to concurrency jobs at a time. Messages are
+// only acknowledged once their handler returns, if the broker goes away the channel is re-established with backoff
+// and unacknowledged jobs are redelivered by the broker.
+func (s *Service) ConsumeJobs(
+	ctx context.Context,
+	concurrency int,
+	handler JobHandler,
+) error {
+	consumer := &jobConsumer{
+		handler: handler,
+		active:  map[int64]chan struct{}{},
+	}
+
+	backoff := time.Second
+	for {
+		err := s.consumeJobs(ctx, concurrency, consumer)
+		if ctx.Err() != nil {
+			consumer.wait()
+			return ctx.Err()
+		}
+
+		log.Printf("job consumer disconnected, reconnecting in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			consumer.wait()
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		// Reset the backoff once we have managed to consume again
+		if errors.Is(err, errConsumerClosed) {
+			backoff = time.Second
+		} else {
+			backoff = min(backoff*2, time.Minute)
+		}
+	}
+}
+
+// errConsumerClosed means the consumer was running and then lost its channel, as opposed to failing to start.
+var errConsumerClosed = errors.New("channel closed")
+
+func (s *Service) consumeJobs(
+	ctx context.Context,
+	concurrency int,
+	consumer *jobConsumer,
+) error {
+	ch, err := s.channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	_, err = ch.QueueDeclare(
+		JobsQueue,
+		true,  // Durable
+		false, // Auto-delete
+		false, // Exclusive
+		false, // No-wait
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error declaring jobs queue: %v", err)
+	}
+
+	// Don't take more jobs off the queue than we are willing to run at once
+	if err = ch.Qos(concurrency, 0, false); err != nil {
+		return fmt.Errorf("error setting prefetch: %v", err)
+	}
+
+	deliveries, err := ch.Consume(
+		JobsQueue,
+		"",    // Consumer tag, generated by the broker
+		false, // Auto-ack
+		false, // Exclusive
+		false, // No-local
+		false, // No-wait
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error consuming jobs queue: %v", err)
+	}
+
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case amqpErr := <-closed:
+			return fmt.Errorf("%w: %v", errConsumerClosed, amqpErr)
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return errConsumerClosed
+			}
+			consumer.dispatch(ctx, delivery)
+		}
+	}
+}
+
+type jobConsumer struct {
+	handler JobHandler
+	mu      sync.Mutex
+	active  map[int64]chan struct{} // Closed when the job finishes
+	wg      sync.WaitGroup
+}
+
+func (c *jobConsumer) dispatch(
+	ctx context.Context,
+	delivery amqp.Delivery,
+) {
+	var msg JobMessage
+	if err := json.Unmarshal(delivery.Body, &msg); err != nil || msg.Event != "new_job" {
+		log.Printf("discarding malformed job message: %s", delivery.Body)
+		if err := delivery.Nack(false, false); err != nil {
+			log.Printf("error rejecting job message: %v", err)
+		}
+		return
+	}
+
+	var payload NewJobPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		log.Printf("discarding job %d with malformed payload: %v", msg.JobId, err)
+		if err := delivery.Nack(false, false); err != nil {
+			log.Printf("error rejecting job message: %v", err)
+		}
+		return
+	}
+
+	c.mu.Lock()
+	running, isRunning := c.active[msg.JobId]
+	done := make(chan struct{})
+	if !isRunning {
+		c.active[msg.JobId] = done
+	}
+	c.mu.Unlock()
+
+	c.wg.Add(1)
+
+	// A redelivery after a reconnect, the job is still running from the original delivery so just settle this one
+	// once it finishes
+	if isRunning {
+		go func() {
+			defer c.wg.Done()
+			<-running
+			if err := delivery.Ack(false); err != nil {
+				log.Printf("error acknowledging redelivered job %d: %v", msg.JobId, err)
+			}
+		}()
+		return
+	}
+
+	go func() {
+		defer c.wg.Done()
+		defer func() {
+			c.mu.Lock()
+			delete(c.active, msg.JobId)
+			c.mu.Unlock()
+			close(done)
+		}()
+
+		if err := c.handler(ctx, msg.JobId, payload); err != nil {
+			log.Printf("job %d failed: %v", msg.JobId, err)
+		}
+
+		// If we are shutting down the job did not actually finish, leave it for the broker to redeliver
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Failed jobs have still reached a terminal state, retrying them is not the queue's job
+		if err := delivery.Ack(false); err != nil {
+			log.Printf("error acknowledging job %d: %v", msg.JobId, err)
+		}
+	}()
+}
+
+func (c *jobConsumer) wait() {
+	c.wg.Wait()
+}
@@ -0,0 +1,157 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"time"
+)
+
+// ResultsExchange is the durable topic exchange job results are published to, routed by "job.<event>".
+const ResultsExchange = "job_results"
+
+// Job result events
+const (
+	ResultDownloading = "downloading"
+	ResultProbing     = "probing"
+	ResultProbed      = "probed"
+	ResultStarted     = "started"
+	ResultProgress    = "progress"
+	ResultUploading   = "uploading"
+	ResultCompleted   = "completed"
+	ResultFailed      = "failed"
+)
+
+type JobResult struct {
+	Event string `json:"event"`
+	JobId int64  `json:"job_id"`
+	// Sequence orders a job's results, the API ignores anything not newer than what it has already applied. It is
+	// derived from the clock so a job that is re-run after a redelivery carries on where the previous run left off.
+	Sequence  int64           `json:"sequence"`
+	Timestamp time.Time       `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+type ProbedPayload struct {
+	Codec    string  `json:"codec"`
+	Format   string  `json:"format"`
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	Size     int64   `json:"size"`
+	Duration float64 `json:"duration"`
+}
+
+type ProgressPayload struct {
+	Percent     float64 `json:"percent"`
+	EtaSeconds  float64 `json:"etaSeconds"`
+	Fps         float64 `json:"fps"`
+	BitrateKbps float64 `json:"bitrateKbps"`
+}
+
+type CompletedPayload struct {
+	Codec  string `json:"codec"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Size   int64  `json:"size"`
+}
+
+type FailedPayload struct {
+	Error string `json:"error"`
+}
+
+// PublishResult publishes a result for a job, waiting for the broker to confirm it.
+func (s *Service) PublishResult(
+	ctx context.Context,
+	jobId int64,
+	event string,
+	payload interface{},
+) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+
+	if s.publishChannel == nil || s.publishChannel.IsClosed() {
+		if err = s.openPublishChannel(); err != nil {
+			return err
+		}
+	}
+
+	// Strictly increasing, even if the clock hasn't moved since the last result
+	sequence := time.Now().UnixNano()
+	if sequence <= s.lastSequence {
+		sequence = s.lastSequence + 1
+	}
+	s.lastSequence = sequence
+
+	body, err := json.Marshal(JobResult{
+		Event:     event,
+		JobId:     jobId,
+		Sequence:  sequence,
+		Timestamp: time.Now(),
+		Payload:   payloadBytes,
+	})
+	if err != nil {
+		return err
+	}
+
+	confirmation, err := s.publishChannel.PublishWithDeferredConfirmWithContext(ctx,
+		ResultsExchange,
+		"job."+event,
+		false, // Mandatory
+		false, // Immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("error publishing result: %v", err)
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error waiting for publisher confirm: %v", err)
+	}
+	if !acked {
+		return fmt.Errorf("broker rejected %s result for job %d", event, jobId)
+	}
+
+	return nil
+}
+
+// openPublishChannel opens a confirming channel for results, callers must hold publishMu.
+func (s *Service) openPublishChannel() error {
+	ch, err := s.channel()
+	if err != nil {
+		return err
+	}
+
+	if err = ch.Confirm(false); err != nil {
+		ch.Close()
+		return fmt.Errorf("error enabling publisher confirms: %v", err)
+	}
+
+	// Must match the declaration in the api
+	err = ch.ExchangeDeclare(
+		ResultsExchange,
+		"topic",
+		true,  // Durable
+		false, // Auto-delete
+		false, // Internal
+		false, // No-wait
+		nil,
+	)
+	if err != nil {
+		ch.Close()
+		return fmt.Errorf("error declaring results exchange: %v", err)
+	}
+
+	s.publishChannel = ch
+	return nil
+}